@@ -0,0 +1,439 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/callus-corn/tao/internal/config"
+	"github.com/callus-corn/tao/internal/dhcp"
+	"github.com/callus-corn/tao/internal/host"
+	"github.com/callus-corn/tao/internal/inventory"
+	"github.com/callus-corn/tao/internal/profile"
+	"github.com/callus-corn/tao/internal/store"
+	"github.com/callus-corn/tao/internal/tftp"
+)
+
+type APIConfig struct {
+	IsEnable bool   `json:"IsEnable"`
+	Address  string `json:"Address"`
+	Token    string `json:"Token"`
+}
+
+type errorResponse struct {
+	Error string `json:"Error"`
+}
+
+// Control connects the API to the daemon.
+type Control struct {
+	// Health reports the health of each subsystem by its name.
+	Health map[string]func() error
+	// Reload reloads the config file.
+	Reload func() error
+	// DHCP and TFTP are the running servers, nil when they are disabled.
+	DHCP *dhcp.Server
+	TFTP *tftp.Server
+	// Hosts and Profiles are the registries shared by the servers.
+	Hosts    *host.Registry
+	Profiles *profile.Registry
+	// Inventory follows the machines through their provisioning.
+	Inventory *inventory.Inventory
+	// History returns the lease history of mac, or of every host if mac is
+	// empty. It is nil when no store keeps the history.
+	History func(mac string) ([]store.Lease, error)
+}
+
+// Server serves the REST API.
+type Server struct {
+	handler http.Handler
+	address string
+	token   atomic.Pointer[string]
+
+	mu     sync.Mutex
+	server *http.Server
+}
+
+type stateRequest struct {
+	State inventory.State `json:"State"`
+}
+
+type healthResponse struct {
+	Status     string            `json:"Status"`
+	Subsystems map[string]string `json:"Subsystems"`
+}
+
+const prefix = "/api/v1"
+
+var logger = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+// Validate checks the config without listening. Errors name the field.
+func (c APIConfig) Validate() error {
+	errs := []error{config.Address("Address", c.Address)}
+	if c.Token == "" {
+		errs = append(errs, config.Errorf("Token", "token is required"))
+	}
+	return errors.Join(errs...)
+}
+
+// NewServer returns a server for conf. It does not listen until Listen is
+// called.
+func NewServer(conf APIConfig, ctl Control) (*Server, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, config.Prefix("API", err)
+	}
+	s := &Server{address: conf.Address}
+	s.handler = s.newHandler(ctl)
+	s.token.Store(&conf.Token)
+	return s, nil
+}
+
+// Listen serves the API in the background.
+func (s *Server) Listen(ctx context.Context) error {
+	ln, err := net.Listen("tcp", s.address)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{
+		Handler:     s,
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	s.mu.Lock()
+	s.server = srv
+	s.mu.Unlock()
+	go func() {
+		err := srv.Serve(ln)
+		if !errors.Is(err, http.ErrServerClosed) {
+			logger.Error(err.Error(), "module", "API")
+		}
+	}()
+	return nil
+}
+
+// Reload checks conf against the running server and returns a function
+// applying it.
+func (s *Server) Reload(conf APIConfig) (func(), error) {
+	if err := conf.Validate(); err != nil {
+		return nil, config.Prefix("API", err)
+	}
+	if conf.Address != s.address {
+		return nil, config.Errorf("API.Address", "cannot be changed without a restart")
+	}
+	return func() { s.token.Store(&conf.Token) }, nil
+}
+
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	srv := s.server
+	s.server = nil
+	s.mu.Unlock()
+	if srv == nil {
+		return nil
+	}
+	err := srv.Shutdown(ctx)
+	if err != nil {
+		srv.Close()
+	}
+	return err
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r)
+}
+
+func (s *Server) newHandler(ctl Control) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+prefix+"/leases", func(w http.ResponseWriter, r *http.Request) {
+		listLeases(w, ctl.DHCP)
+	})
+	mux.HandleFunc("DELETE "+prefix+"/leases/{mac}", func(w http.ResponseWriter, r *http.Request) {
+		deleteLease(w, r, ctl.DHCP)
+	})
+	mux.HandleFunc("POST "+prefix+"/leases/{mac}/pin", func(w http.ResponseWriter, r *http.Request) {
+		pinLease(w, r, ctl.DHCP)
+	})
+	mux.HandleFunc("GET "+prefix+"/hosts", func(w http.ResponseWriter, r *http.Request) {
+		listHosts(w, ctl.Hosts)
+	})
+	mux.HandleFunc("GET "+prefix+"/hosts/{mac}", func(w http.ResponseWriter, r *http.Request) {
+		getHost(w, r, ctl.Hosts)
+	})
+	mux.HandleFunc("PUT "+prefix+"/hosts/{mac}", func(w http.ResponseWriter, r *http.Request) {
+		putHost(w, r, ctl.Hosts, ctl.Profiles)
+	})
+	mux.HandleFunc("DELETE "+prefix+"/hosts/{mac}", func(w http.ResponseWriter, r *http.Request) {
+		deleteHost(w, r, ctl.Hosts)
+	})
+	mux.HandleFunc("GET "+prefix+"/machines", func(w http.ResponseWriter, r *http.Request) {
+		listMachines(w, ctl.Inventory)
+	})
+	mux.HandleFunc("GET "+prefix+"/machines/{mac}", func(w http.ResponseWriter, r *http.Request) {
+		getMachine(w, r, ctl.Inventory)
+	})
+	mux.HandleFunc("PUT "+prefix+"/machines/{mac}/state", func(w http.ResponseWriter, r *http.Request) {
+		setState(w, r, ctl.Inventory)
+	})
+	mux.HandleFunc("POST "+prefix+"/machines/{mac}/rearm", func(w http.ResponseWriter, r *http.Request) {
+		rearm(w, r, ctl.Inventory)
+	})
+	mux.HandleFunc("DELETE "+prefix+"/machines/{mac}", func(w http.ResponseWriter, r *http.Request) {
+		deleteMachine(w, r, ctl.Inventory)
+	})
+	mux.HandleFunc("GET "+prefix+"/history", func(w http.ResponseWriter, r *http.Request) {
+		listHistory(w, "", ctl.History)
+	})
+	mux.HandleFunc("GET "+prefix+"/history/{mac}", func(w http.ResponseWriter, r *http.Request) {
+		listHistory(w, r.PathValue("mac"), ctl.History)
+	})
+	mux.HandleFunc("GET "+prefix+"/transfers", func(w http.ResponseWriter, r *http.Request) {
+		listTransfers(w, ctl.TFTP)
+	})
+	mux.HandleFunc("GET "+prefix+"/health", func(w http.ResponseWriter, r *http.Request) {
+		getHealth(w, ctl.Health)
+	})
+	mux.HandleFunc("POST "+prefix+"/reload", func(w http.ResponseWriter, r *http.Request) {
+		reload(w, ctl.Reload)
+	})
+	return s.authorize(mux)
+}
+
+// authorize rejects requests without the bearer token.
+func (s *Server) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		want := s.token.Load()
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || want == nil || *want == "" || subtle.ConstantTimeCompare([]byte(got), []byte(*want)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, errors.New("invalid token"))
+			return
+		}
+		logger.Info("API request from "+r.RemoteAddr, "module", "API", "method", r.Method, "path", r.URL.Path)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func listLeases(w http.ResponseWriter, srv *dhcp.Server) {
+	leases := []dhcp.Lease{}
+	if srv != nil {
+		leases = srv.Leases()
+	}
+	writeJSON(w, http.StatusOK, leases)
+}
+
+func deleteLease(w http.ResponseWriter, r *http.Request, srv *dhcp.Server) {
+	if srv == nil || !srv.DeleteLease(r.PathValue("mac")) {
+		writeError(w, http.StatusNotFound, errors.New("lease is not found"))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func pinLease(w http.ResponseWriter, r *http.Request, srv *dhcp.Server) {
+	if srv == nil {
+		writeError(w, http.StatusNotFound, errors.New("DHCP is disabled"))
+		return
+	}
+	lease, err := srv.PinLease(r.PathValue("mac"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, lease)
+}
+
+func listHosts(w http.ResponseWriter, hosts *host.Registry) {
+	writeJSON(w, http.StatusOK, hosts.All())
+}
+
+func getHost(w http.ResponseWriter, r *http.Request, hosts *host.Registry) {
+	h, ok := hosts.Get(r.PathValue("mac"))
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("host is not found"))
+		return
+	}
+	writeJSON(w, http.StatusOK, h)
+}
+
+func putHost(w http.ResponseWriter, r *http.Request, hosts *host.Registry, profiles *profile.Registry) {
+	var h host.Host
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&h); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	mac, err := host.NormalizeMAC(r.PathValue("mac"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if h.MAC != "" {
+		if m, err := host.NormalizeMAC(h.MAC); err != nil || m != mac {
+			writeError(w, http.StatusBadRequest, errors.New("MAC of the body does not match the path"))
+			return
+		}
+	}
+	h.MAC = mac
+	if h.Profile != "" && !profiles.Exists(h.Profile) {
+		writeError(w, http.StatusBadRequest, errors.New("unknown profile "+h.Profile))
+		return
+	}
+	if err := hosts.Put(h); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	h, _ = hosts.Get(mac)
+	writeJSON(w, http.StatusOK, h)
+}
+
+func deleteHost(w http.ResponseWriter, r *http.Request, hosts *host.Registry) {
+	if !hosts.Delete(r.PathValue("mac")) {
+		writeError(w, http.StatusNotFound, errors.New("host is not found"))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func listMachines(w http.ResponseWriter, inv *inventory.Inventory) {
+	machines := []inventory.Machine{}
+	if inv != nil {
+		machines = inv.Machines()
+	}
+	writeJSON(w, http.StatusOK, machines)
+}
+
+func getMachine(w http.ResponseWriter, r *http.Request, inv *inventory.Inventory) {
+	if inv == nil {
+		writeError(w, http.StatusNotFound, errors.New("machine is not found"))
+		return
+	}
+	m, ok := inv.Get(r.PathValue("mac"))
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("machine is not found"))
+		return
+	}
+	writeJSON(w, http.StatusOK, m)
+}
+
+// setState moves a machine to a state by hand, such as approving it with
+// ready or retrying it after a failure.
+func setState(w http.ResponseWriter, r *http.Request, inv *inventory.Inventory) {
+	if inv == nil {
+		writeError(w, http.StatusNotImplemented, errors.New("inventory is not supported"))
+		return
+	}
+	var req stateRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	m, err := inv.Set(r.PathValue("mac"), req.State)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, m)
+}
+
+// rearm makes an installed machine boot from the network again.
+func rearm(w http.ResponseWriter, r *http.Request, inv *inventory.Inventory) {
+	if inv == nil {
+		writeError(w, http.StatusNotFound, errors.New("machine is not found"))
+		return
+	}
+	m, err := inv.Rearm(r.PathValue("mac"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, m)
+}
+
+func deleteMachine(w http.ResponseWriter, r *http.Request, inv *inventory.Inventory) {
+	if inv == nil || !inv.Delete(r.PathValue("mac")) {
+		writeError(w, http.StatusNotFound, errors.New("machine is not found"))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listHistory lists the leases handed out to mac, or to every host, from
+// the oldest.
+func listHistory(w http.ResponseWriter, mac string, history func(string) ([]store.Lease, error)) {
+	if history == nil {
+		writeError(w, http.StatusNotImplemented, errors.New("lease history is not kept without a store"))
+		return
+	}
+	if mac != "" {
+		if _, err := host.NormalizeMAC(mac); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	leases, err := history(mac)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if leases == nil {
+		leases = []store.Lease{}
+	}
+	writeJSON(w, http.StatusOK, leases)
+}
+
+func listTransfers(w http.ResponseWriter, srv *tftp.Server) {
+	var transfers []tftp.Transfer
+	if srv != nil {
+		transfers = srv.Transfers()
+	}
+	if transfers == nil {
+		transfers = []tftp.Transfer{}
+	}
+	writeJSON(w, http.StatusOK, transfers)
+}
+
+func getHealth(w http.ResponseWriter, checks map[string]func() error) {
+	res := healthResponse{Status: "ok", Subsystems: make(map[string]string)}
+	status := http.StatusOK
+	for name, check := range checks {
+		if err := check(); err != nil {
+			res.Subsystems[name] = err.Error()
+			res.Status = "unhealthy"
+			status = http.StatusServiceUnavailable
+			continue
+		}
+		res.Subsystems[name] = "ok"
+	}
+	writeJSON(w, status, res)
+}
+
+func reload(w http.ResponseWriter, reload func() error) {
+	if reload == nil {
+		writeError(w, http.StatusNotImplemented, errors.New("reload is not supported"))
+		return
+	}
+	if err := reload(); err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
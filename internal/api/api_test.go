@@ -0,0 +1,187 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/callus-corn/tao/internal/event"
+	"github.com/callus-corn/tao/internal/host"
+	"github.com/callus-corn/tao/internal/inventory"
+	"github.com/callus-corn/tao/internal/profile"
+	"github.com/callus-corn/tao/internal/store"
+)
+
+const secret = "secret"
+
+var hosts = host.NewRegistry()
+
+var machines = inventory.New(hosts)
+
+var leaseHistory = store.NewMemory()
+
+func do(t *testing.T, method string, target string, body string, bearer string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if bearer != "" {
+		r.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	w := httptest.NewRecorder()
+	ctl := Control{
+		Health: map[string]func() error{
+			"DHCP": func() error { return nil },
+			"TFTP": func() error { return errors.New("TFTP is not started") },
+		},
+		Reload:    func() error { return errors.New("DHCP.Address: cannot be changed without a restart") },
+		Hosts:     hosts,
+		Profiles:  profile.NewRegistry(),
+		Inventory: machines,
+		History:   func(mac string) ([]store.Lease, error) { return store.History(leaseHistory, mac) },
+	}
+	s, err := NewServer(APIConfig{Address: "127.0.0.1:0", Token: secret}, ctl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.ServeHTTP(w, r)
+	return w
+}
+
+func TestUnauthorized(t *testing.T) {
+	for _, tok := range []string{"", "wrong"} {
+		if w := do(t, "GET", "/api/v1/hosts", "", tok); w.Code != http.StatusUnauthorized {
+			t.Fatalf("token %q: got %d", tok, w.Code)
+		}
+	}
+}
+
+func TestHosts(t *testing.T) {
+	if err := hosts.Set(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	w := do(t, "PUT", "/api/v1/hosts/aa-bb-cc-dd-ee-01", `{"IP":"10.0.1.10","Hostname":"node1"}`, secret)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d %s", w.Code, w.Body)
+	}
+	w = do(t, "PUT", "/api/v1/hosts/aa:bb:cc:dd:ee:02", `{"IP":"10.0.1.10"}`, secret)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("got %d %s", w.Code, w.Body)
+	}
+	w = do(t, "PUT", "/api/v1/hosts/aa:bb:cc:dd:ee:02", `{"MAC":"aa:bb:cc:dd:ee:03"}`, secret)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("got %d %s", w.Code, w.Body)
+	}
+
+	w = do(t, "GET", "/api/v1/hosts", "", secret)
+	var hosts []host.Host
+	if err := json.Unmarshal(w.Body.Bytes(), &hosts); err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != 1 || hosts[0].MAC != "aa:bb:cc:dd:ee:01" || hosts[0].Hostname != "node1" {
+		t.Fatalf("got %+v", hosts)
+	}
+
+	if w = do(t, "DELETE", "/api/v1/hosts/aa:bb:cc:dd:ee:01", "", secret); w.Code != http.StatusNoContent {
+		t.Fatalf("got %d", w.Code)
+	}
+	if w = do(t, "GET", "/api/v1/hosts/aa:bb:cc:dd:ee:01", "", secret); w.Code != http.StatusNotFound {
+		t.Fatalf("got %d", w.Code)
+	}
+}
+
+func TestLeases(t *testing.T) {
+	if w := do(t, "GET", "/api/v1/leases", "", secret); w.Code != http.StatusOK {
+		t.Fatalf("got %d", w.Code)
+	}
+	if w := do(t, "POST", "/api/v1/leases/aa:bb:cc:dd:ee:09/pin", "", secret); w.Code != http.StatusNotFound {
+		t.Fatalf("got %d", w.Code)
+	}
+	if w := do(t, "DELETE", "/api/v1/leases/aa:bb:cc:dd:ee:09", "", secret); w.Code != http.StatusNotFound {
+		t.Fatalf("got %d", w.Code)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	w := do(t, "GET", "/api/v1/health", "", secret)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got %d", w.Code)
+	}
+	var res healthResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Status != "unhealthy" || res.Subsystems["TFTP"] != "TFTP is not started" || res.Subsystems["DHCP"] != "ok" {
+		t.Fatalf("got %+v", res)
+	}
+}
+
+func TestReload(t *testing.T) {
+	w := do(t, "POST", "/api/v1/reload", "", secret)
+	if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), "DHCP.Address") {
+		t.Fatalf("got %d %s", w.Code, w.Body)
+	}
+}
+
+func TestMachines(t *testing.T) {
+	machines.Handle(event.Event{Type: event.DHCPDiscover, MAC: "aa:bb:cc:dd:ee:01"})
+
+	w := do(t, "PUT", "/api/v1/machines/aa-bb-cc-dd-ee-01/state", `{"State":"ready"}`, secret)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d %s", w.Code, w.Body)
+	}
+	if w = do(t, "PUT", "/api/v1/machines/aa:bb:cc:dd:ee:01/state", `{"State":"gone"}`, secret); w.Code != http.StatusBadRequest {
+		t.Fatalf("got %d %s", w.Code, w.Body)
+	}
+
+	w = do(t, "GET", "/api/v1/machines", "", secret)
+	var got []inventory.Machine
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].State != inventory.Ready || len(got[0].History) != 2 || got[0].History[1].Reason != "operator" {
+		t.Fatalf("got %+v", got)
+	}
+
+	if w = do(t, "POST", "/api/v1/machines/aa:bb:cc:dd:ee:09/rearm", "", secret); w.Code != http.StatusNotFound {
+		t.Fatalf("got %d", w.Code)
+	}
+	machines.Handle(event.Event{Type: event.InstallDone, MAC: "aa:bb:cc:dd:ee:01"})
+	w = do(t, "POST", "/api/v1/machines/aa:bb:cc:dd:ee:01/rearm", "", secret)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"State":"ready"`) {
+		t.Fatalf("got %d %s", w.Code, w.Body)
+	}
+
+	if w = do(t, "DELETE", "/api/v1/machines/aa:bb:cc:dd:ee:01", "", secret); w.Code != http.StatusNoContent {
+		t.Fatalf("got %d", w.Code)
+	}
+	if w = do(t, "GET", "/api/v1/machines/aa:bb:cc:dd:ee:01", "", secret); w.Code != http.StatusNotFound {
+		t.Fatalf("got %d", w.Code)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	for _, mac := range []string{"aa:bb:cc:dd:ee:01", "aa:bb:cc:dd:ee:02"} {
+		if err := store.RecordLease(leaseHistory, event.Event{Type: event.DHCPAck, MAC: mac, IP: "10.0.1.2", Time: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := do(t, "GET", "/api/v1/history/AA-BB-CC-DD-EE-01", "", secret)
+	var leases []store.Lease
+	if err := json.Unmarshal(w.Body.Bytes(), &leases); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK || len(leases) != 1 || leases[0].MAC != "aa:bb:cc:dd:ee:01" {
+		t.Fatalf("got %d %s", w.Code, w.Body)
+	}
+	if w = do(t, "GET", "/api/v1/history", "", secret); w.Code != http.StatusOK || strings.Count(w.Body.String(), "MAC") != 2 {
+		t.Fatalf("got %d %s", w.Code, w.Body)
+	}
+	if w = do(t, "GET", "/api/v1/history/node1", "", secret); w.Code != http.StatusBadRequest {
+		t.Fatalf("got %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,303 @@
+// Package config decodes and validates tao.conf.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// FieldError is an error of the config field at Path, such as
+// "DHCP.RangeStart" or "Hosts[2].MAC".
+type FieldError struct {
+	Path string
+	Err  error
+}
+
+func (e *FieldError) Error() string {
+	return e.Path + ": " + e.Err.Error()
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// Errorf returns a FieldError of path.
+func Errorf(path string, format string, a ...any) error {
+	return &FieldError{Path: path, Err: fmt.Errorf(format, a...)}
+}
+
+// Prefix prepends prefix to the paths of the field errors in err, which may
+// be joined by errors.Join.
+func Prefix(prefix string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		var errs []error
+		for _, e := range joined.Unwrap() {
+			errs = append(errs, Prefix(prefix, e))
+		}
+		return errors.Join(errs...)
+	}
+	var fe *FieldError
+	if errors.As(err, &fe) {
+		return &FieldError{Path: join(prefix, fe.Path), Err: fe.Err}
+	}
+	return &FieldError{Path: prefix, Err: err}
+}
+
+// Decode unmarshals JSON data into v and rejects keys v does not have.
+func Decode(data []byte, v any) error {
+	var raw any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return syntaxError(data, err)
+	}
+	if err := unknownFields(raw, reflect.TypeOf(v), ""); err != nil {
+		return err
+	}
+
+	err := json.Unmarshal(data, v)
+	var te *json.UnmarshalTypeError
+	if errors.As(err, &te) {
+		return Errorf(te.Field, "cannot use JSON %s as %s", te.Value, te.Type)
+	}
+	return err
+}
+
+// Set sets the value at keys in the JSON object data to v and adds the keys
+// which are missing. The rest of data is kept as it is written, and v is
+// indented like tao.conf.
+func Set(data []byte, keys []string, v any) ([]byte, error) {
+	start := bytes.IndexByte(data, '{')
+	if start < 0 || len(bytes.TrimSpace(data[:start])) > 0 || len(keys) == 0 {
+		return nil, errors.New("not a JSON object")
+	}
+	return set(data, start, keys, v)
+}
+
+// set sets keys in the object which starts at data[start].
+func set(data []byte, start int, keys []string, v any) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data[start:]))
+	if _, err := dec.Token(); err != nil {
+		return nil, syntaxError(data, err)
+	}
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return nil, syntaxError(data, err)
+		}
+		begin := start + int(dec.InputOffset())
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return nil, syntaxError(data, err)
+		}
+		end := start + int(dec.InputOffset())
+		if t != keys[0] {
+			continue
+		}
+		// Skip the colon before the value.
+		begin += bytes.IndexFunc(data[begin:end], func(r rune) bool { return !strings.ContainsRune(" \t\r\n:", r) })
+		if len(keys) > 1 {
+			if raw[0] != '{' {
+				return nil, Errorf(keys[0], "not a JSON object")
+			}
+			b, err := set(data, begin, keys[1:], v)
+			return b, Prefix(keys[0], err)
+		}
+		b, err := indent(v, lineIndent(data, begin))
+		if err != nil {
+			return nil, err
+		}
+		return slices.Concat(data[:begin], b, data[end:]), nil
+	}
+
+	// Add the key after the last member.
+	if _, err := dec.Token(); err != nil {
+		return nil, syntaxError(data, err)
+	}
+	closing := start + int(dec.InputOffset()) - 1
+	last := closing
+	for last > start+1 && strings.ContainsRune(" \t\r\n", rune(data[last-1])) {
+		last--
+	}
+	for i := len(keys) - 1; i > 0; i-- {
+		v = map[string]any{keys[i]: v}
+	}
+	outer := lineIndent(data, start)
+	b, err := indent(v, outer+"    ")
+	if err != nil {
+		return nil, err
+	}
+	key, _ := json.Marshal(keys[0])
+	member := "\n" + outer + "    " + string(key) + " : " + string(b) + "\n" + outer
+	if data[last-1] != '{' {
+		member = "," + member
+	}
+	return slices.Concat(data[:last], []byte(member), data[closing:]), nil
+}
+
+var keyColon = regexp.MustCompile(`(?m)^(\s*"(?:[^"\\]|\\.)*"): `)
+
+// indent encodes v indented by prefix with the spaced colons of tao.conf.
+func indent(v any, prefix string) ([]byte, error) {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent(prefix, "    ")
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return keyColon.ReplaceAll(bytes.TrimSuffix(b.Bytes(), []byte("\n")), []byte("$1 : ")), nil
+}
+
+// lineIndent returns the indent of the line which has data[i].
+func lineIndent(data []byte, i int) string {
+	line := data[bytes.LastIndexByte(data[:i], '\n')+1 : i]
+	return string(line[:len(line)-len(bytes.TrimLeft(line, " \t"))])
+}
+
+// Address checks that addr is a host:port pair with a numeric port.
+func Address(path string, addr string) error {
+	if addr == "" {
+		return Errorf(path, "address is required")
+	}
+	h, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return Errorf(path, "%w", err)
+	}
+	if p, err := strconv.Atoi(port); err != nil || p < 0 || p > 65535 {
+		return Errorf(path, "invalid port %q", port)
+	}
+	if h != "" && net.ParseIP(h) == nil {
+		if _, err := net.LookupHost(h); err != nil {
+			return Errorf(path, "unknown host %q", h)
+		}
+	}
+	return nil
+}
+
+// IPv4 checks that ip is an IPv4 address.
+func IPv4(path string, ip string) error {
+	if net.ParseIP(ip).To4() == nil {
+		return Errorf(path, "invalid IPv4 address %q", ip)
+	}
+	return nil
+}
+
+// Dir checks that dir is an existing directory.
+func Dir(path string, dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return Errorf(path, "%w", err)
+	}
+	if !info.IsDir() {
+		return Errorf(path, "%s is not a directory", dir)
+	}
+	return nil
+}
+
+// File checks that name is an existing regular file.
+func File(path string, name string) error {
+	info, err := os.Stat(name)
+	if err != nil {
+		return Errorf(path, "%w", err)
+	}
+	if info.IsDir() {
+		return Errorf(path, "%s is a directory", name)
+	}
+	return nil
+}
+
+func unknownFields(raw any, t reflect.Type, path string) error {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	var errs []error
+	switch v := raw.(type) {
+	case map[string]any:
+		switch t.Kind() {
+		case reflect.Map:
+			for _, k := range sortedKeys(v) {
+				errs = append(errs, unknownFields(v[k], t.Elem(), path+"["+strconv.Quote(k)+"]"))
+			}
+		case reflect.Struct:
+			fields := fieldsOf(t)
+			for _, k := range sortedKeys(v) {
+				f, ok := fields[k]
+				if !ok {
+					errs = append(errs, Errorf(join(path, k), "unknown field"))
+					continue
+				}
+				errs = append(errs, unknownFields(v[k], f.Type, join(path, k)))
+			}
+		}
+	case []any:
+		if t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+			for i, e := range v {
+				errs = append(errs, unknownFields(e, t.Elem(), path+"["+strconv.Itoa(i)+"]"))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// fieldsOf returns the exported fields of t by their JSON names.
+func fieldsOf(t reflect.Type) map[string]reflect.StructField {
+	fields := make(map[string]reflect.StructField)
+	for _, f := range reflect.VisibleFields(t) {
+		if !f.IsExported() || (f.Anonymous && f.Type.Kind() == reflect.Struct && f.Tag.Get("json") == "") {
+			continue
+		}
+		name := f.Name
+		if tag, ok := f.Tag.Lookup("json"); ok {
+			tag, _, _ = strings.Cut(tag, ",")
+			if tag == "-" {
+				continue
+			}
+			if tag != "" {
+				name = tag
+			}
+		}
+		fields[name] = f
+	}
+	return fields
+}
+
+func sortedKeys(m map[string]any) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func syntaxError(data []byte, err error) error {
+	var se *json.SyntaxError
+	if !errors.As(err, &se) {
+		return err
+	}
+	line := 1 + bytes.Count(data[:se.Offset], []byte("\n"))
+	col := int(se.Offset) - bytes.LastIndexByte(data[:se.Offset], '\n') - 1
+	return fmt.Errorf("line %d, column %d: %w", line, col, err)
+}
+
+func join(prefix string, path string) string {
+	switch {
+	case prefix == "":
+		return path
+	case path == "" || strings.HasPrefix(path, "["):
+		return prefix + path
+	}
+	return prefix + "." + path
+}
@@ -0,0 +1,129 @@
+package config
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+type testConfig struct {
+	Server struct {
+		Address string            `json:"Address"`
+		Port    int               `json:"Port"`
+		Labels  map[string]string `json:"Labels"`
+	} `json:"Server"`
+	Hosts []struct {
+		MAC string `json:"MAC"`
+	} `json:"Hosts"`
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name  string
+		json  string
+		wants []string
+	}{
+		{
+			name: "valid",
+			json: `{"Server":{"Address":":69","Labels":{"any":"key"}},"Hosts":[{"MAC":"aa:bb:cc:dd:ee:01"}]}`,
+		},
+		{
+			name:  "unknown fields",
+			json:  `{"Server":{"Adress":":69"},"Hosts":[{"MAC":"x"},{"Mac":"y"}],"Extra":1}`,
+			wants: []string{"Extra: unknown field", "Hosts[1].Mac: unknown field", "Server.Adress: unknown field"},
+		},
+		{
+			name:  "type",
+			json:  `{"Server":{"Port":"69"}}`,
+			wants: []string{"Server.Port: cannot use JSON string as int"},
+		},
+		{
+			name:  "syntax",
+			json:  "{\n\"Server\": {,}}",
+			wants: []string{"line 2, column 12"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var c testConfig
+			err := Decode([]byte(tt.json), &c)
+			if len(tt.wants) == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("no error")
+			}
+			lines := strings.Split(err.Error(), "\n")
+			for i, want := range tt.wants {
+				if i >= len(lines) || !strings.HasPrefix(lines[i], want) {
+					t.Fatalf("got %q, wants %q", err.Error(), tt.wants)
+				}
+			}
+		})
+	}
+}
+
+func TestPrefix(t *testing.T) {
+	err := Prefix("DHCP", errors.Join(Errorf("DNS", "invalid"), errors.New("plain"), nil))
+	if err.Error() != "DHCP.DNS: invalid\nDHCP: plain" {
+		t.Fatalf("got %q", err.Error())
+	}
+	if err := Prefix("Hosts", Errorf("[0].MAC", "invalid")); err.Error() != "Hosts[0].MAC: invalid" {
+		t.Fatalf("got %q", err.Error())
+	}
+	var fe *FieldError
+	if !errors.As(err, &fe) || fe.Path != "DHCP.DNS" {
+		t.Fatalf("got %v", fe)
+	}
+	if Prefix("DHCP", nil) != nil {
+		t.Fatal("nil is prefixed")
+	}
+}
+
+func TestSet(t *testing.T) {
+	data := "{\n    \"Server\" : {\n        \"Address\" : \":69\",\n        \"Labels\" : {}\n    },\n    \"Hosts\" : []\n}\n"
+	tests := []struct {
+		keys  []string
+		v     any
+		wants string
+	}{
+		{
+			keys:  []string{"Server", "Address"},
+			v:     ":8069",
+			wants: "{\n    \"Server\" : {\n        \"Address\" : \":8069\",\n        \"Labels\" : {}\n    },\n    \"Hosts\" : []\n}\n",
+		},
+		{
+			keys: []string{"Server", "Labels", "role"},
+			v:    "a&b",
+			wants: "{\n    \"Server\" : {\n        \"Address\" : \":69\",\n        \"Labels\" : {\n" +
+				"            \"role\" : \"a&b\"\n        }\n    },\n    \"Hosts\" : []\n}\n",
+		},
+		{
+			keys: []string{"Boot", "Profiles", "memtest"},
+			v:    map[string]string{"Kernel": "memtest.efi"},
+			wants: "{\n    \"Server\" : {\n        \"Address\" : \":69\",\n        \"Labels\" : {}\n    },\n    \"Hosts\" : [],\n" +
+				"    \"Boot\" : {\n        \"Profiles\" : {\n            \"memtest\" : {\n                \"Kernel\" : \"memtest.efi\"\n" +
+				"            }\n        }\n    }\n}\n",
+		},
+	}
+	for _, tt := range tests {
+		b, err := Set([]byte(data), tt.keys, tt.v)
+		if err != nil || string(b) != tt.wants {
+			t.Fatalf("%v: got %v\n%s", tt.keys, err, b)
+		}
+	}
+
+	if b, err := Set([]byte(`{}`), []string{"Port"}, 69); err != nil || string(b) != "{\n    \"Port\" : 69\n}" {
+		t.Fatalf("got %s %v", b, err)
+	}
+	if _, err := Set([]byte(data), []string{"Hosts", "MAC"}, ""); err == nil || err.Error() != "Hosts: not a JSON object" {
+		t.Fatalf("got %v", err)
+	}
+	if _, err := Set([]byte(`[]`), []string{"Port"}, 69); err == nil {
+		t.Fatal("array is accepted")
+	}
+}
@@ -2,23 +2,38 @@ package dhcp
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"log/slog"
 	"net"
 	"os"
+	"path/filepath"
 	"slices"
 	"strconv"
+	"sync"
+
+	"github.com/callus-corn/tao/internal/config"
+	"github.com/callus-corn/tao/internal/event"
+	"github.com/callus-corn/tao/internal/host"
 )
 
+// DHCPConfig is the DHCP section of tao.conf.
 type DHCPConfig struct {
-	IsEnable      bool   `json:"IsEnable"`
-	Address       string `json:"Address"`
-	FileName      string `json:"FileName"`
-	RangeStart    string `json:"RangeStart"`
+	IsEnable   bool   `json:"IsEnable"`
+	Address    string `json:"Address"`
+	FileName   string `json:"FileName"`
+	RangeStart string `json:"RangeStart"`
+	// RangeEnd is the last address handed out, inside the /24 of
+	// RangeStart. It is the .254 of that /24 when it is empty.
+	RangeEnd      string `json:"RangeEnd"`
 	DefaultRouter string `json:"DefaultRouter"`
 	DNS           string `json:"DNS"`
+	LeaseFile     string `json:"LeaseFile"`
+	// LocalBootFile is offered instead of FileName to hosts which boot from
+	// their local disk. FileName is kept when it is empty.
+	LocalBootFile string `json:"LocalBootFile"`
 }
 
 type dhcp struct {
@@ -66,6 +81,7 @@ const DHCPMsgType = 53
 const DHCPServerId = 54
 const ParameterList = 55
 const ClassId = 60
+const ClientArch = 93
 const End = 255
 
 const DHCPDISCOVER = 1
@@ -75,56 +91,200 @@ const DHCPACK = 5
 
 var logger = slog.New(slog.NewJSONHandler(os.Stdout, nil))
 
-var fname string
-var rangeStart string
-var defaultRouter string
-var dns string
+// Server hands out addresses and boot files over DHCP. Its settings can be
+// changed by Reload while it is serving.
+type Server struct {
+	// mu guards the settings Reload changes while a message is handled.
+	mu            sync.RWMutex
+	fname         string
+	localFname    string
+	localBoot     func(mac string) bool
+	rangeStart    string
+	rangeEnd      string
+	defaultRouter string
+	dns           string
+
+	// hosts has the reservations, and learns the hosts acknowledged.
+	hosts *host.Registry
+
+	// dbMu guards the lease database.
+	dbMu      sync.Mutex
+	db        leaseDB
+	current   int
+	dirty     bool
+	store     LeaseStore
+	leaseFile string
+
+	serverId [4]byte
+	address  string
+	listener net.PacketConn
+	// running counts the DHCP messages being handled.
+	running sync.WaitGroup
+
+	events event.Hooks
+
+	healthMu sync.Mutex
+	health   error
+}
 
-var db leaseDB
-var current byte
-var serverId [4]byte
+// Validate checks the config without listening. Errors name the field.
+func (c DHCPConfig) Validate() error {
+	errs := []error{config.Address("Address", c.Address)}
+	if c.FileName == "" {
+		errs = append(errs, config.Errorf("FileName", "file name is required"))
+	}
+	start, ipnet, err := net.ParseCIDR(c.RangeStart)
+	if err != nil || start.To4() == nil {
+		errs = append(errs, config.Errorf("RangeStart", "invalid IPv4 CIDR %q", c.RangeStart))
+		ipnet = nil
+	} else if prefix, _ := ipnet.Mask.Size(); prefix > 24 {
+		// Addresses are handed out by cycling through the last octet.
+		errs = append(errs, config.Errorf("RangeStart", "range %s/24 is not inside subnet %s", start.Mask(net.CIDRMask(24, 32)), ipnet))
+	} else if start.Equal(ipnet.IP) {
+		errs = append(errs, config.Errorf("RangeStart", "%s is the network address", start))
+	}
+	if c.RangeEnd != "" {
+		end := net.ParseIP(c.RangeEnd).To4()
+		switch {
+		case end == nil:
+			errs = append(errs, config.Errorf("RangeEnd", "invalid IPv4 address %q", c.RangeEnd))
+		case ipnet == nil:
+		case !start.Mask(net.CIDRMask(24, 32)).Equal(end.Mask(net.CIDRMask(24, 32))) || end[3] < start.To4()[3]:
+			errs = append(errs, config.Errorf("RangeEnd", "%s is not between %s and the end of its /24", end, start))
+		case end.Equal(broadcast(ipnet)):
+			errs = append(errs, config.Errorf("RangeEnd", "%s is the broadcast address", end))
+		}
+	}
+	if err := config.IPv4("DefaultRouter", c.DefaultRouter); err != nil {
+		errs = append(errs, err)
+	} else if ipnet != nil && !ipnet.Contains(net.ParseIP(c.DefaultRouter)) {
+		errs = append(errs, config.Errorf("DefaultRouter", "%s is not inside subnet %s", c.DefaultRouter, ipnet))
+	}
+	errs = append(errs, config.IPv4("DNS", c.DNS))
+	if c.LeaseFile != "" {
+		errs = append(errs, config.Dir("LeaseFile", filepath.Dir(c.LeaseFile)))
+	}
+	return errors.Join(errs...)
+}
 
-func Listen(conf DHCPConfig) error {
-	fname = conf.FileName
-	rangeStart = conf.RangeStart
-	defaultRouter = conf.DefaultRouter
-	dns = conf.DNS
+// NewServer returns a server for conf with the leases of its lease file.
+// The reservations of hosts are handed out, and the hosts acknowledged are
+// recorded in it. It does not listen until Listen is called.
+func NewServer(conf DHCPConfig, hosts *host.Registry) (*Server, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, config.Prefix("DHCP", err)
+	}
+	s := &Server{
+		hosts:     hosts,
+		address:   conf.Address,
+		leaseFile: conf.LeaseFile,
+		health:    errors.New("DHCP is not started"),
+	}
+	s.configure(conf)
+	var store LeaseStore
+	if conf.LeaseFile != "" {
+		store = NewFileStore(conf.LeaseFile)
+	}
+	if err := s.loadLeases(store); err != nil {
+		return nil, config.Prefix("DHCP.LeaseFile", err)
+	}
+	return s, nil
+}
 
-	db = make(leaseDB)
-	current = 0
+// OnEvent adds fn to the functions called for each DHCPDISCOVER offered and
+// DHCPREQUEST acknowledged. fn is called while the message is handled.
+func (s *Server) OnEvent(fn func(event.Event)) {
+	s.events.Add(fn)
+}
 
+// SetLocalBoot sets the function deciding which hosts are offered
+// LocalBootFile.
+func (s *Server) SetLocalBoot(fn func(mac string) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.localBoot = fn
+}
+
+// Listen starts serving in the background. The listener is closed when ctx
+// is done.
+func (s *Server) Listen(ctx context.Context) error {
 	dummy, err := net.Dial("udp", "8.8.8.8:80")
 	if err != nil {
 		return err
 	}
 	defer dummy.Close()
-	copy(serverId[:], dummy.LocalAddr().(*net.UDPAddr).IP)
+	copy(s.serverId[:], dummy.LocalAddr().(*net.UDPAddr).IP)
 
-	conn, err := net.ListenPacket("udp", conf.Address)
+	conn, err := net.ListenPacket("udp", s.address)
 	if err != nil {
 		return err
 	}
+	s.mu.Lock()
+	s.listener = conn
+	s.mu.Unlock()
+	context.AfterFunc(ctx, func() { conn.Close() })
 
-	go listen(conn)
+	go s.serve(conn)
+	s.setHealth(nil)
 
 	return nil
 }
 
-func listen(conn net.PacketConn) {
+// Reload checks conf against the running server and returns a function
+// applying it. Leases are kept.
+func (s *Server) Reload(conf DHCPConfig) (func(), error) {
+	if err := conf.Validate(); err != nil {
+		return nil, config.Prefix("DHCP", err)
+	}
+	if conf.Address != s.address {
+		return nil, config.Errorf("DHCP.Address", "cannot be changed without a restart")
+	}
+	if conf.LeaseFile != s.leaseFile {
+		return nil, config.Errorf("DHCP.LeaseFile", "cannot be changed without a restart")
+	}
+	return func() { s.configure(conf) }, nil
+}
+
+// configure applies a validated conf.
+func (s *Server) configure(conf DHCPConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fname = conf.FileName
+	s.localFname = conf.LocalBootFile
+	s.rangeStart = conf.RangeStart
+	s.rangeEnd = conf.RangeEnd
+	s.defaultRouter = conf.DefaultRouter
+	s.dns = conf.DNS
+
+	_, ipnet, _ := net.ParseCIDR(s.rangeStart)
+	prefix, _ := ipnet.Mask.Size()
+	s.hosts.SetNetwork(host.Network{Prefix: prefix, Gateway: s.defaultRouter, DNS: []string{s.dns}})
+}
+
+func (s *Server) serve(conn net.PacketConn) {
 	defer conn.Close()
 
 	rx := make([]byte, udpMax)
 	for {
 		n, _, err := conn.ReadFrom(rx)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
 			logger.Error(err.Error(), "module", "DHCP")
 			continue
 		}
-		go handleDHCP(conn, slices.Clone(rx[:n]))
+		s.running.Add(1)
+		go func(p []byte) {
+			defer s.running.Done()
+			s.mu.RLock()
+			defer s.mu.RUnlock()
+			s.handleDHCP(conn, p)
+		}(slices.Clone(rx[:n]))
 	}
 }
 
-func handleDHCP(conn net.PacketConn, p []byte) {
+func (s *Server) handleDHCP(conn net.PacketConn, p []byte) {
 	dhcp, err := newdhcp(p)
 	if err != nil {
 		logger.Error(err.Error(), "module", "DHCP")
@@ -135,7 +295,7 @@ func handleDHCP(conn net.PacketConn, p []byte) {
 	switch dhcp.msgType() {
 	case DHCPDISCOVER:
 		logger.Info("receve DHCPDISCOVER", "module", "DHCP", "message", fmt.Sprintf("%v", dhcp))
-		offer, err := dhcp.offer()
+		offer, err := s.reply(dhcp)
 		if err != nil {
 			logger.Error(err.Error(), "module", "DHCP")
 			return
@@ -147,20 +307,23 @@ func handleDHCP(conn net.PacketConn, p []byte) {
 			return
 		}
 		tx = tx[:n]
+		s.events.Emit(event.Event{Type: event.DHCPDiscover, MAC: offer.mac(), IP: net.IP(offer.yiaddr[:]).String()})
 	case DHCPREQUEST:
 		logger.Info("receve DHCPREQUEST", "module", "DHCP", "message", fmt.Sprintf("%v", dhcp))
-		ack, err := dhcp.ack()
+		ack, err := s.reply(dhcp)
 		if err != nil {
 			logger.Error(err.Error(), "module", "DHCP")
 			return
 		}
 		logger.Info("send DHCPACK", "module", "DHCP", "message", fmt.Sprintf("%v", ack))
+		s.hosts.Observe(ack.mac(), net.IP(ack.yiaddr[:]).String(), dhcp.arch())
 		n, err := ack.write(tx)
 		if err != nil {
 			logger.Error(err.Error(), "module", "DHCP")
 			return
 		}
 		tx = tx[:n]
+		s.events.Emit(event.Event{Type: event.DHCPAck, MAC: ack.mac(), IP: net.IP(ack.yiaddr[:]).String()})
 	default:
 		logger.Info("receved message is not supported", "module", "DHCP", "message", fmt.Sprintf("%v", dhcp))
 		return
@@ -174,15 +337,9 @@ func handleDHCP(conn net.PacketConn, p []byte) {
 	conn.WriteTo(slices.Clone(tx), addr)
 }
 
-func (d *dhcp) offer() (*dhcp, error) {
-	return d.reply()
-}
-
-func (d *dhcp) ack() (*dhcp, error) {
-	return d.reply()
-}
-
-func (d *dhcp) reply() (*dhcp, error) {
+// reply answers a DHCPDISCOVER with a DHCPOFFER and a DHCPREQUEST with a
+// DHCPACK. The caller holds s.mu.
+func (s *Server) reply(d *dhcp) (*dhcp, error) {
 	msgType := option{
 		code:  DHCPMsgType,
 		len:   1,
@@ -207,10 +364,10 @@ func (d *dhcp) reply() (*dhcp, error) {
 	dhcpServerId := option{
 		code:  DHCPServerId,
 		len:   4,
-		value: serverId[:],
+		value: s.serverId[:],
 	}
 
-	o, err := options(d.parameterList())
+	o, err := s.options(d.parameterList())
 	if err != nil {
 		return nil, err
 	}
@@ -220,17 +377,22 @@ func (d *dhcp) reply() (*dhcp, error) {
 	options = append(options, o...)
 
 	yiaddr := [4]byte{0}
-	pick, err := db.pick(d.chaddr)
+	s.dbMu.Lock()
+	pick, err := s.pick(d.chaddr)
+	s.dbMu.Unlock()
 	if err != nil {
 		return nil, err
 	}
+	if err := s.saveLeases(); err != nil {
+		logger.Error(err.Error(), "module", "DHCP")
+	}
 	copy(yiaddr[:], pick[:])
 
 	siaddr := [4]byte{0}
 	file := [128]byte{0}
 	if d.isPXE() {
-		copy(siaddr[:], serverId[:])
-		copy(file[:], []byte(fname))
+		copy(siaddr[:], s.serverId[:])
+		copy(file[:], []byte(s.bootFile(d.mac())))
 	}
 
 	return &dhcp{
@@ -252,7 +414,18 @@ func (d *dhcp) reply() (*dhcp, error) {
 	}, nil
 }
 
+// bootFile returns the boot file offered to mac. The caller holds s.mu.
+func (s *Server) bootFile(mac string) string {
+	if s.localFname != "" && s.localBoot != nil && s.localBoot(mac) {
+		return s.localFname
+	}
+	return s.fname
+}
+
 func newdhcp(p []byte) (*dhcp, error) {
+	if len(p) < 240 {
+		return nil, errors.New("DHCP packet is too short")
+	}
 	if [4]byte(p[236:240]) != [4]byte{99, 130, 83, 99} {
 		return nil, errors.New("DHCP options have not magic number")
 	}
@@ -261,16 +434,19 @@ func newdhcp(p []byte) (*dhcp, error) {
 	o := p[240:]
 	i := 0
 	for {
-		if o[i] == End {
-			break
-		}
 		if i >= len(o) {
 			return nil, errors.New("DHCP options have not end option")
 		}
+		if o[i] == End {
+			break
+		}
 		if o[i] == Pad {
 			i++
 			continue
 		}
+		if i+2 > len(o) || i+2+int(o[i+1]) > len(o) {
+			return nil, errors.New("DHCP option is truncated")
+		}
 		code := o[i]
 		len := o[i+1]
 		value := o[i+2 : i+2+int(len)]
@@ -297,13 +473,13 @@ func newdhcp(p []byte) (*dhcp, error) {
 	}, nil
 }
 
-func options(p []byte) ([]option, error) {
+func (s *Server) options(p []byte) ([]option, error) {
 	options := make([]option, len(p))
 	n := 0
 	for i, code := range p {
 		switch code {
 		case SubnetMask:
-			_, ipnet, err := net.ParseCIDR(rangeStart)
+			_, ipnet, err := net.ParseCIDR(s.rangeStart)
 			if err != nil {
 				return nil, err
 			}
@@ -317,25 +493,25 @@ func options(p []byte) ([]option, error) {
 			options[i] = option{
 				code:  code,
 				len:   4,
-				value: net.ParseIP(defaultRouter)[12:16],
+				value: net.ParseIP(s.defaultRouter).To4(),
 			}
 			n++
 		case DomainServer:
 			options[i] = option{
 				code:  code,
 				len:   4,
-				value: net.ParseIP(dns)[12:16],
+				value: net.ParseIP(s.dns).To4(),
 			}
 			n++
 		case BroadcastAddress:
-			_, ipnet, err := net.ParseCIDR(rangeStart)
+			_, ipnet, err := net.ParseCIDR(s.rangeStart)
 			if err != nil {
 				return nil, err
 			}
 			options[i] = option{
 				code:  code,
 				len:   4,
-				value: []byte{ipnet.IP[0] | ^ipnet.Mask[0], ipnet.IP[1] | ^ipnet.Mask[1], ipnet.IP[2] | ^ipnet.Mask[2], ipnet.IP[3] | ^ipnet.Mask[3]},
+				value: broadcast(ipnet),
 			}
 			n++
 		}
@@ -346,7 +522,7 @@ func options(p []byte) ([]option, error) {
 func (d dhcp) msgType() byte {
 	t := byte(0)
 	for _, option := range d.options {
-		if option.code != DHCPMsgType {
+		if option.code != DHCPMsgType || len(option.value) < 1 {
 			continue
 		}
 		t = option.value[0]
@@ -367,6 +543,39 @@ func (d dhcp) parameterList() []byte {
 	return t
 }
 
+func (d dhcp) mac() string {
+	return net.HardwareAddr(d.chaddr[:ETHERNETHLEN]).String()
+}
+
+// arch names the client system architecture of option 93 (RFC 4578).
+func (d dhcp) arch() string {
+	for _, option := range d.options {
+		if option.code != ClientArch || len(option.value) < 2 {
+			continue
+		}
+		switch binary.BigEndian.Uint16(option.value) {
+		case 0:
+			return "x86-bios"
+		case 6:
+			return "x86-uefi"
+		case 7, 9:
+			return "x64-uefi"
+		case 10:
+			return "arm32-uefi"
+		case 11:
+			return "arm64-uefi"
+		case 15:
+			return "x86-uefi-http"
+		case 16:
+			return "x64-uefi-http"
+		case 19:
+			return "arm64-uefi-http"
+		}
+		return strconv.Itoa(int(binary.BigEndian.Uint16(option.value)))
+	}
+	return ""
+}
+
 func (d dhcp) isPXE() bool {
 	t := false
 	for _, option := range d.options {
@@ -421,18 +630,46 @@ func (d dhcp) write(p []byte) (int, error) {
 	return n, nil
 }
 
-func (d leaseDB) pick(haddr [16]byte) ([4]byte, error) {
-	addr, ok := d[string(haddr[:])]
+// broadcast returns the broadcast address of ipnet.
+func broadcast(ipnet *net.IPNet) net.IP {
+	return net.IP{ipnet.IP[0] | ^ipnet.Mask[0], ipnet.IP[1] | ^ipnet.Mask[1], ipnet.IP[2] | ^ipnet.Mask[2], ipnet.IP[3] | ^ipnet.Mask[3]}
+}
+
+// pick returns the address of haddr, leasing one if it has none. The caller
+// holds s.dbMu.
+func (s *Server) pick(haddr [16]byte) ([4]byte, error) {
+	addr, ok := s.hosts.Reservation(net.HardwareAddr(haddr[:ETHERNETHLEN]).String())
 	if !ok {
-		iaddr, _, err := net.ParseCIDR(rangeStart)
+		addr, ok = s.db[string(haddr[:])]
+	}
+	if !ok {
+		start, ipnet, err := net.ParseCIDR(s.rangeStart)
 		if err != nil {
 			return [4]byte{}, err
 		}
-		iaddr = iaddr[12:16]
-		iaddr[3] = iaddr[3] + current
-		current++
-		d[string(haddr[:])] = strconv.Itoa(int(iaddr[0])) + "." + strconv.Itoa(int(iaddr[1])) + "." + strconv.Itoa(int(iaddr[2])) + "." + strconv.Itoa(int(iaddr[3]))
-		addr = d[string(haddr[:])]
+		first, last := start.To4()[3], byte(254)
+		if s.rangeEnd != "" {
+			last = net.ParseIP(s.rangeEnd).To4()[3]
+		}
+		size := int(last) - int(first) + 1
+		for i := 0; ; i++ {
+			if i >= size {
+				return [4]byte{}, errors.New("no address is left in the range")
+			}
+			n := (s.current + i) % size
+			iaddr := slices.Clone(start.To4())
+			iaddr[3] = first + byte(n)
+			if iaddr.Equal(ipnet.IP) || iaddr.Equal(broadcast(ipnet)) {
+				continue
+			}
+			addr = iaddr.String()
+			if !s.hosts.Reserved(addr) && !s.db.leased(addr) {
+				s.current = n + 1
+				break
+			}
+		}
+		s.db[string(haddr[:])] = addr
+		s.dirty = true
 	}
 	picked := [4]byte{}
 	copy(picked[:], net.ParseIP(addr)[12:16])
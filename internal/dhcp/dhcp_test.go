@@ -0,0 +1,78 @@
+package dhcp
+
+import (
+	"net"
+	"slices"
+	"testing"
+
+	"github.com/callus-corn/tao/internal/host"
+)
+
+func TestBootFile(t *testing.T) {
+	s := &Server{hosts: host.NewRegistry()}
+	s.configure(DHCPConfig{FileName: "bootx64.efi", RangeStart: "10.0.1.2/24", DefaultRouter: "10.0.1.1", DNS: "8.8.8.8"})
+	s.SetLocalBoot(func(mac string) bool { return mac == "aa:bb:cc:dd:ee:01" })
+	if got := s.bootFile("aa:bb:cc:dd:ee:01"); got != "bootx64.efi" {
+		t.Fatalf("got %s without LocalBootFile", got)
+	}
+
+	s.configure(DHCPConfig{FileName: "bootx64.efi", LocalBootFile: "local.ipxe", RangeStart: "10.0.1.2/24", DefaultRouter: "10.0.1.1", DNS: "8.8.8.8"})
+	if got := s.bootFile("aa:bb:cc:dd:ee:01"); got != "local.ipxe" {
+		t.Fatalf("got %s", got)
+	}
+	if got := s.bootFile("aa:bb:cc:dd:ee:02"); got != "bootx64.efi" {
+		t.Fatalf("got %s", got)
+	}
+}
+
+func TestShortPacket(t *testing.T) {
+	p := make([]byte, 240)
+	copy(p[236:], []byte{99, 130, 83, 99})
+	tests := map[string][]byte{
+		"empty":             nil,
+		"short header":      p[:100],
+		"no magic number":   make([]byte, 300),
+		"no end option":     p,
+		"truncated length":  append(slices.Clone(p), DHCPMsgType),
+		"truncated value":   append(slices.Clone(p), DHCPMsgType, 4, 1),
+		"pad without end":   append(slices.Clone(p), Pad, Pad),
+		"value without end": append(slices.Clone(p), DHCPMsgType, 1, DHCPDISCOVER),
+	}
+	for name, p := range tests {
+		if _, err := newdhcp(p); err == nil {
+			t.Fatalf("Fail at %s: no error", name)
+		}
+	}
+
+	d, err := newdhcp(append(slices.Clone(p), DHCPMsgType, 0, End))
+	if err != nil || d.msgType() != 0 {
+		t.Fatalf("got %v %v", d, err)
+	}
+}
+
+func TestRegistries(t *testing.T) {
+	conf := DHCPConfig{Address: "127.0.0.1:0", FileName: "bootx64.efi", RangeStart: "10.0.1.2/24", DefaultRouter: "10.0.1.1", DNS: "8.8.8.8"}
+	haddr := [16]byte{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x01}
+	for _, want := range []string{"10.0.1.10", "10.0.1.20"} {
+		hosts := host.NewRegistry()
+		if err := hosts.Set([]host.Host{{MAC: "aa:bb:cc:dd:ee:01", IP: want}}); err != nil {
+			t.Fatal(err)
+		}
+		s, err := NewServer(conf, hosts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.dbMu.Lock()
+		picked, err := s.pick(haddr)
+		s.dbMu.Unlock()
+		if got := net.IP(picked[:]).String(); err != nil || got != want {
+			t.Fatalf("got %s %v, wants %s", got, err, want)
+		}
+		if leases := s.Leases(); len(leases) != 0 {
+			t.Fatalf("got %+v", leases)
+		}
+		if n := hosts.GetNetwork(); n.Prefix != 24 || n.Gateway != "10.0.1.1" {
+			t.Fatalf("got %+v", n)
+		}
+	}
+}
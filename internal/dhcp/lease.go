@@ -0,0 +1,191 @@
+package dhcp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/callus-corn/tao/internal/host"
+)
+
+// Lease is an address handed out to a host. Reserved is set when the
+// address comes from the reservation of the host.
+type Lease struct {
+	MAC      string `json:"MAC"`
+	IP       string `json:"IP"`
+	Reserved bool   `json:"Reserved"`
+}
+
+// Leases returns the leases sorted by MAC address.
+func (s *Server) Leases() []Lease {
+	s.dbMu.Lock()
+	defer s.dbMu.Unlock()
+
+	return s.db.leases(s.hosts)
+}
+
+// DeleteLease forgets the lease of mac, so that its address can be handed
+// out again, and reports whether there was one.
+func (s *Server) DeleteLease(mac string) bool {
+	key, err := leaseKey(mac)
+	if err != nil {
+		return false
+	}
+
+	s.dbMu.Lock()
+	_, ok := s.db[key]
+	delete(s.db, key)
+	s.dirty = s.dirty || ok
+	s.dbMu.Unlock()
+
+	if err := s.saveLeases(); err != nil {
+		logger.Error(err.Error(), "module", "DHCP")
+	}
+	return ok
+}
+
+// PinLease turns the lease of mac into a host reservation, so the host
+// keeps its address.
+func (s *Server) PinLease(mac string) (Lease, error) {
+	key, err := leaseKey(mac)
+	if err != nil {
+		return Lease{}, err
+	}
+
+	s.dbMu.Lock()
+	ip, ok := s.db[key]
+	s.dbMu.Unlock()
+	if !ok {
+		return Lease{}, errors.New("lease of " + mac + " is not found")
+	}
+
+	h, ok := s.hosts.Get(mac)
+	if !ok {
+		h = host.Host{MAC: mac}
+	}
+	h.IP = ip
+	if err := s.hosts.Put(h); err != nil {
+		return Lease{}, err
+	}
+	return Lease{MAC: h.MAC, IP: ip, Reserved: true}, nil
+}
+
+// Health returns nil while the server is listening.
+func (s *Server) Health() error {
+	s.healthMu.Lock()
+	defer s.healthMu.Unlock()
+	return s.health
+}
+
+// Shutdown closes the listener, waits for the messages being handled and
+// writes the leases to the lease file.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	if s.listener != nil {
+		s.listener.Close()
+		s.listener = nil
+	}
+	s.mu.Unlock()
+	s.setHealth(errors.New("DHCP is stopped"))
+
+	done := make(chan struct{})
+	go func() {
+		s.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return s.saveLeases()
+}
+
+func (s *Server) setHealth(err error) {
+	s.healthMu.Lock()
+	defer s.healthMu.Unlock()
+	s.health = err
+}
+
+func leaseKey(mac string) (string, error) {
+	hw, err := net.ParseMAC(strings.ReplaceAll(mac, "-", ":"))
+	if err != nil {
+		return "", err
+	}
+	var haddr [16]byte
+	copy(haddr[:], hw)
+	return string(haddr[:]), nil
+}
+
+func (d leaseDB) leases(hosts *host.Registry) []Lease {
+	leases := make([]Lease, 0, len(d))
+	for haddr, ip := range d {
+		mac := net.HardwareAddr(haddr[:ETHERNETHLEN]).String()
+		_, reserved := hosts.Reservation(mac)
+		leases = append(leases, Lease{MAC: mac, IP: ip, Reserved: reserved})
+	}
+	slices.SortFunc(leases, func(a, b Lease) int { return strings.Compare(a.MAC, b.MAC) })
+	return leases
+}
+
+func (d leaseDB) leased(ip string) bool {
+	for _, leased := range d {
+		if leased == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// SetLeaseStore replaces the store of the leases, which is the lease file
+// by default, and restores the leases from it.
+func (s *Server) SetLeaseStore(store LeaseStore) error {
+	return s.loadLeases(store)
+}
+
+// loadLeases restores the leases from store. A nil store keeps the leases
+// in memory only.
+func (s *Server) loadLeases(store LeaseStore) error {
+	s.dbMu.Lock()
+	defer s.dbMu.Unlock()
+	s.store = store
+	s.db = make(leaseDB)
+	s.current = 0
+	s.dirty = false
+	if store == nil {
+		return nil
+	}
+
+	leases, err := store.Load()
+	if err != nil {
+		return err
+	}
+	for _, l := range leases {
+		key, err := leaseKey(l.MAC)
+		if err != nil {
+			return err
+		}
+		if net.ParseIP(l.IP).To4() == nil {
+			return errors.New("invalid IP address " + l.IP + " of lease " + l.MAC)
+		}
+		s.db[key] = l.IP
+	}
+	return nil
+}
+
+// saveLeases writes the leases to the store if they have changed.
+func (s *Server) saveLeases() error {
+	s.dbMu.Lock()
+	defer s.dbMu.Unlock()
+	if s.store == nil || !s.dirty {
+		return nil
+	}
+
+	if err := s.store.Save(s.db.leases(s.hosts)); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
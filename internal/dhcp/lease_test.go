@@ -0,0 +1,113 @@
+package dhcp
+
+import (
+	"net"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/callus-corn/tao/internal/host"
+)
+
+func TestLeaseFile(t *testing.T) {
+	store := NewFileStore(filepath.Join(t.TempDir(), "leases.json"))
+	s := &Server{rangeStart: "10.0.1.2/16", hosts: host.NewRegistry()}
+	if err := s.loadLeases(store); err != nil {
+		t.Fatal(err)
+	}
+
+	a := [16]byte{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x01}
+	b := [16]byte{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x02}
+	s.dbMu.Lock()
+	s.pick(a)
+	s.pick(b)
+	s.dbMu.Unlock()
+	if err := s.saveLeases(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.loadLeases(store); err != nil {
+		t.Fatal(err)
+	}
+	leases := s.Leases()
+	if len(leases) != 2 || leases[0].IP != "10.0.1.2" || leases[1].IP != "10.0.1.3" {
+		t.Fatalf("got %+v", leases)
+	}
+
+	// The restored leases are not handed out again.
+	c := [16]byte{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x03}
+	s.dbMu.Lock()
+	picked, err := s.pick(c)
+	s.dbMu.Unlock()
+	if err != nil || picked != [4]byte{10, 0, 1, 4} {
+		t.Fatalf("got %v %v", picked, err)
+	}
+
+	if !s.DeleteLease("aa:bb:cc:dd:ee:01") {
+		t.Fatal("lease is not deleted")
+	}
+	if err := s.loadLeases(store); err != nil {
+		t.Fatal(err)
+	}
+	if leases := s.Leases(); len(leases) != 2 || leases[0].MAC != "aa:bb:cc:dd:ee:02" {
+		t.Fatalf("got %+v", leases)
+	}
+}
+
+func TestPickRange(t *testing.T) {
+	tests := []struct {
+		start string
+		end   string
+		wants []string
+	}{
+		{"10.0.1.250/24", "", []string{"10.0.1.250", "10.0.1.251", "10.0.1.252", "10.0.1.253", "10.0.1.254"}},
+		{"10.0.1.2/24", "10.0.1.4", []string{"10.0.1.2", "10.0.1.3", "10.0.1.4"}},
+		{"10.0.1.0/16", "10.0.1.1", []string{"10.0.1.0", "10.0.1.1"}},
+	}
+	for _, tt := range tests {
+		s := &Server{rangeStart: tt.start, rangeEnd: tt.end, hosts: host.NewRegistry(), db: make(leaseDB)}
+		var got []string
+		for i := range 256 {
+			picked, err := s.pick([16]byte{0xaa, 0xbb, 0xcc, 0xdd, byte(i >> 8), byte(i)})
+			if err != nil {
+				break
+			}
+			got = append(got, net.IP(picked[:]).String())
+		}
+		if !slices.Equal(got, tt.wants) {
+			t.Fatalf("%s to %q: got %v", tt.start, tt.end, got)
+		}
+	}
+}
+
+type stubStore struct {
+	leases []Lease
+}
+
+func (s *stubStore) Load() ([]Lease, error)    { return s.leases, nil }
+func (s *stubStore) Save(leases []Lease) error { s.leases = leases; return nil }
+
+func TestSetLeaseStore(t *testing.T) {
+	s := &Server{rangeStart: "10.0.1.2/16", hosts: host.NewRegistry()}
+	store := &stubStore{leases: []Lease{{MAC: "aa:bb:cc:dd:ee:01", IP: "10.0.1.2"}}}
+	if err := s.SetLeaseStore(store); err != nil {
+		t.Fatal(err)
+	}
+	if leases := s.Leases(); len(leases) != 1 || leases[0].IP != "10.0.1.2" {
+		t.Fatalf("got %+v", leases)
+	}
+
+	s.dbMu.Lock()
+	s.pick([16]byte{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x02})
+	s.dbMu.Unlock()
+	if err := s.saveLeases(); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.leases) != 2 || store.leases[1].IP != "10.0.1.3" {
+		t.Fatalf("got %+v", store.leases)
+	}
+
+	if err := s.SetLeaseStore(&stubStore{leases: []Lease{{MAC: "invalid"}}}); err == nil {
+		t.Fatal("invalid lease is loaded")
+	}
+}
@@ -0,0 +1,54 @@
+package dhcp
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+)
+
+// LeaseStore keeps the leases across restarts.
+type LeaseStore interface {
+	// Load returns the leases saved last.
+	Load() ([]Lease, error)
+	// Save replaces the saved leases with leases.
+	Save(leases []Lease) error
+}
+
+type fileStore struct {
+	name string
+}
+
+// NewFileStore returns a store keeping the leases in the JSON file name.
+func NewFileStore(name string) LeaseStore {
+	return &fileStore{name: name}
+}
+
+// Load returns no lease when the file is missing.
+func (f *fileStore) Load() ([]Lease, error) {
+	data, err := os.ReadFile(f.name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var leases []Lease
+	if err := json.Unmarshal(data, &leases); err != nil {
+		return nil, err
+	}
+	return leases, nil
+}
+
+// Save replaces the file at once so that a crash never leaves half of it.
+func (f *fileStore) Save(leases []Lease) error {
+	data, err := json.MarshalIndent(leases, "", "    ")
+	if err != nil {
+		return err
+	}
+	tmp := f.name + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.name)
+}
@@ -0,0 +1,69 @@
+// Package event describes what the servers see of the hosts they boot.
+package event
+
+import (
+	"sync"
+	"time"
+)
+
+// Type is what has happened to a host.
+type Type string
+
+const (
+	// DHCPDiscover is a DHCPDISCOVER answered with an offer.
+	DHCPDiscover Type = "dhcp.discover"
+	// DHCPAck is a DHCPREQUEST acknowledged with a lease.
+	DHCPAck Type = "dhcp.ack"
+	// TFTPTransfer is a file sent over TFTP to the end.
+	TFTPTransfer Type = "tftp.transfer"
+	// HTTPRequest is a file, template or metadata served over HTTP.
+	HTTPRequest Type = "http.request"
+	// InstallProgress is the installer of a host reporting a step.
+	InstallProgress Type = "install.progress"
+	// InstallLog is the installer of a host uploading a log.
+	InstallLog Type = "install.log"
+	// InstallDone is the installer of a host reporting success.
+	InstallDone Type = "install.done"
+	// InstallFailed is the installer of a host reporting a failure.
+	InstallFailed Type = "install.failed"
+)
+
+// Event is a message handled or a file served for a host.
+type Event struct {
+	Type Type   `json:"Type"`
+	MAC  string `json:"MAC"`
+	IP   string `json:"IP"`
+	// File is the file name of a TFTP transfer, the path of an HTTP
+	// request or the file an installer log is saved to.
+	File string `json:"File"`
+	// Message is what an installer has reported.
+	Message string    `json:"Message"`
+	Time    time.Time `json:"Time"`
+}
+
+// Hooks calls the functions added to it for each event. The zero value is
+// ready to use.
+type Hooks struct {
+	mu    sync.RWMutex
+	hooks []func(Event)
+}
+
+// Add adds fn to the functions called by Emit.
+func (h *Hooks) Add(fn func(Event)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.hooks = append(h.hooks, fn)
+}
+
+// Emit calls the hooks in the order they were added. The time of e is set
+// if it is zero.
+func (h *Hooks) Emit(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, fn := range h.hooks {
+		fn(e)
+	}
+}
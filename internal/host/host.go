@@ -0,0 +1,388 @@
+package host
+
+import (
+	"errors"
+	"maps"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/callus-corn/tao/internal/config"
+)
+
+// Host is a reservation of the config or the API, or a host seen through
+// DHCP.
+type Host struct {
+	MAC      string            `json:"MAC"`
+	IP       string            `json:"IP"`
+	Hostname string            `json:"Hostname"`
+	Arch     string            `json:"Arch"`
+	Labels   map[string]string `json:"Labels"`
+
+	InstanceID string   `json:"InstanceID"`
+	SSHKeys    []string `json:"SSHKeys"`
+	UserData   string   `json:"UserData"`
+
+	// Profile is the boot profile of the host. The classes of the boot
+	// config decide it when it is empty.
+	Profile string `json:"Profile"`
+
+	// NetbootOnce makes the host boot from its local disk once its
+	// installer has reported success, until it is re-armed.
+	NetbootOnce bool `json:"NetbootOnce"`
+
+	// source is where the reservation comes from, empty for hosts only
+	// seen through DHCP.
+	source string
+}
+
+// Entry is a known host as kept by a store.
+type Entry struct {
+	Host
+	// Source is "config" or "api" for reservations, empty for hosts only
+	// seen through DHCP.
+	Source string `json:"Source"`
+}
+
+// Network is what DHCP configures the hosts with.
+type Network struct {
+	Prefix  int
+	Gateway string
+	DNS     []string
+}
+
+const (
+	sourceConfig = "config"
+	sourceAPI    = "api"
+)
+
+// Registry is the set of hosts known to the servers sharing it: the
+// reservations and the hosts seen through DHCP.
+type Registry struct {
+	mu      sync.RWMutex
+	hosts   map[string]*Host
+	network Network
+
+	hooksMu sync.Mutex
+	hooks   []func()
+}
+
+// NewRegistry returns a registry without any host.
+func NewRegistry() *Registry {
+	return &Registry{hosts: make(map[string]*Host)}
+}
+
+// Set replaces the reservations of the config with reservations. Hosts
+// reserved through the API or only seen through DHCP are kept unless a
+// reservation takes their address.
+func (r *Registry) Set(reservations []Host) error {
+	next, err := validate(reservations)
+	if err != nil {
+		return err
+	}
+
+	defer r.changed()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for mac, h := range r.hosts {
+		if n, ok := next[mac]; ok {
+			if n.IP == "" {
+				n.IP = h.IP
+			}
+			if n.Arch == "" {
+				n.Arch = h.Arch
+			}
+			continue
+		}
+		if h.source != sourceConfig && !reserved(next, h.IP) {
+			next[mac] = h
+		}
+	}
+	r.hosts = next
+	return nil
+}
+
+// Validate checks reservations without changing the known hosts.
+func Validate(reservations []Host) error {
+	_, err := validate(reservations)
+	return err
+}
+
+// Put adds or replaces the reservation of h.MAC.
+func (r *Registry) Put(h Host) error {
+	mac, err := NormalizeMAC(h.MAC)
+	if err != nil {
+		return err
+	}
+	if h.IP != "" && net.ParseIP(h.IP).To4() == nil {
+		return errors.New("invalid IP address " + h.IP + " of host " + h.MAC)
+	}
+
+	defer r.changed()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, other := range r.hosts {
+		if other.MAC != mac && other.source != "" && h.IP != "" && other.IP == h.IP {
+			return errors.New("IP address " + h.IP + " is reserved by " + other.MAC)
+		}
+	}
+	h.MAC = mac
+	h.Labels = maps.Clone(h.Labels)
+	h.SSHKeys = slices.Clone(h.SSHKeys)
+	h.source = sourceAPI
+	r.hosts[mac] = &h
+	return nil
+}
+
+// Delete removes the host of mac and reports whether it was known.
+func (r *Registry) Delete(mac string) bool {
+	mac, err := NormalizeMAC(mac)
+	if err != nil {
+		return false
+	}
+
+	defer r.changed()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.hosts[mac]
+	delete(r.hosts, mac)
+	return ok
+}
+
+// Get returns a copy of the host of mac.
+func (r *Registry) Get(mac string) (Host, bool) {
+	mac, err := NormalizeMAC(mac)
+	if err != nil {
+		return Host{}, false
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	h, ok := r.hosts[mac]
+	if !ok {
+		return Host{}, false
+	}
+	return h.clone(), true
+}
+
+// Reservation returns the address reserved for mac by the config or the API.
+func (r *Registry) Reservation(mac string) (string, bool) {
+	mac, err := NormalizeMAC(mac)
+	if err != nil {
+		return "", false
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	h, ok := r.hosts[mac]
+	if !ok || h.source == "" || h.IP == "" {
+		return "", false
+	}
+	return h.IP, true
+}
+
+// Reserved reports whether ip is reserved by the config or the API.
+func (r *Registry) Reserved(ip string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, h := range r.hosts {
+		if h.source != "" && h.IP == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// ByIP returns a copy of the host with the address ip, reserved or leased.
+func (r *Registry) ByIP(ip string) (Host, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, h := range r.hosts {
+		if h.IP == ip {
+			return h.clone(), true
+		}
+	}
+	return Host{}, false
+}
+
+// All returns copies of the known hosts sorted by MAC address.
+func (r *Registry) All() []Host {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	all := make([]Host, 0, len(r.hosts))
+	for _, h := range r.hosts {
+		all = append(all, h.clone())
+	}
+	slices.SortFunc(all, func(a, b Host) int { return strings.Compare(a.MAC, b.MAC) })
+	return all
+}
+
+// Observe records what DHCP learned about a host. The address of a
+// reservation is never overwritten.
+func (r *Registry) Observe(mac string, ip string, arch string) {
+	mac, err := NormalizeMAC(mac)
+	if err != nil {
+		return
+	}
+
+	if r.observe(mac, ip, arch) {
+		r.changed()
+	}
+}
+
+// observe records the host and reports whether anything has changed.
+func (r *Registry) observe(mac string, ip string, arch string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	h, ok := r.hosts[mac]
+	if ok && (h.IP != "" || ip == "") && (arch == "" || h.Arch == arch) {
+		return false
+	}
+	if !ok {
+		h = &Host{MAC: mac}
+		r.hosts[mac] = h
+	}
+	if h.IP == "" {
+		h.IP = ip
+	}
+	if arch != "" {
+		h.Arch = arch
+	}
+	return true
+}
+
+// Entries returns the known hosts to be kept by a store.
+func (r *Registry) Entries() []Entry {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	entries := make([]Entry, 0, len(r.hosts))
+	for _, h := range r.hosts {
+		entries = append(entries, Entry{Host: h.clone(), Source: h.source})
+	}
+	slices.SortFunc(entries, func(a, b Entry) int { return strings.Compare(a.MAC, b.MAC) })
+	return entries
+}
+
+// Restore adds the hosts of entries which are not known. Reservations of
+// the config are skipped, since the config in use decides them.
+func (r *Registry) Restore(entries []Entry) {
+	defer r.changed()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, e := range entries {
+		mac, err := NormalizeMAC(e.MAC)
+		if err != nil || e.Source == sourceConfig {
+			continue
+		}
+		if _, ok := r.hosts[mac]; ok || reserved(r.hosts, e.IP) {
+			continue
+		}
+		h := e.Host
+		h.MAC = mac
+		h.Labels = maps.Clone(h.Labels)
+		h.SSHKeys = slices.Clone(h.SSHKeys)
+		h.source = e.Source
+		if h.source != sourceAPI {
+			h.source = ""
+		}
+		r.hosts[mac] = &h
+	}
+}
+
+// OnChange adds fn to the functions called after the known hosts change.
+func (r *Registry) OnChange(fn func()) {
+	r.hooksMu.Lock()
+	defer r.hooksMu.Unlock()
+	r.hooks = append(r.hooks, fn)
+}
+
+func (r *Registry) changed() {
+	r.hooksMu.Lock()
+	fns := slices.Clone(r.hooks)
+	r.hooksMu.Unlock()
+	for _, fn := range fns {
+		fn()
+	}
+}
+
+// SetNetwork records the network hosts are configured with by DHCP.
+func (r *Registry) SetNetwork(n Network) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n.DNS = slices.Clone(n.DNS)
+	r.network = n
+}
+
+// GetNetwork returns the network set by SetNetwork.
+func (r *Registry) GetNetwork() Network {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	n := r.network
+	n.DNS = slices.Clone(r.network.DNS)
+	return n
+}
+
+// NormalizeMAC returns mac, separated by colons or hyphens, in the lower
+// case form separated by colons.
+func NormalizeMAC(mac string) (string, error) {
+	hw, err := net.ParseMAC(strings.ReplaceAll(mac, "-", ":"))
+	if err != nil {
+		return "", err
+	}
+	return hw.String(), nil
+}
+
+func validate(reservations []Host) (map[string]*Host, error) {
+	next := make(map[string]*Host)
+	ips := make(map[string]string)
+	for i, h := range reservations {
+		path := "[" + strconv.Itoa(i) + "]"
+		mac, err := NormalizeMAC(h.MAC)
+		if err != nil {
+			return nil, config.Errorf(path+".MAC", "%w", err)
+		}
+		if h.IP != "" && net.ParseIP(h.IP).To4() == nil {
+			return nil, config.Errorf(path+".IP", "invalid IP address %s of host %s", h.IP, h.MAC)
+		}
+		if _, ok := next[mac]; ok {
+			return nil, config.Errorf(path+".MAC", "duplicate host %s", h.MAC)
+		}
+		if other, ok := ips[h.IP]; ok && h.IP != "" {
+			return nil, config.Errorf(path+".IP", "IP address %s is reserved by %s", h.IP, other)
+		}
+		ips[h.IP] = mac
+		h.MAC = mac
+		h.Labels = maps.Clone(h.Labels)
+		h.SSHKeys = slices.Clone(h.SSHKeys)
+		h.source = sourceConfig
+		next[mac] = &h
+	}
+	return next, nil
+}
+
+func reserved(hosts map[string]*Host, ip string) bool {
+	for _, h := range hosts {
+		if ip != "" && h.IP == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// ID returns the instance ID of the host, derived from its MAC address
+// unless one is configured.
+func (h Host) ID() string {
+	if h.InstanceID != "" {
+		return h.InstanceID
+	}
+	return "iid-" + strings.ReplaceAll(h.MAC, ":", "")
+}
+
+func (h *Host) clone() Host {
+	c := *h
+	c.Labels = maps.Clone(h.Labels)
+	c.SSHKeys = slices.Clone(h.SSHKeys)
+	return c
+}
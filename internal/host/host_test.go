@@ -0,0 +1,145 @@
+package host
+
+import (
+	"testing"
+)
+
+func TestSet(t *testing.T) {
+	r := NewRegistry()
+	err := r.Set([]Host{
+		{MAC: "AA-BB-CC-DD-EE-01", IP: "10.0.1.10", Hostname: "node1", Labels: map[string]string{"rack": "a"}},
+		{MAC: "aa:bb:cc:dd:ee:02", Hostname: "node2"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h, ok := r.Get("aa:bb:cc:dd:ee:01")
+	if !ok || h.Hostname != "node1" || h.Labels["rack"] != "a" {
+		t.Fatalf("got %+v", h)
+	}
+	if ip, ok := r.Reservation("AA:BB:CC:DD:EE:01"); !ok || ip != "10.0.1.10" {
+		t.Fatalf("got reservation %s", ip)
+	}
+	if _, ok := r.Reservation("aa:bb:cc:dd:ee:02"); ok {
+		t.Fatal("host without address has a reservation")
+	}
+	if !r.Reserved("10.0.1.10") || r.Reserved("10.0.1.11") {
+		t.Fatal("reserved address is not reported")
+	}
+
+	h.Labels["rack"] = "b"
+	if h, _ := r.Get("aa:bb:cc:dd:ee:01"); h.Labels["rack"] != "a" {
+		t.Fatal("host is modified through a copy")
+	}
+
+	for _, hosts := range [][]Host{
+		{{MAC: "invalid"}},
+		{{MAC: "aa:bb:cc:dd:ee:01", IP: "10.0.1"}},
+		{{MAC: "aa:bb:cc:dd:ee:01"}, {MAC: "AA-BB-CC-DD-EE-01"}},
+	} {
+		if err := r.Set(hosts); err == nil {
+			t.Fatalf("invalid hosts are accepted: %v", hosts)
+		}
+	}
+}
+
+func TestObserve(t *testing.T) {
+	r := NewRegistry()
+	if err := r.Set([]Host{{MAC: "aa:bb:cc:dd:ee:01", IP: "10.0.1.10"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	r.Observe("aa:bb:cc:dd:ee:01", "10.0.1.2", "x64-uefi")
+	r.Observe("aa:bb:cc:dd:ee:02", "10.0.1.3", "x86-bios")
+
+	if h, _ := r.Get("aa:bb:cc:dd:ee:01"); h.IP != "10.0.1.10" || h.Arch != "x64-uefi" {
+		t.Fatalf("reservation is overwritten: %+v", h)
+	}
+	if h, ok := r.ByIP("10.0.1.3"); !ok || h.MAC != "aa:bb:cc:dd:ee:02" || h.Arch != "x86-bios" {
+		t.Fatalf("got %+v", h)
+	}
+	if len(r.All()) != 2 {
+		t.Fatalf("got %v", r.All())
+	}
+
+	if err := r.Set([]Host{{MAC: "aa:bb:cc:dd:ee:03", IP: "10.0.1.3"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.Get("aa:bb:cc:dd:ee:01"); ok {
+		t.Fatal("removed reservation is kept")
+	}
+	if _, ok := r.Get("aa:bb:cc:dd:ee:02"); ok {
+		t.Fatal("observed host conflicting with a reservation is kept")
+	}
+}
+
+func TestPut(t *testing.T) {
+	r := NewRegistry()
+	if err := r.Set([]Host{{MAC: "aa:bb:cc:dd:ee:01", IP: "10.0.1.10"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Put(Host{MAC: "AA-BB-CC-DD-EE-02", IP: "10.0.1.11", Hostname: "node2"}); err != nil {
+		t.Fatal(err)
+	}
+	if ip, ok := r.Reservation("aa:bb:cc:dd:ee:02"); !ok || ip != "10.0.1.11" {
+		t.Fatalf("got %v %v", ip, ok)
+	}
+	if err := r.Put(Host{MAC: "aa:bb:cc:dd:ee:03", IP: "10.0.1.10"}); err == nil {
+		t.Fatal("reserved address is taken")
+	}
+	if err := r.Put(Host{MAC: "aa:bb:cc:dd:ee:01", IP: "10.0.1.12"}); err != nil {
+		t.Fatal(err)
+	}
+	if r.Reserved("10.0.1.10") {
+		t.Fatal("old address of the edited reservation is still reserved")
+	}
+
+	if !r.Delete("aa:bb:cc:dd:ee:02") {
+		t.Fatal("host is not deleted")
+	}
+	if r.Delete("aa:bb:cc:dd:ee:02") {
+		t.Fatal("deleted host is deleted again")
+	}
+}
+
+func TestRestore(t *testing.T) {
+	r := NewRegistry()
+	if err := r.Set([]Host{{MAC: "aa:bb:cc:dd:ee:01", IP: "10.0.1.10"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Put(Host{MAC: "aa:bb:cc:dd:ee:02", IP: "10.0.1.11"}); err != nil {
+		t.Fatal(err)
+	}
+	r.Observe("aa:bb:cc:dd:ee:03", "10.0.1.2", "x64-uefi")
+	entries := r.Entries()
+	if len(entries) != 3 || entries[0].Source != "config" || entries[1].Source != "api" || entries[2].Source != "" {
+		t.Fatalf("got %+v", entries)
+	}
+
+	// Reservations of the API survive a reload of the config.
+	if err := r.Set([]Host{{MAC: "aa:bb:cc:dd:ee:04", IP: "10.0.1.12"}}); err != nil {
+		t.Fatal(err)
+	}
+	if ip, ok := r.Reservation("aa:bb:cc:dd:ee:02"); !ok || ip != "10.0.1.11" {
+		t.Fatalf("got %v %v", ip, ok)
+	}
+
+	if err := r.Set([]Host{{MAC: "aa:bb:cc:dd:ee:05", IP: "10.0.1.2"}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, mac := range []string{"aa:bb:cc:dd:ee:01", "aa:bb:cc:dd:ee:02", "aa:bb:cc:dd:ee:03"} {
+		r.Delete(mac)
+	}
+	r.Restore(entries)
+	if _, ok := r.Get("aa:bb:cc:dd:ee:01"); ok {
+		t.Fatal("reservation of an old config is restored")
+	}
+	if ip, ok := r.Reservation("aa:bb:cc:dd:ee:02"); !ok || ip != "10.0.1.11" {
+		t.Fatalf("got %v %v", ip, ok)
+	}
+	if _, ok := r.Get("aa:bb:cc:dd:ee:03"); ok {
+		t.Fatal("host taking a reserved address is restored")
+	}
+}
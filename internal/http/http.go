@@ -1,38 +1,345 @@
 package http
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"path"
 	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/callus-corn/tao/internal/config"
+	"github.com/callus-corn/tao/internal/event"
+	"github.com/callus-corn/tao/internal/host"
+	"github.com/callus-corn/tao/internal/profile"
 )
 
+// HTTPConfig is the HTTP section of tao.conf.
 type HTTPConfig struct {
 	IsEnable bool   `json:"IsEnable"`
 	Address  string `json:"Address"`
 	SrvDir   string `json:"SrvDir"`
+
+	Metadata              bool `json:"Metadata"`
+	MetadataTokenRequired bool `json:"MetadataTokenRequired"`
+
+	// InstallLogDir keeps the logs uploaded by installers. Uploads are
+	// refused when it is empty.
+	InstallLogDir string `json:"InstallLogDir"`
+
+	TLSAddress   string `json:"TLSAddress"`
+	CertFile     string `json:"CertFile"`
+	KeyFile      string `json:"KeyFile"`
+	AutoCert     bool   `json:"AutoCert"`
+	CertDir      string `json:"CertDir"`
+	ClientCAFile string `json:"ClientCAFile"`
+	ClientAuth   string `json:"ClientAuth"`
 }
 
 var logger = slog.New(slog.NewJSONHandler(os.Stdout, nil))
-var addr string
-var srvDir = "./"
 
-func Listen(c HTTPConfig) error {
-	addr = c.Address
-	srvDir = c.SrvDir
-	go listen()
+// Server serves files, templates and instance metadata over HTTP and
+// HTTPS. Its settings can be changed by Reload while it is serving.
+type Server struct {
+	// mu guards the settings Reload changes.
+	mu              sync.RWMutex
+	srvDir          string
+	metadataEnabled bool
+	tokenRequired   bool
+	installLogDir   string
+	tlsConf         atomic.Pointer[tls.Config]
+
+	// hosts and profiles describe the hosts requesting files.
+	hosts    *host.Registry
+	profiles *profile.Registry
+
+	address    string
+	tlsAddress string
+	servers    []*http.Server
+
+	tokenMu sync.Mutex
+	tokens  map[string]token
+
+	// installKey signs the tokens of the installer callbacks. logFiles and
+	// logBytes limit the logs kept for a host.
+	installKey []byte
+	logMu      sync.Mutex
+	logFiles   int
+	logBytes   int64
+
+	events event.Hooks
+
+	healthMu sync.Mutex
+	health   error
+}
+
+// statusWriter remembers the status code of the response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+// Validate checks the config without listening. Errors name the field.
+func (c HTTPConfig) Validate() error {
+	var errs []error
+	if c.Address == "" && c.TLSAddress == "" {
+		errs = append(errs, config.Errorf("Address", "Address or TLSAddress is required"))
+	}
+	if c.Address != "" {
+		errs = append(errs, config.Address("Address", c.Address))
+	}
+	errs = append(errs, config.Dir("SrvDir", c.SrvDir))
+	if c.InstallLogDir != "" {
+		errs = append(errs, config.Dir("InstallLogDir", c.InstallLogDir))
+	}
+	if c.TLSAddress == "" {
+		return errors.Join(errs...)
+	}
+
+	errs = append(errs, config.Address("TLSAddress", c.TLSAddress))
+	switch {
+	case c.AutoCert && c.CertDir == "":
+		errs = append(errs, config.Errorf("CertDir", "CertDir is required by AutoCert"))
+	case !c.AutoCert && c.CertFile == "":
+		errs = append(errs, config.Errorf("CertFile", "CertFile is required by TLSAddress without AutoCert"))
+	case !c.AutoCert && c.KeyFile == "":
+		errs = append(errs, config.Errorf("KeyFile", "KeyFile is required by TLSAddress without AutoCert"))
+	case !c.AutoCert:
+		errs = append(errs, config.File("CertFile", c.CertFile), config.File("KeyFile", c.KeyFile))
+	}
+	switch c.ClientAuth {
+	case "", "none":
+	case "request", "require":
+		if c.ClientCAFile != "" {
+			errs = append(errs, config.File("ClientCAFile", c.ClientCAFile))
+		} else if !c.AutoCert {
+			errs = append(errs, config.Errorf("ClientCAFile", "ClientCAFile is required by ClientAuth"))
+		}
+	default:
+		errs = append(errs, config.Errorf("ClientAuth", "must be none, request or require"))
+	}
+	return errors.Join(errs...)
+}
+
+// NewServer returns a server for c. The hosts requesting files are looked
+// up in hosts, and their boot configs generated from profiles. It does not
+// listen until Listen is called.
+func NewServer(c HTTPConfig, hosts *host.Registry, profiles *profile.Registry) (*Server, error) {
+	if err := c.Validate(); err != nil {
+		return nil, config.Prefix("HTTP", err)
+	}
+	s := newServer(c.SrvDir)
+	s.hosts, s.profiles = hosts, profiles
+	apply, err := s.prepare(c)
+	if err != nil {
+		return nil, err
+	}
+	apply()
+	s.address, s.tlsAddress = c.Address, c.TLSAddress
+	return s, nil
+}
+
+func newServer(dir string) *Server {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return &Server{
+		srvDir:     dir,
+		hosts:      host.NewRegistry(),
+		profiles:   profile.NewRegistry(),
+		tokens:     make(map[string]token),
+		installKey: key,
+		logFiles:   maxLogs,
+		logBytes:   maxLogBytes,
+		health:     errors.New("HTTP is not started"),
+	}
+}
+
+// Listen starts serving in the background. Requests see ctx as their base
+// context.
+func (s *Server) Listen(ctx context.Context) error {
+	var servers []*http.Server
+	listeners := make(map[*http.Server]net.Listener)
+	if s.address != "" {
+		srv := &http.Server{Addr: s.address, Handler: s}
+		servers = append(servers, srv)
+	}
+	if s.tlsAddress != "" {
+		// The certificates are looked up for each connection to follow Reload.
+		conf := &tls.Config{GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return s.tlsConf.Load(), nil
+		}}
+		srv := &http.Server{Addr: s.tlsAddress, Handler: s, TLSConfig: conf}
+		servers = append(servers, srv)
+	}
+	for _, srv := range servers {
+		srv.BaseContext = func(net.Listener) context.Context { return ctx }
+		ln, err := net.Listen("tcp", srv.Addr)
+		if err != nil {
+			for _, ln := range listeners {
+				ln.Close()
+			}
+			return err
+		}
+		listeners[srv] = ln
+	}
+	s.mu.Lock()
+	s.servers = servers
+	s.mu.Unlock()
+	for srv, ln := range listeners {
+		go s.serve(srv, ln)
+	}
+	s.setHealth(nil)
 	return nil
 }
 
-func listen() {
-	http.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		logger.Info("HTTP connection start from "+r.RemoteAddr, "module", "HTTP", "file", r.URL.Path)
-		upath := r.URL.Path
-		if !strings.HasPrefix(upath, "/") {
-			upath = "/" + upath
-			r.URL.Path = upath
+// Reload checks c against the running server and returns a function
+// applying it.
+func (s *Server) Reload(c HTTPConfig) (func(), error) {
+	if err := c.Validate(); err != nil {
+		return nil, config.Prefix("HTTP", err)
+	}
+	if c.Address != s.address {
+		return nil, config.Errorf("HTTP.Address", "cannot be changed without a restart")
+	}
+	if c.TLSAddress != s.tlsAddress {
+		return nil, config.Errorf("HTTP.TLSAddress", "cannot be changed without a restart")
+	}
+	return s.prepare(c)
+}
+
+func (s *Server) prepare(c HTTPConfig) (func(), error) {
+	var conf *tls.Config
+	if c.TLSAddress != "" {
+		var err error
+		if conf, err = tlsConfig(c); err != nil {
+			return nil, err
 		}
-		http.ServeFile(w, r, srvDir+upath)
-	}))
-	logger.Error(http.ListenAndServe(addr, nil).Error(), "module", "HTTP")
+	}
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.srvDir = c.SrvDir
+		s.metadataEnabled = c.Metadata
+		s.tokenRequired = c.MetadataTokenRequired
+		s.installLogDir = c.InstallLogDir
+		s.tlsConf.Store(conf)
+	}, nil
+}
+
+// Shutdown stops accepting connections and waits for the requests in
+// progress until ctx is done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	servers := s.servers
+	s.servers = nil
+	s.mu.Unlock()
+
+	var errs []error
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			srv.Close()
+			errs = append(errs, err)
+		}
+	}
+	s.setHealth(errors.New("HTTP is stopped"))
+	return errors.Join(errs...)
+}
+
+// Health returns nil while the server is listening.
+func (s *Server) Health() error {
+	s.healthMu.Lock()
+	defer s.healthMu.Unlock()
+	return s.health
+}
+
+func (s *Server) setHealth(err error) {
+	s.healthMu.Lock()
+	defer s.healthMu.Unlock()
+	s.health = err
+}
+
+func (s *Server) serve(srv *http.Server, ln net.Listener) {
+	var err error
+	if srv.TLSConfig != nil {
+		err = srv.ServeTLS(ln, "", "")
+	} else {
+		err = srv.Serve(ln)
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return
+	}
+	s.setHealth(err)
+	logger.Error(err.Error(), "module", "HTTP")
+}
+
+// OnEvent adds fn to the functions called for each request answered
+// successfully.
+func (s *Server) OnEvent(fn func(event.Event)) {
+	s.events.Add(fn)
+}
+
+// ServeHTTP serves r, so that the server can be mounted on another one.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+	s.handle(sw, r)
+	if sw.status < http.StatusBadRequest {
+		h := s.lookup(r)
+		s.events.Emit(event.Event{Type: event.HTTPRequest, MAC: h.MAC, IP: h.IP, File: r.URL.Path})
+	}
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	logger.Info("HTTP connection start from "+r.RemoteAddr, "module", "HTTP", "file", r.URL.Path)
+	upath := r.URL.Path
+	if !strings.HasPrefix(upath, "/") {
+		upath = "/" + upath
+		r.URL.Path = upath
+	}
+	s.mu.RLock()
+	metadata := s.metadataEnabled
+	s.mu.RUnlock()
+	if metadata && s.serveMetadata(w, r) {
+		return
+	}
+	if strings.HasPrefix(upath, noCloudPrefix) && s.serveNoCloud(w, r) {
+		return
+	}
+	if strings.HasPrefix(upath, installPrefix) && s.serveInstall(w, r) {
+		return
+	}
+	if strings.HasPrefix(upath, profilePrefix) && s.serveProfile(w, r) {
+		return
+	}
+	dir := s.serverDir()
+	if tmpl := dir + path.Clean(upath) + templateExt; isFile(tmpl) {
+		s.serveTemplate(w, r, tmpl)
+		return
+	}
+	http.ServeFile(w, r, dir+upath)
+}
+
+func (s *Server) serverDir() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.srvDir
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func isFile(name string) bool {
+	info, err := os.Stat(name)
+	return err == nil && !info.IsDir()
 }
@@ -0,0 +1,415 @@
+package http
+
+import (
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/callus-corn/tao/internal/event"
+	"github.com/callus-corn/tao/internal/host"
+	"github.com/callus-corn/tao/internal/profile"
+)
+
+func TestTemplate(t *testing.T) {
+	dir := t.TempDir()
+	s := newServer(dir)
+	tmpl := "#!ipxe\nset hostname {{.Hostname}}\nset mac {{.MAC}}\nset ip {{.IP}}\nset arch {{.Arch}}\nset rack {{index .Labels \"rack\"}}\nchain http://{{.Server}}/next\n"
+	if err := os.WriteFile(filepath.Join(dir, "boot.ipxe.tmpl"), []byte(tmpl), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "static.txt"), []byte("static"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := s.hosts.Set([]host.Host{
+		{MAC: "aa:bb:cc:dd:ee:01", IP: "10.0.1.10", Hostname: "node1", Arch: "x64-uefi", Labels: map[string]string{"rack": "a"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []event.Event
+	s.OnEvent(func(e event.Event) { events = append(events, e) })
+
+	tests := []struct {
+		name   string
+		target string
+		remote string
+		wants  string
+	}{
+		{
+			name:   "by source address",
+			target: "/boot.ipxe",
+			remote: "10.0.1.10:1234",
+			wants:  "#!ipxe\nset hostname node1\nset mac aa:bb:cc:dd:ee:01\nset ip 10.0.1.10\nset arch x64-uefi\nset rack a\nchain http://tao/next\n",
+		},
+		{
+			name:   "by mac",
+			target: "/boot.ipxe?mac=AA-BB-CC-DD-EE-01",
+			remote: "10.0.9.9:1234",
+			wants:  "#!ipxe\nset hostname node1\nset mac aa:bb:cc:dd:ee:01\nset ip 10.0.1.10\nset arch x64-uefi\nset rack a\nchain http://tao/next\n",
+		},
+		{
+			name:   "unknown host with parameters",
+			target: "/boot.ipxe?mac=aa:bb:cc:dd:ee:02&hostname=node2&arch=arm64-uefi",
+			remote: "10.0.1.20:1234",
+			wants:  "#!ipxe\nset hostname node2\nset mac aa:bb:cc:dd:ee:02\nset ip 10.0.1.20\nset arch arm64-uefi\nset rack \nchain http://tao/next\n",
+		},
+		{
+			name:   "static file",
+			target: "/static.txt",
+			remote: "10.0.1.10:1234",
+			wants:  "static",
+		},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "http://tao"+tt.target, nil)
+		r.RemoteAddr = tt.remote
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+
+		got, err := io.ReadAll(w.Result().Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != 200 || string(got) != tt.wants {
+			t.Fatalf("Fail at %s: got %d %q", tt.name, w.Code, got)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "http://tao/missing", nil)
+	s.ServeHTTP(httptest.NewRecorder(), r)
+	if len(events) != len(tests) || events[0].MAC != "aa:bb:cc:dd:ee:01" || events[0].File != "/boot.ipxe" {
+		t.Fatalf("got %+v", events)
+	}
+}
+
+func TestNoCloud(t *testing.T) {
+	dir := t.TempDir()
+	s := newServer(dir)
+	if err := os.Mkdir(filepath.Join(dir, "nocloud"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "custom.yaml"), []byte("#cloud-config\nfqdn: {{.Hostname}}.example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := s.hosts.Set([]host.Host{
+		{MAC: "aa:bb:cc:dd:ee:01", IP: "10.0.1.10", Hostname: "node1", SSHKeys: []string{"ssh-ed25519 AAAA node1"}},
+		{MAC: "aa:bb:cc:dd:ee:02", Hostname: "node2", InstanceID: "node2-1", UserData: "custom.yaml"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.hosts.SetNetwork(host.Network{Prefix: 8, Gateway: "10.0.0.1", DNS: []string{"8.8.8.8"}})
+
+	tests := []struct {
+		target string
+		remote string
+		code   int
+		wants  string
+	}{
+		{
+			target: "/nocloud/meta-data",
+			remote: "10.0.1.10:1234",
+			code:   200,
+			wants:  "instance-id: \"iid-aabbccddee01\"\nlocal-hostname: \"node1\"\npublic-keys:\n  - \"ssh-ed25519 AAAA node1\"\n",
+		},
+		{
+			target: "/nocloud/user-data",
+			remote: "10.0.1.10:1234",
+			code:   200,
+			wants:  "#cloud-config\nhostname: \"node1\"\nssh_authorized_keys:\n  - \"ssh-ed25519 AAAA node1\"\n",
+		},
+		{
+			target: "/nocloud/vendor-data",
+			remote: "10.0.1.10:1234",
+			code:   200,
+			wants:  "",
+		},
+		{
+			target: "/nocloud/network-config",
+			remote: "10.0.1.10:1234",
+			code:   200,
+			wants: "version: 2\nethernets:\n  id0:\n    match:\n      macaddress: \"aa:bb:cc:dd:ee:01\"\n" +
+				"    addresses:\n      - \"10.0.1.10/8\"\n    routes:\n      - to: default\n        via: \"10.0.0.1\"\n" +
+				"    nameservers:\n      addresses:\n        - \"8.8.8.8\"\n",
+		},
+		{
+			target: "/nocloud/aa:bb:cc:dd:ee:02/meta-data",
+			remote: "10.0.1.99:1234",
+			code:   200,
+			wants:  "instance-id: \"node2-1\"\nlocal-hostname: \"node2\"\n",
+		},
+		{
+			target: "/nocloud/aa:bb:cc:dd:ee:02/user-data",
+			remote: "10.0.1.99:1234",
+			code:   200,
+			wants:  "#cloud-config\nfqdn: node2.example.com\n",
+		},
+		{
+			target: "/nocloud/aa:bb:cc:dd:ee:02/network-config",
+			remote: "10.0.1.99:1234",
+			code:   200,
+			wants:  "version: 2\nethernets:\n  id0:\n    match:\n      macaddress: \"aa:bb:cc:dd:ee:02\"\n    dhcp4: true\n",
+		},
+		{
+			target: "/nocloud/meta-data",
+			remote: "10.0.1.99:1234",
+			code:   404,
+			wants:  "404 page not found\n",
+		},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "http://tao"+tt.target, nil)
+		r.RemoteAddr = tt.remote
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+
+		got, err := io.ReadAll(w.Result().Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != tt.code || string(got) != tt.wants {
+			t.Fatalf("Fail at %s: got %d %q", tt.target, w.Code, got)
+		}
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	dir := t.TempDir()
+	s := newServer(dir)
+	s.metadataEnabled = true
+	err := s.hosts.Set([]host.Host{
+		{MAC: "aa:bb:cc:dd:ee:01", IP: "10.0.1.10", Hostname: "node1", SSHKeys: []string{"ssh-ed25519 AAAA one", "ssh-ed25519 BBBB two"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(method string, target string, remote string, header map[string]string) (int, string) {
+		r := httptest.NewRequest(method, "http://169.254.169.254"+target, nil)
+		r.RemoteAddr = remote
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		got, err := io.ReadAll(w.Result().Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return w.Code, string(got)
+	}
+
+	tests := []struct {
+		target string
+		code   int
+		wants  string
+	}{
+		{target: "/latest/meta-data/", code: 200, wants: "hostname\ninstance-id\nlocal-hostname\nlocal-ipv4\nmac\npublic-keys/"},
+		{target: "/latest/meta-data/instance-id", code: 200, wants: "iid-aabbccddee01"},
+		{target: "/2009-04-04/meta-data/hostname", code: 200, wants: "node1"},
+		{target: "/latest/meta-data/local-ipv4", code: 200, wants: "10.0.1.10"},
+		{target: "/latest/meta-data/public-keys/", code: 200, wants: "0=key-0\n1=key-1"},
+		{target: "/latest/meta-data/public-keys/1/", code: 200, wants: "openssh-key"},
+		{target: "/latest/meta-data/public-keys/1/openssh-key", code: 200, wants: "ssh-ed25519 BBBB two"},
+		{target: "/latest/meta-data/public-keys/2/openssh-key", code: 404, wants: "404 page not found\n"},
+		{target: "/latest/meta-data/unknown", code: 404, wants: "404 page not found\n"},
+		{target: "/latest/user-data", code: 200, wants: "#cloud-config\nhostname: \"node1\"\nssh_authorized_keys:\n  - \"ssh-ed25519 AAAA one\"\n  - \"ssh-ed25519 BBBB two\"\n"},
+	}
+	for _, tt := range tests {
+		code, got := get("GET", tt.target, "10.0.1.10:1234", nil)
+		if code != tt.code || got != tt.wants {
+			t.Fatalf("Fail at %s: got %d %q", tt.target, code, got)
+		}
+	}
+	if code, _ := get("GET", "/latest/meta-data/instance-id", "10.0.1.99:1234", nil); code != 404 {
+		t.Fatalf("unknown host got %d", code)
+	}
+
+	s.tokenRequired = true
+	if code, _ := get("GET", "/latest/meta-data/instance-id", "10.0.1.10:1234", nil); code != 401 {
+		t.Fatalf("request without token got %d", code)
+	}
+	if code, _ := get("GET", "/latest/api/token", "10.0.1.10:1234", map[string]string{tokenTTLHeader: "60"}); code != 405 {
+		t.Fatalf("GET token got %d", code)
+	}
+	if code, _ := get("PUT", "/latest/api/token", "10.0.1.10:1234", map[string]string{tokenTTLHeader: "0"}); code != 400 {
+		t.Fatalf("token without TTL got %d", code)
+	}
+	code, v := get("PUT", "/latest/api/token", "10.0.1.10:1234", map[string]string{tokenTTLHeader: "60"})
+	if code != 200 || v == "" {
+		t.Fatalf("token request got %d %q", code, v)
+	}
+	if code, got := get("GET", "/latest/meta-data/instance-id", "10.0.1.10:1234", map[string]string{tokenHeader: v}); code != 200 || got != "iid-aabbccddee01" {
+		t.Fatalf("request with token got %d %q", code, got)
+	}
+	if code, _ := get("GET", "/latest/meta-data/instance-id", "10.0.1.11:1234", map[string]string{tokenHeader: v}); code != 401 {
+		t.Fatalf("token from another host got %d", code)
+	}
+	if code, _ := get("GET", "/latest/meta-data/instance-id", "10.0.1.10:1234", map[string]string{tokenHeader: "invalid"}); code != 401 {
+		t.Fatalf("invalid token got %d", code)
+	}
+}
+
+func TestInstall(t *testing.T) {
+	dir := t.TempDir()
+	s := newServer(dir)
+	logs := t.TempDir()
+	s.installLogDir = logs
+	err := s.hosts.Set([]host.Host{{MAC: "aa:bb:cc:dd:ee:01", IP: "10.0.1.10"}, {MAC: "aa:bb:cc:dd:ee:02", IP: "10.0.1.11"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []event.Event
+	s.OnEvent(func(e event.Event) {
+		if e.MAC == "aa:bb:cc:dd:ee:01" && e.Type != event.HTTPRequest {
+			events = append(events, e)
+		}
+	})
+	post := func(target string, remote string, body string) int {
+		r := httptest.NewRequest("POST", "http://tao"+target, strings.NewReader(body))
+		r.RemoteAddr = remote
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "ks.cfg.tmpl"), []byte("{{.InstallToken}}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "http://tao/ks.cfg", nil)
+	r.RemoteAddr = "10.0.1.10:1234"
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	token := w.Body.String()
+	if w.Code != 200 || !strings.HasPrefix(token, "aabbccddee01-") {
+		t.Fatalf("got %d %q", w.Code, token)
+	}
+	_, sum, _ := strings.Cut(token, "-")
+	for _, target := range []string{"/ks.cfg?mac=aa:bb:cc:dd:ee:01", "/ks.cfg?ip=10.0.1.10"} {
+		r := httptest.NewRequest("GET", "http://tao"+target, nil)
+		r.RemoteAddr = "10.0.9.9:1234"
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != 200 || w.Body.Len() != 0 {
+			t.Fatalf("%s: got %d %q", target, w.Code, w.Body.String())
+		}
+	}
+
+	tests := []struct {
+		method string
+		target string
+		remote string
+		body   string
+		code   int
+	}{
+		{"POST", "/install/progress?step=packages", "10.0.1.10:1234", "", 204},
+		{"POST", "/install/log?name=../anaconda", "10.0.1.10:1234", "installing\n", 204},
+		{"POST", "/install/done", "10.0.1.10:1234", "", 204},
+		{"POST", "/install/failed?token=" + token + "&step=partition", "10.0.9.9:1234", "disk not found\n", 204},
+		{"GET", "/install/done", "10.0.1.10:1234", "", 405},
+		{"POST", "/install/done", "10.0.1.99:1234", "", 404},
+		// spoofed
+		{"POST", "/install/failed?mac=aa:bb:cc:dd:ee:01", "10.0.9.9:1234", "", 404},
+		{"POST", "/install/failed?ip=10.0.1.10", "10.0.9.9:1234", "", 404},
+		{"POST", "/install/failed?mac=aa:bb:cc:dd:ee:01", "10.0.1.11:1234", "", 204},
+		{"POST", "/install/failed?token=aabbccddee02-" + sum, "10.0.9.9:1234", "", 404},
+		{"POST", "/install/failed?token=invalid", "10.0.1.10:1234", "", 404},
+		{"POST", "/install/failed?token=" + s.installToken("aa:bb:cc:dd:ee:09"), "10.0.9.9:1234", "", 404},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "http://tao"+tt.target, strings.NewReader(tt.body))
+		r.RemoteAddr = tt.remote
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != tt.code {
+			t.Fatalf("%s %s from %s: got %d", tt.method, tt.target, tt.remote, w.Code)
+		}
+	}
+	if len(events) != 4 || events[0].Message != "step packages" || events[3].Type != event.InstallFailed || events[3].Message != "step partition: disk not found" {
+		t.Fatalf("got %+v", events)
+	}
+	log := events[1].File
+	if filepath.Dir(log) != filepath.Join(logs, "aa-bb-cc-dd-ee-01") || !strings.HasSuffix(log, "-anaconda.log") {
+		t.Fatalf("log is saved to %s", log)
+	}
+	if b, err := os.ReadFile(log); err != nil || string(b) != "installing\n" {
+		t.Fatalf("got %q %v", b, err)
+	}
+
+	// oversized
+	s.logFiles = 2
+	for i, code := range []int{204, 413} {
+		if got := post("/install/log?name=log"+strconv.Itoa(i), "10.0.1.10:1234", "log"); got != code {
+			t.Fatalf("log %d: got %d", i, got)
+		}
+	}
+	s.installLogDir = t.TempDir()
+	s.logFiles, s.logBytes = maxLogs, 10
+	for i, code := range []int{204, 204, 413} {
+		if got := post("/install/log?name=log"+strconv.Itoa(i), "10.0.1.10:1234", "12345678"); got != code {
+			t.Fatalf("log %d: got %d", i, got)
+		}
+	}
+	if b, err := os.ReadFile(events[len(events)-1].File); err != nil || string(b) != "12" {
+		t.Fatalf("got %q %v", b, err)
+	}
+
+	s.installLogDir = ""
+	if code := post("/install/log", "10.0.1.10:1234", "log"); code != 404 {
+		t.Fatalf("got %d without InstallLogDir", code)
+	}
+}
+
+func TestProfile(t *testing.T) {
+	dir := t.TempDir()
+	s := newServer(dir)
+	if err := os.WriteFile(filepath.Join(dir, "ks.cfg"), []byte("network --hostname={{.Hostname}}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := s.profiles.Set(profile.BootConfig{
+		Profiles: map[string]profile.Profile{
+			"rocky-9": {Kernel: "rocky/vmlinuz", Cmdline: "inst.ks={{.URL}}/profile/answer", AnswerFile: "ks.cfg"},
+			"memtest": {Kernel: "memtest.efi"},
+		},
+		Classes: []profile.Class{{Labels: map[string]string{"role": "test"}, Profile: "memtest"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.hosts.Set([]host.Host{
+		{MAC: "aa:bb:cc:dd:ee:01", IP: "10.0.1.10", Hostname: "node1", Profile: "rocky-9"},
+		{MAC: "aa:bb:cc:dd:ee:02", IP: "10.0.1.11", Labels: map[string]string{"role": "test"}},
+		{MAC: "aa:bb:cc:dd:ee:03", IP: "10.0.1.12"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		target string
+		remote string
+		code   int
+		wants  string
+	}{
+		{"/profile/ipxe", "10.0.1.10:1234", 200, "#!ipxe\nkernel http://tao/rocky/vmlinuz inst.ks=http://tao/profile/answer\nboot\n"},
+		{"/profile/answer", "10.0.1.10:1234", 200, "network --hostname=node1\n"},
+		{"/profile/pxelinux?mac=aa:bb:cc:dd:ee:02", "10.0.9.9:1234", 200, "DEFAULT memtest\nLABEL memtest\n    KERNEL /memtest.efi\n"},
+		{"/profile/answer", "10.0.1.11:1234", 404, ""},
+		{"/profile/ipxe", "10.0.1.12:1234", 404, ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "http://tao"+tt.target, nil)
+		r.RemoteAddr = tt.remote
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != tt.code || (tt.code == 200 && w.Body.String() != tt.wants) {
+			t.Fatalf("Fail at %s: got %d %q", tt.target, w.Code, w.Body.String())
+		}
+	}
+}
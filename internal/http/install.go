@@ -0,0 +1,201 @@
+package http
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/callus-corn/tao/internal/event"
+	"github.com/callus-corn/tao/internal/host"
+)
+
+const installPrefix = "/install/"
+
+// maxMessage and maxLog limit the body of the reports and of the uploaded
+// logs. maxLogs and maxLogBytes limit the logs kept for a host.
+const maxMessage = 4096
+const maxLog = 64 << 20
+const maxLogs = 32
+const maxLogBytes = 256 << 20
+
+var errLogQuota = errors.New("too many logs of the host")
+
+var logName = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// serveInstall records what the installer of a host reports, such as
+// "curl -X POST --data 'disk not found' http://tao/install/failed?step=partition"
+// from a kickstart. The host is identified by its source address, or by
+// ?token= issued to it as .InstallToken in the rendered templates. Unlike
+// templates, ?mac= and ?ip= are not trusted.
+//
+//	/install/progress  a step of the installation
+//	/install/log       a log saved to InstallLogDir, named by ?name= and cut at 64 MiB;
+//	                   a host keeps up to 32 logs and 256 MiB
+//	/install/done      the installation has succeeded
+//	/install/failed    the installation has failed
+func (s *Server) serveInstall(w http.ResponseWriter, r *http.Request) bool {
+	var t event.Type
+	switch strings.TrimPrefix(path.Clean(r.URL.Path), installPrefix) {
+	case "progress":
+		t = event.InstallProgress
+	case "log":
+		t = event.InstallLog
+	case "done":
+		t = event.InstallDone
+	case "failed":
+		t = event.InstallFailed
+	default:
+		return false
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "405 method not allowed", http.StatusMethodNotAllowed)
+		return true
+	}
+	h, ok := s.installHost(r)
+	if !ok {
+		logger.Error("installer host is not found", "module", "HTTP", "address", r.RemoteAddr)
+		http.NotFound(w, r)
+		return true
+	}
+
+	e := event.Event{Type: t, MAC: h.MAC, IP: h.IP, File: r.URL.Path}
+	if t == event.InstallLog {
+		name, err := s.saveLog(r, h)
+		if err == errLogQuota {
+			logger.Error("installer log is not saved: "+err.Error(), "module", "HTTP", "mac", h.MAC)
+			http.Error(w, "413 too many logs", http.StatusRequestEntityTooLarge)
+			return true
+		}
+		if err != nil {
+			logger.Error("installer log is not saved: "+err.Error(), "module", "HTTP", "mac", h.MAC)
+			http.Error(w, "500 internal server error", http.StatusInternalServerError)
+			return true
+		}
+		if name == "" {
+			http.Error(w, "404 log upload is not enabled", http.StatusNotFound)
+			return true
+		}
+		e.File = name
+	} else {
+		b, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxMessage))
+		if err != nil {
+			http.Error(w, "413 request entity too large", http.StatusRequestEntityTooLarge)
+			return true
+		}
+		e.Message = strings.TrimSpace(string(b))
+		if step := r.URL.Query().Get("step"); step != "" {
+			e.Message = strings.TrimSuffix("step "+step+": "+e.Message, ": ")
+		}
+	}
+	logger.Info("HTTP installer reports "+string(t), "module", "HTTP", "mac", h.MAC, "message", e.Message, "file", e.File)
+	s.events.Emit(e)
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// installHost identifies the host calling back by ?token=, or else by its
+// source address. Only known hosts are accepted.
+func (s *Server) installHost(r *http.Request) (host.Host, bool) {
+	if v := r.URL.Query().Get("token"); v != "" {
+		mac, ok := s.verifyInstallToken(v)
+		if !ok {
+			return host.Host{}, false
+		}
+		return s.hosts.Get(mac)
+	}
+	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+	return s.hosts.ByIP(ip)
+}
+
+// installToken returns the token of the host mac for the installer
+// callbacks. It is "<mac in hex>-<HMAC of mac>" so that it can be checked
+// without keeping it, and is valid until the server restarts.
+func (s *Server) installToken(mac string) string {
+	if mac == "" {
+		return ""
+	}
+	return strings.ReplaceAll(mac, ":", "") + "-" + s.installMAC(mac)
+}
+
+func (s *Server) installMAC(mac string) string {
+	m := hmac.New(sha256.New, s.installKey)
+	m.Write([]byte(mac))
+	return hex.EncodeToString(m.Sum(nil)[:16])
+}
+
+// verifyInstallToken returns the MAC address v is issued to.
+func (s *Server) verifyInstallToken(v string) (string, bool) {
+	hexMAC, sum, ok := strings.Cut(v, "-")
+	if !ok || len(hexMAC) != 12 {
+		return "", false
+	}
+	mac, err := host.NormalizeMAC(hexMAC)
+	if err != nil || !hmac.Equal([]byte(sum), []byte(s.installMAC(mac))) {
+		return "", false
+	}
+	return mac, true
+}
+
+// saveLog writes the body of r to InstallLogDir/<mac>/<time>-<name>.log and
+// returns the file name, empty when no directory is configured. The log is
+// cut to what is left of the quota of the host, and refused with
+// errLogQuota when nothing is left.
+func (s *Server) saveLog(r *http.Request, h host.Host) (string, error) {
+	s.mu.RLock()
+	dir := s.installLogDir
+	s.mu.RUnlock()
+	if dir == "" {
+		return "", nil
+	}
+
+	// logMu keeps concurrent uploads from passing the quota together.
+	s.logMu.Lock()
+	defer s.logMu.Unlock()
+	dir = filepath.Join(dir, strings.ReplaceAll(h.MAC, ":", "-"))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	left := s.logBytes
+	for _, e := range entries {
+		if info, err := e.Info(); err == nil {
+			left -= info.Size()
+		}
+	}
+	if len(entries) >= s.logFiles || left <= 0 {
+		return "", errLogQuota
+	}
+	left = min(left, maxLog)
+	name := strings.Trim(logName.ReplaceAllString(r.URL.Query().Get("name"), "_"), "._")
+	if name == "" {
+		name = "install"
+	}
+	name = filepath.Join(dir, time.Now().UTC().Format("20060102T150405")+"-"+name+".log")
+	f, err := os.Create(name)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(f, io.LimitReader(r.Body, left))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(name)
+		return "", err
+	}
+	return name, nil
+}
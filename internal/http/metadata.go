@@ -0,0 +1,157 @@
+package http
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/callus-corn/tao/internal/host"
+)
+
+type token struct {
+	ip     string
+	expire time.Time
+}
+
+const tokenHeader = "X-aws-ec2-metadata-token"
+const tokenTTLHeader = "X-aws-ec2-metadata-token-ttl-seconds"
+const tokenTTLMax = 21600
+
+var metadataPath = regexp.MustCompile(`^/(latest|\d{4}-\d{2}-\d{2})/(meta-data|user-data|api/token)(/.*)?$`)
+
+// serveMetadata emulates the EC2 instance metadata service. The caller is
+// identified by its source address only.
+func (s *Server) serveMetadata(w http.ResponseWriter, r *http.Request) bool {
+	m := metadataPath.FindStringSubmatch(r.URL.Path)
+	if m == nil {
+		return false
+	}
+	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+
+	if m[2] == "api/token" {
+		s.issueToken(w, r, ip)
+		return true
+	}
+	s.mu.RLock()
+	required := s.tokenRequired
+	s.mu.RUnlock()
+	if v := r.Header.Get(tokenHeader); v != "" || required {
+		if !s.validToken(v, ip) {
+			http.Error(w, "401 unauthorized", http.StatusUnauthorized)
+			return true
+		}
+	}
+
+	h, ok := s.hosts.ByIP(ip)
+	if !ok {
+		logger.Error("metadata host is not found", "module", "HTTP", "address", r.RemoteAddr)
+		http.NotFound(w, r)
+		return true
+	}
+
+	var out string
+	switch m[2] {
+	case "user-data":
+		b, err := s.userData(h, r.Host, s.installToken(h.MAC))
+		if err != nil {
+			logger.Error(err.Error(), "module", "HTTP")
+			http.Error(w, "500 internal server error", http.StatusInternalServerError)
+			return true
+		}
+		out = string(b)
+	case "meta-data":
+		if out, ok = metadata(h, strings.Trim(m[3], "/")); !ok {
+			http.NotFound(w, r)
+			return true
+		}
+	}
+	logger.Info("HTTP metadata "+r.URL.Path, "module", "HTTP", "mac", h.MAC, "instance-id", h.ID())
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(out))
+	return true
+}
+
+func metadata(h host.Host, key string) (string, bool) {
+	switch key {
+	case "":
+		return "hostname\ninstance-id\nlocal-hostname\nlocal-ipv4\nmac\npublic-keys/", true
+	case "instance-id":
+		return h.ID(), true
+	case "hostname", "local-hostname":
+		return h.Hostname, true
+	case "local-ipv4":
+		return h.IP, true
+	case "mac":
+		return h.MAC, true
+	case "public-keys":
+		keys := make([]string, len(h.SSHKeys))
+		for i := range h.SSHKeys {
+			keys[i] = strconv.Itoa(i) + "=key-" + strconv.Itoa(i)
+		}
+		return strings.Join(keys, "\n"), true
+	}
+
+	parts := strings.Split(key, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] != "public-keys" {
+		return "", false
+	}
+	i, err := strconv.Atoi(parts[1])
+	if err != nil || i < 0 || i >= len(h.SSHKeys) {
+		return "", false
+	}
+	if len(parts) == 2 || parts[2] == "" {
+		return "openssh-key", true
+	}
+	if parts[2] == "openssh-key" {
+		return h.SSHKeys[i], true
+	}
+	return "", false
+}
+
+// issueToken answers PUT /latest/api/token of IMDSv2.
+func (s *Server) issueToken(w http.ResponseWriter, r *http.Request, ip string) {
+	if r.Method != http.MethodPut {
+		w.Header().Set("Allow", http.MethodPut)
+		http.Error(w, "405 method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ttl, err := strconv.Atoi(r.Header.Get(tokenTTLHeader))
+	if err != nil || ttl < 1 || ttl > tokenTTLMax {
+		http.Error(w, "400 bad request", http.StatusBadRequest)
+		return
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		logger.Error(err.Error(), "module", "HTTP")
+		http.Error(w, "500 internal server error", http.StatusInternalServerError)
+		return
+	}
+	v := base64.RawURLEncoding.EncodeToString(b)
+
+	s.tokenMu.Lock()
+	now := time.Now()
+	for k, t := range s.tokens {
+		if now.After(t.expire) {
+			delete(s.tokens, k)
+		}
+	}
+	s.tokens[v] = token{ip: ip, expire: now.Add(time.Duration(ttl) * time.Second)}
+	s.tokenMu.Unlock()
+
+	w.Header().Set(tokenTTLHeader, strconv.Itoa(ttl))
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(v))
+}
+
+func (s *Server) validToken(v string, ip string) bool {
+	s.tokenMu.Lock()
+	defer s.tokenMu.Unlock()
+	t, ok := s.tokens[v]
+	return ok && t.ip == ip && time.Now().Before(t.expire)
+}
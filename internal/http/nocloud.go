@@ -0,0 +1,162 @@
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/callus-corn/tao/internal/host"
+)
+
+const noCloudPrefix = "/nocloud/"
+
+// serveNoCloud answers the files of the cloud-init NoCloud datasource.
+// Either /nocloud/<file> identifying the host like templates do, or
+// /nocloud/<mac>/<file> is accepted.
+func (s *Server) serveNoCloud(w http.ResponseWriter, r *http.Request) bool {
+	dir, file := path.Split(strings.TrimPrefix(path.Clean(r.URL.Path), noCloudPrefix))
+	switch file {
+	case "meta-data", "user-data", "vendor-data", "network-config":
+	default:
+		return false
+	}
+
+	var h host.Host
+	if mac := strings.TrimSuffix(dir, "/"); mac != "" {
+		var ok bool
+		if h, ok = s.hosts.Get(mac); !ok {
+			return false
+		}
+	} else {
+		h = s.lookup(r)
+	}
+	if h.MAC == "" {
+		logger.Error("NoCloud host is not found", "module", "HTTP", "address", r.RemoteAddr)
+		http.NotFound(w, r)
+		return true
+	}
+
+	var out []byte
+	var err error
+	switch file {
+	case "meta-data":
+		out = metaData(h)
+	case "user-data":
+		out, err = s.userData(h, r.Host, s.tokenFor(r, h))
+	case "vendor-data":
+		out, err = s.renderFile(s.serverDir()+noCloudPrefix+"vendor-data"+templateExt, h, r.Host, s.tokenFor(r, h))
+		if os.IsNotExist(err) {
+			out, err = nil, nil
+		}
+	case "network-config":
+		out = s.networkConfig(h)
+	}
+	if err != nil {
+		logger.Error(err.Error(), "module", "HTTP")
+		http.Error(w, "500 internal server error", http.StatusInternalServerError)
+		return true
+	}
+	logger.Info("HTTP NoCloud "+file, "module", "HTTP", "mac", h.MAC, "instance-id", h.ID())
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(out)
+	return true
+}
+
+func metaData(h host.Host) []byte {
+	var b bytes.Buffer
+	b.WriteString("instance-id: " + quote(h.ID()) + "\n")
+	if h.Hostname != "" {
+		b.WriteString("local-hostname: " + quote(h.Hostname) + "\n")
+	}
+	if len(h.SSHKeys) > 0 {
+		b.WriteString("public-keys:\n")
+		for _, key := range h.SSHKeys {
+			b.WriteString("  - " + quote(key) + "\n")
+		}
+	}
+	return b.Bytes()
+}
+
+// userData renders the template named by the host, or nocloud/user-data
+// under SrvDir. Without either, a cloud-config setting the hostname and
+// SSH keys is returned.
+func (s *Server) userData(h host.Host, server string, token string) ([]byte, error) {
+	dir := s.serverDir()
+	name := dir + noCloudPrefix + "user-data" + templateExt
+	if h.UserData != "" {
+		name = dir + "/" + path.Clean("/"+h.UserData)
+	}
+	out, err := s.renderFile(name, h, server, token)
+	if !os.IsNotExist(err) || h.UserData != "" {
+		return out, err
+	}
+
+	var b bytes.Buffer
+	b.WriteString("#cloud-config\n")
+	if h.Hostname != "" {
+		b.WriteString("hostname: " + quote(h.Hostname) + "\n")
+	}
+	if len(h.SSHKeys) > 0 {
+		b.WriteString("ssh_authorized_keys:\n")
+		for _, key := range h.SSHKeys {
+			b.WriteString("  - " + quote(key) + "\n")
+		}
+	}
+	return b.Bytes(), nil
+}
+
+// networkConfig builds a version 2 network configuration. Hosts with a
+// reserved address get it statically, the others use DHCP.
+func (s *Server) networkConfig(h host.Host) []byte {
+	var b bytes.Buffer
+	b.WriteString("version: 2\n")
+	b.WriteString("ethernets:\n")
+	b.WriteString("  id0:\n")
+	b.WriteString("    match:\n")
+	b.WriteString("      macaddress: " + quote(h.MAC) + "\n")
+	ip, ok := s.hosts.Reservation(h.MAC)
+	if !ok {
+		b.WriteString("    dhcp4: true\n")
+		return b.Bytes()
+	}
+
+	n := s.hosts.GetNetwork()
+	b.WriteString("    addresses:\n")
+	b.WriteString("      - " + quote(ip+"/"+strconv.Itoa(n.Prefix)) + "\n")
+	if n.Gateway != "" {
+		b.WriteString("    routes:\n")
+		b.WriteString("      - to: default\n")
+		b.WriteString("        via: " + quote(n.Gateway) + "\n")
+	}
+	if len(n.DNS) > 0 {
+		b.WriteString("    nameservers:\n")
+		b.WriteString("      addresses:\n")
+		for _, dns := range n.DNS {
+			b.WriteString("        - " + quote(dns) + "\n")
+		}
+	}
+	return b.Bytes()
+}
+
+func (s *Server) renderFile(name string, h host.Host, server string, token string) ([]byte, error) {
+	t, err := template.ParseFiles(name)
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	if err := t.Execute(&out, TemplateData{Host: h, Server: server, InstallToken: token}); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// quote returns s as a double-quoted scalar, which YAML reads like JSON.
+func quote(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
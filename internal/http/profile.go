@@ -0,0 +1,55 @@
+package http
+
+import (
+	"net/http"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/callus-corn/tao/internal/profile"
+)
+
+const profilePrefix = "/profile/"
+
+// serveProfile answers the boot configs generated from the boot profile of
+// the host at /profile/ipxe, /profile/grub and /profile/pxelinux, and its
+// answer file at /profile/answer. The host is identified like templates do.
+func (s *Server) serveProfile(w http.ResponseWriter, r *http.Request) bool {
+	format := strings.TrimPrefix(path.Clean(r.URL.Path), profilePrefix)
+	if format != "answer" && !slices.Contains(profile.Formats, format) {
+		return false
+	}
+	h := s.lookup(r)
+	name, p, ok := s.profiles.For(h)
+	if !ok {
+		logger.Error("boot profile of the host is not found", "module", "HTTP", "address", r.RemoteAddr, "mac", h.MAC)
+		http.NotFound(w, r)
+		return true
+	}
+
+	var b []byte
+	var err error
+	if format == "answer" {
+		if p.AnswerFile == "" {
+			http.NotFound(w, r)
+			return true
+		}
+		b, err = s.renderFile(filepath.Join(s.serverDir(), filepath.FromSlash(path.Clean("/"+p.AnswerFile))), h, r.Host, s.tokenFor(r, h))
+	} else {
+		scheme := "http://"
+		if r.TLS != nil {
+			scheme = "https://"
+		}
+		b, _, err = s.profiles.Render(format, h, scheme+r.Host)
+	}
+	if err != nil {
+		logger.Error(err.Error(), "module", "HTTP", "profile", name)
+		http.Error(w, "500 internal server error", http.StatusInternalServerError)
+		return true
+	}
+	logger.Info("HTTP boot profile "+format, "module", "HTTP", "mac", h.MAC, "profile", name)
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(b)
+	return true
+}
@@ -0,0 +1,82 @@
+package http
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/callus-corn/tao/internal/host"
+)
+
+// TemplateData is what the .tmpl files under SrvDir see: the requesting
+// host and the address of the server it has reached.
+type TemplateData struct {
+	host.Host
+	Server string
+	// InstallToken authenticates the installer callbacks of the host, such
+	// as /install/done?token={{.InstallToken}}. It is empty unless the host
+	// has been identified by the source address of the request.
+	InstallToken string
+}
+
+const templateExt = ".tmpl"
+
+func (s *Server) serveTemplate(w http.ResponseWriter, r *http.Request, name string) {
+	h := s.lookup(r)
+	out, err := s.renderFile(name, h, r.Host, s.tokenFor(r, h))
+	if err != nil {
+		logger.Error(err.Error(), "module", "HTTP")
+		http.Error(w, "500 internal server error", http.StatusInternalServerError)
+		return
+	}
+	logger.Info("HTTP render template", "module", "HTTP", "file", name, "mac", h.MAC, "ip", h.IP)
+	http.ServeContent(w, r, strings.TrimSuffix(name, templateExt), time.Time{}, bytes.NewReader(out))
+}
+
+// tokenFor returns the install token of h if h is the host at the source
+// address of r, so that the query parameters cannot get the token of
+// another host.
+func (s *Server) tokenFor(r *http.Request, h host.Host) string {
+	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+	src, ok := s.hosts.ByIP(ip)
+	if !ok || h.MAC == "" || src.MAC != h.MAC {
+		return ""
+	}
+	return s.installToken(h.MAC)
+}
+
+// lookup identifies the requesting host by the mac or ip query parameter,
+// or else by its source address. The other query parameters override what
+// is known about the host.
+func (s *Server) lookup(r *http.Request) host.Host {
+	q := r.URL.Query()
+	h, ok := host.Host{}, false
+	if mac := q.Get("mac"); mac != "" {
+		h, ok = s.hosts.Get(mac)
+		if !ok {
+			h.MAC, _ = host.NormalizeMAC(mac)
+		}
+	}
+	ip := q.Get("ip")
+	if ip == "" {
+		ip, _, _ = net.SplitHostPort(r.RemoteAddr)
+	}
+	if !q.Has("mac") {
+		if found, ok := s.hosts.ByIP(ip); ok {
+			h = found
+		}
+	}
+
+	if h.IP == "" || q.Has("ip") {
+		h.IP = ip
+	}
+	if v := q.Get("hostname"); v != "" {
+		h.Hostname = v
+	}
+	if v := q.Get("arch"); v != "" {
+		h.Arch = v
+	}
+	return h
+}
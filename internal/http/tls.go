@@ -0,0 +1,193 @@
+package http
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const caCertName = "ca.crt"
+const caKeyName = "ca.key"
+const serverCertName = "server.crt"
+const serverKeyName = "server.key"
+
+func tlsConfig(c HTTPConfig) (*tls.Config, error) {
+	certFile, keyFile, caFile := c.CertFile, c.KeyFile, c.ClientCAFile
+	if c.AutoCert {
+		if c.CertDir == "" {
+			return nil, errors.New("HTTP CertDir is required by AutoCert")
+		}
+		if certFile == "" && keyFile == "" {
+			certFile = filepath.Join(c.CertDir, serverCertName)
+			keyFile = filepath.Join(c.CertDir, serverKeyName)
+		}
+		if caFile == "" {
+			caFile = filepath.Join(c.CertDir, caCertName)
+		}
+		if err := autoCert(c.CertDir, certFile, keyFile); err != nil {
+			return nil, err
+		}
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	conf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	switch c.ClientAuth {
+	case "", "none":
+		return conf, nil
+	case "request":
+		conf.ClientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, errors.New("HTTP ClientAuth must be none, request or require")
+	}
+	if caFile == "" {
+		return nil, errors.New("HTTP ClientCAFile is required by ClientAuth")
+	}
+	ca, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	conf.ClientCAs = x509.NewCertPool()
+	if !conf.ClientCAs.AppendCertsFromPEM(ca) {
+		return nil, errors.New("no certificate is found in " + caFile)
+	}
+	return conf, nil
+}
+
+// autoCert creates a self-signed CA in dir, unless there is one, and signs a
+// server certificate for this host with it when certFile does not exist.
+func autoCert(dir string, certFile string, keyFile string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	caCert, caKey, err := loadCA(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		caCert, caKey, err = newCA(dir)
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(certFile); err == nil {
+		return nil
+	}
+	template, err := newTemplate("tao")
+	if err != nil {
+		return err
+	}
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	template.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+	template.NotAfter = template.NotBefore.AddDate(2, 0, 0)
+	template.DNSNames = []string{"localhost"}
+	if name, err := os.Hostname(); err == nil {
+		template.DNSNames = append(template.DNSNames, name)
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok {
+			template.IPAddresses = append(template.IPAddresses, ipnet.IP)
+		}
+	}
+	logger.Info("HTTP generate server certificate "+certFile, "module", "HTTP")
+	return issue(template, caCert, caKey, certFile, keyFile)
+}
+
+func loadCA(dir string) (*x509.Certificate, *rsa.PrivateKey, error) {
+	certPEM, err := os.ReadFile(filepath.Join(dir, caCertName))
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := os.ReadFile(filepath.Join(dir, caKeyName))
+	if err != nil {
+		return nil, nil, err
+	}
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	key, ok := pair.PrivateKey.(*rsa.PrivateKey)
+	if !ok {
+		return nil, nil, errors.New("CA key is not an RSA key")
+	}
+	return cert, key, nil
+}
+
+func newCA(dir string) (*x509.Certificate, *rsa.PrivateKey, error) {
+	template, err := newTemplate("tao CA")
+	if err != nil {
+		return nil, nil, err
+	}
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	template.NotAfter = template.NotBefore.AddDate(10, 0, 0)
+
+	logger.Info("HTTP generate CA certificate in "+dir, "module", "HTTP")
+	certFile := filepath.Join(dir, caCertName)
+	if err := issue(template, nil, nil, certFile, filepath.Join(dir, caKeyName)); err != nil {
+		return nil, nil, err
+	}
+	return loadCA(dir)
+}
+
+func newTemplate(name string) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+	}, nil
+}
+
+// issue signs template with the parent certificate, or by itself when
+// parent is nil, and writes the certificate and a new key as PEM files.
+func issue(template *x509.Certificate, parent *x509.Certificate, parentKey *rsa.PrivateKey, certFile string, keyFile string) error {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return err
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return err
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
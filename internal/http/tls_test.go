@@ -0,0 +1,98 @@
+package http
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTLS(t *testing.T) {
+	dir := t.TempDir()
+	s := newServer(dir)
+	if err := os.WriteFile(filepath.Join(dir, "vmlinuz"), []byte("kernel"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	certDir := filepath.Join(t.TempDir(), "tls")
+	c := HTTPConfig{TLSAddress: ":443", AutoCert: true, CertDir: certDir, ClientAuth: "require"}
+
+	conf, err := tlsConfig(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := os.ReadFile(filepath.Join(certDir, caCertName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tlsConfig(c); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := os.ReadFile(filepath.Join(certDir, caCertName)); !bytes.Equal(ca, again) {
+		t.Fatal("CA is generated again")
+	}
+
+	srv := httptest.NewUnstartedServer(s)
+	srv.TLS = conf
+	srv.StartTLS()
+	defer srv.Close()
+
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	if _, err := client.Get(srv.URL + "/vmlinuz"); err == nil {
+		t.Fatal("client without certificate is accepted")
+	}
+
+	caCert, caKey, err := loadCA(certDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template, err := newTemplate("node1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.NotAfter = template.NotBefore.AddDate(0, 0, 1)
+	certFile, keyFile := filepath.Join(certDir, "client.crt"), filepath.Join(certDir, "client.key")
+	if err := issue(template, caCert, caKey, certFile, keyFile); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Transport.(*http.Transport).TLSClientConfig.Certificates = []tls.Certificate{cert}
+
+	res, err := client.Get(srv.URL + "/vmlinuz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	got, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != 200 || string(got) != "kernel" {
+		t.Fatalf("got %d %q", res.StatusCode, got)
+	}
+}
+
+func TestTLSConfigError(t *testing.T) {
+	dir := t.TempDir()
+	tests := []HTTPConfig{
+		{TLSAddress: ":443", AutoCert: true},
+		{TLSAddress: ":443", CertFile: filepath.Join(dir, "missing.crt"), KeyFile: filepath.Join(dir, "missing.key")},
+		{TLSAddress: ":443", AutoCert: true, CertDir: dir, ClientAuth: "always"},
+	}
+	for _, c := range tests {
+		if _, err := tlsConfig(c); err == nil {
+			t.Fatalf("invalid config is accepted: %+v", c)
+		}
+	}
+}
@@ -0,0 +1,340 @@
+// Package inventory follows the machines booted by tao through their
+// provisioning, from the first DHCPDISCOVER to the installer reporting
+// the end.
+package inventory
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/callus-corn/tao/internal/event"
+	"github.com/callus-corn/tao/internal/host"
+)
+
+// State is where a machine is in its provisioning.
+type State string
+
+const (
+	// Discovered is a machine seen through DHCP and not booted yet.
+	Discovered State = "discovered"
+	// Ready is a machine an operator has approved for provisioning.
+	Ready State = "ready"
+	// Provisioning is a machine which has fetched its boot file or its
+	// answer file.
+	Provisioning State = "provisioning"
+	// Installed is a machine whose installer has reported success.
+	Installed State = "installed"
+	// Failed is a machine whose installer has reported a failure.
+	Failed State = "failed"
+)
+
+// Machine is a host followed through its provisioning.
+type Machine struct {
+	MAC   string `json:"MAC"`
+	State State  `json:"State"`
+	// Labels are the labels of the host, filled when the machine is read.
+	Labels     map[string]string `json:"Labels"`
+	Discovered time.Time         `json:"Discovered"`
+	Updated    time.Time         `json:"Updated"`
+	// History is the latest transitions from the oldest.
+	History []Transition `json:"History"`
+	// Reports are the latest reports of the installer from the oldest.
+	Reports []Report `json:"Reports"`
+}
+
+// Transition is a change of the state of a machine.
+type Transition struct {
+	From State `json:"From"`
+	To   State `json:"To"`
+	// Reason is the type of the event, "operator" or "rearm".
+	Reason string    `json:"Reason"`
+	Time   time.Time `json:"Time"`
+}
+
+// Report is what the installer of a machine has reported.
+type Report struct {
+	Type    event.Type `json:"Type"`
+	Message string     `json:"Message"`
+	// File is where an uploaded log is saved.
+	File string    `json:"File"`
+	Time time.Time `json:"Time"`
+}
+
+// Inventory keeps the state of each machine. The zero value is not ready
+// to use; call New.
+type Inventory struct {
+	mu       sync.RWMutex
+	machines map[string]*Machine
+	// hosts has the labels and the NetbootOnce flags of the machines.
+	hosts *host.Registry
+
+	hooksMu sync.Mutex
+	hooks   []func()
+}
+
+var errNotFound = errors.New("machine is not found")
+
+// maxHistory is how many transitions and reports a machine keeps.
+const maxHistory = 32
+
+var logger = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+// New returns an empty inventory of the hosts of hosts.
+func New(hosts *host.Registry) *Inventory {
+	return &Inventory{machines: make(map[string]*Machine), hosts: hosts}
+}
+
+// ParseState returns the state named s.
+func ParseState(s string) (State, error) {
+	switch st := State(s); st {
+	case Discovered, Ready, Provisioning, Installed, Failed:
+		return st, nil
+	}
+	return "", errors.New("unknown state " + s + ", must be discovered, ready, provisioning, installed or failed")
+}
+
+// Handle moves the machine of e to the state e leads to. It is meant to be
+// added to the servers with OnEvent.
+func (inv *Inventory) Handle(e event.Event) {
+	mac, err := host.NormalizeMAC(e.MAC)
+	if err != nil {
+		return
+	}
+	if e.Type == event.TFTPTransfer && inv.LocalBoot(mac) {
+		// The host is fetching its local-boot target.
+		return
+	}
+	var report *Report
+	switch e.Type {
+	case event.InstallProgress, event.InstallLog, event.InstallDone, event.InstallFailed:
+		report = &Report{Type: e.Type, Message: e.Message, Time: e.Time}
+		if e.Type == event.InstallLog {
+			report.File = e.File
+		}
+	}
+	inv.change(mac, string(e.Type), e.Time, report, func(cur State) (State, bool) {
+		return next(cur, e.Type)
+	})
+}
+
+// next returns the state an event leads to from cur, where cur is empty
+// for a machine never seen.
+func next(cur State, t event.Type) (State, bool) {
+	switch t {
+	case event.DHCPDiscover:
+		return Discovered, cur == ""
+	case event.TFTPTransfer:
+		// Booting from the network again reinstalls the machine.
+		return Provisioning, cur != Provisioning
+	case event.HTTPRequest:
+		// Metadata is also fetched on each boot of an installed machine.
+		return Provisioning, cur == "" || cur == Discovered || cur == Ready
+	case event.InstallProgress:
+		return Provisioning, cur != Provisioning
+	case event.InstallLog:
+		// Logs are also uploaded after the installer reports the end.
+		return Provisioning, cur == ""
+	case event.InstallDone:
+		return Installed, cur != Installed
+	case event.InstallFailed:
+		return Failed, cur != Failed
+	}
+	return cur, false
+}
+
+// Set moves the machine of mac to state whatever its current state is, as
+// an operator does to approve or to retry a machine.
+func (inv *Inventory) Set(mac string, state State) (Machine, error) {
+	mac, err := host.NormalizeMAC(mac)
+	if err != nil {
+		return Machine{}, err
+	}
+	if _, err := ParseState(string(state)); err != nil {
+		return Machine{}, err
+	}
+	inv.change(mac, "operator", time.Now(), nil, func(cur State) (State, bool) {
+		return state, cur != state
+	})
+	m, _ := inv.Get(mac)
+	return m, nil
+}
+
+// LocalBoot reports whether the host of mac boots from its local disk,
+// which is when it netboots once and is installed.
+func (inv *Inventory) LocalBoot(mac string) bool {
+	h, ok := inv.hosts.Get(mac)
+	if !ok || !h.NetbootOnce {
+		return false
+	}
+	m, ok := inv.Get(mac)
+	return ok && m.State == Installed
+}
+
+// Rearm makes the machine of mac boot from the network again to be
+// reinstalled.
+func (inv *Inventory) Rearm(mac string) (Machine, error) {
+	if _, ok := inv.Get(mac); !ok {
+		return Machine{}, errNotFound
+	}
+	mac, _ = host.NormalizeMAC(mac)
+	inv.change(mac, "rearm", time.Now(), nil, func(cur State) (State, bool) {
+		return Ready, cur != Ready
+	})
+	m, _ := inv.Get(mac)
+	return m, nil
+}
+
+// change moves the machine of mac to the state to returns and adds report
+// unless it is nil.
+func (inv *Inventory) change(mac string, reason string, t time.Time, report *Report, to func(cur State) (State, bool)) {
+	if t.IsZero() {
+		t = time.Now()
+	}
+	if report != nil && report.Time.IsZero() {
+		report.Time = t
+	}
+	from, m, ok := inv.transit(mac, reason, t, report, to)
+	if !ok {
+		return
+	}
+	if from != m.State {
+		logger.Info("machine is "+string(m.State), "module", "INVENTORY", "mac", mac, "reason", reason)
+	}
+	inv.changed()
+}
+
+func (inv *Inventory) transit(mac string, reason string, t time.Time, report *Report, to func(cur State) (State, bool)) (State, Machine, bool) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	m, ok := inv.machines[mac]
+	var cur State
+	if ok {
+		cur = m.State
+	}
+	state, change := to(cur)
+	if !change && (report == nil || !ok) {
+		return cur, Machine{}, false
+	}
+	if !ok {
+		m = &Machine{MAC: mac, Discovered: t}
+		inv.machines[mac] = m
+	}
+	if change {
+		m.State = state
+		m.Updated = t
+		m.History = append(m.History, Transition{From: cur, To: state, Reason: reason, Time: t})
+		if len(m.History) > maxHistory {
+			m.History = slices.Clone(m.History[len(m.History)-maxHistory:])
+		}
+	}
+	if report != nil {
+		m.Reports = append(m.Reports, *report)
+		if len(m.Reports) > maxHistory {
+			m.Reports = slices.Clone(m.Reports[len(m.Reports)-maxHistory:])
+		}
+	}
+	return cur, m.clone(), true
+}
+
+// Get returns a copy of the machine of mac.
+func (inv *Inventory) Get(mac string) (Machine, bool) {
+	mac, err := host.NormalizeMAC(mac)
+	if err != nil {
+		return Machine{}, false
+	}
+	inv.mu.RLock()
+	m, ok := inv.machines[mac]
+	inv.mu.RUnlock()
+	if !ok {
+		return Machine{}, false
+	}
+	return inv.labeled(m.clone()), true
+}
+
+// Machines returns every machine sorted by MAC address.
+func (inv *Inventory) Machines() []Machine {
+	inv.mu.RLock()
+	machines := make([]Machine, 0, len(inv.machines))
+	for _, m := range inv.machines {
+		machines = append(machines, m.clone())
+	}
+	inv.mu.RUnlock()
+	slices.SortFunc(machines, func(a, b Machine) int { return strings.Compare(a.MAC, b.MAC) })
+	for i := range machines {
+		machines[i] = inv.labeled(machines[i])
+	}
+	return machines
+}
+
+// Delete forgets the machine of mac, which is discovered again on its next
+// DHCPDISCOVER.
+func (inv *Inventory) Delete(mac string) bool {
+	mac, err := host.NormalizeMAC(mac)
+	if err != nil {
+		return false
+	}
+	inv.mu.Lock()
+	_, ok := inv.machines[mac]
+	delete(inv.machines, mac)
+	inv.mu.Unlock()
+	if ok {
+		inv.changed()
+	}
+	return ok
+}
+
+// Restore adds machines which are not known, such as the ones kept by a
+// store.
+func (inv *Inventory) Restore(machines []Machine) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	for _, m := range machines {
+		mac, err := host.NormalizeMAC(m.MAC)
+		if err != nil {
+			continue
+		}
+		if _, ok := inv.machines[mac]; ok {
+			continue
+		}
+		m.MAC = mac
+		m.Labels = nil
+		m = m.clone()
+		inv.machines[mac] = &m
+	}
+}
+
+// OnChange adds fn to the functions called after a machine changes its
+// state or is deleted.
+func (inv *Inventory) OnChange(fn func()) {
+	inv.hooksMu.Lock()
+	defer inv.hooksMu.Unlock()
+	inv.hooks = append(inv.hooks, fn)
+}
+
+func (inv *Inventory) changed() {
+	inv.hooksMu.Lock()
+	hooks := slices.Clone(inv.hooks)
+	inv.hooksMu.Unlock()
+	for _, fn := range hooks {
+		fn()
+	}
+}
+
+func (m *Machine) clone() Machine {
+	c := *m
+	c.History = slices.Clone(m.History)
+	c.Reports = slices.Clone(m.Reports)
+	return c
+}
+
+func (inv *Inventory) labeled(m Machine) Machine {
+	if h, ok := inv.hosts.Get(m.MAC); ok {
+		m.Labels = h.Labels
+	}
+	return m
+}
@@ -0,0 +1,135 @@
+package inventory
+
+import (
+	"testing"
+
+	"github.com/callus-corn/tao/internal/event"
+	"github.com/callus-corn/tao/internal/host"
+)
+
+func TestHandle(t *testing.T) {
+	inv := New(host.NewRegistry())
+	changes := 0
+	inv.OnChange(func() { changes++ })
+
+	mac := "aa:bb:cc:dd:ee:01"
+	tests := []struct {
+		event event.Type
+		state State
+	}{
+		{event.HTTPRequest, Provisioning},
+		{event.InstallFailed, Failed},
+		{event.DHCPDiscover, Failed},
+		{event.TFTPTransfer, Provisioning},
+		{event.TFTPTransfer, Provisioning},
+		{event.InstallDone, Installed},
+		{event.DHCPAck, Installed},
+		{event.HTTPRequest, Installed},
+		{event.TFTPTransfer, Provisioning},
+	}
+	for i, tt := range tests {
+		inv.Handle(event.Event{Type: tt.event, MAC: "AA-BB-CC-DD-EE-01"})
+		m, ok := inv.Get(mac)
+		if !ok || m.State != tt.state {
+			t.Fatalf("%d %s: got %+v", i, tt.event, m)
+		}
+	}
+	m, _ := inv.Get(mac)
+	if changes != 5 || len(m.History) != 5 || m.History[0].From != "" || m.History[4].Reason != string(event.TFTPTransfer) {
+		t.Fatalf("got %d changes, %+v", changes, m.History)
+	}
+
+	inv.Handle(event.Event{Type: event.DHCPDiscover, MAC: "aa:bb:cc:dd:ee:02"})
+	if m, ok := inv.Get("aa:bb:cc:dd:ee:02"); !ok || m.State != Discovered || m.Discovered.IsZero() {
+		t.Fatalf("got %+v", m)
+	}
+	inv.Handle(event.Event{Type: event.HTTPRequest})
+	if len(inv.Machines()) != 2 {
+		t.Fatalf("got %+v", inv.Machines())
+	}
+}
+
+func TestSet(t *testing.T) {
+	inv := New(host.NewRegistry())
+	if _, err := inv.Set("aa:bb:cc:dd:ee:01", "gone"); err == nil {
+		t.Fatal("unknown state is accepted")
+	}
+	m, err := inv.Set("aa:bb:cc:dd:ee:01", Ready)
+	if err != nil || m.State != Ready || m.History[0].Reason != "operator" {
+		t.Fatalf("got %+v %v", m, err)
+	}
+	inv.Handle(event.Event{Type: event.HTTPRequest, MAC: "aa:bb:cc:dd:ee:01"})
+	if m, _ := inv.Get("aa:bb:cc:dd:ee:01"); m.State != Provisioning {
+		t.Fatalf("got %+v", m)
+	}
+
+	for i := 0; i < maxHistory; i++ {
+		inv.Set("aa:bb:cc:dd:ee:01", Ready)
+		inv.Set("aa:bb:cc:dd:ee:01", Failed)
+	}
+	if m, _ := inv.Get("aa:bb:cc:dd:ee:01"); len(m.History) != maxHistory || m.History[maxHistory-1].To != Failed {
+		t.Fatalf("got %d transitions", len(m.History))
+	}
+
+	restored := New(host.NewRegistry())
+	restored.Restore(inv.Machines())
+	if m, ok := restored.Get("aa:bb:cc:dd:ee:01"); !ok || m.State != Failed {
+		t.Fatalf("got %+v", m)
+	}
+}
+
+func TestLocalBoot(t *testing.T) {
+	hosts := host.NewRegistry()
+	inv := New(hosts)
+	err := hosts.Set([]host.Host{{MAC: "aa:bb:cc:dd:ee:01", NetbootOnce: true}, {MAC: "aa:bb:cc:dd:ee:02"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mac := range []string{"aa:bb:cc:dd:ee:01", "aa:bb:cc:dd:ee:02"} {
+		inv.Handle(event.Event{Type: event.TFTPTransfer, MAC: mac})
+		if inv.LocalBoot(mac) {
+			t.Fatalf("%s boots locally while provisioning", mac)
+		}
+		inv.Handle(event.Event{Type: event.InstallDone, MAC: mac})
+	}
+	if !inv.LocalBoot("aa:bb:cc:dd:ee:01") || inv.LocalBoot("aa:bb:cc:dd:ee:02") {
+		t.Fatal("only the host netbooting once boots locally")
+	}
+
+	// Fetching the local-boot target does not reinstall the machine.
+	inv.Handle(event.Event{Type: event.TFTPTransfer, MAC: "aa:bb:cc:dd:ee:01"})
+	if m, _ := inv.Get("aa:bb:cc:dd:ee:01"); m.State != Installed {
+		t.Fatalf("got %+v", m)
+	}
+
+	m, err := inv.Rearm("aa:bb:cc:dd:ee:01")
+	if err != nil || m.State != Ready || m.History[len(m.History)-1].Reason != "rearm" || inv.LocalBoot("aa:bb:cc:dd:ee:01") {
+		t.Fatalf("got %+v %v", m, err)
+	}
+	if _, err := inv.Rearm("aa:bb:cc:dd:ee:09"); err == nil {
+		t.Fatal("unknown machine is re-armed")
+	}
+}
+
+func TestReports(t *testing.T) {
+	inv := New(host.NewRegistry())
+	changes := 0
+	inv.OnChange(func() { changes++ })
+	mac := "aa:bb:cc:dd:ee:01"
+
+	for _, e := range []event.Event{
+		{Type: event.InstallProgress, MAC: mac, Message: "step packages"},
+		{Type: event.InstallProgress, MAC: mac, Message: "step bootloader"},
+		{Type: event.InstallDone, MAC: mac},
+		{Type: event.InstallLog, MAC: mac, File: "/var/log/tao/aa-bb-cc-dd-ee-01/install.log"},
+	} {
+		inv.Handle(e)
+	}
+	m, _ := inv.Get(mac)
+	if m.State != Installed || len(m.History) != 2 || changes != 4 {
+		t.Fatalf("got %d changes, %+v", changes, m)
+	}
+	if len(m.Reports) != 4 || m.Reports[1].Message != "step bootloader" || m.Reports[3].File == "" || m.Reports[3].Time.IsZero() {
+		t.Fatalf("got %+v", m.Reports)
+	}
+}
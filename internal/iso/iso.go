@@ -0,0 +1,575 @@
+// Package iso reads ISO 9660 images without mounting them. The names of the
+// files are taken from the Rock Ridge or Joliet extensions when the image has
+// them, and the El Torito boot catalog is read.
+package iso
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+const sectorSize = 2048
+
+// maxDir limits the size of a directory read into memory.
+const maxDir = 16 << 20
+
+var errFormat = errors.New("not an ISO 9660 image")
+var errCorrupt = errors.New("corrupt ISO 9660 image")
+
+// Image is an ISO 9660 image. It implements fs.FS, fs.ReadDirFS and
+// fs.StatFS.
+type Image struct {
+	r         io.ReaderAt
+	blockSize int64
+	root      *entry
+	rockRidge bool
+	// skip is the number of bytes skipped at the start of the system use
+	// areas, given by the SP entry of Rock Ridge.
+	skip   int
+	joliet bool
+	boot   []BootEntry
+}
+
+// BootEntry is an entry of the El Torito boot catalog.
+type BootEntry struct {
+	// Platform is "bios", "uefi", "powerpc" or "mac".
+	Platform string
+	Bootable bool
+	Offset   int64
+	// Size is the size the firmware loads, which may be less than the size
+	// of the boot image file.
+	Size int64
+}
+
+type extent struct {
+	offset int64
+	size   int64
+}
+
+type entry struct {
+	name    string
+	dir     bool
+	symlink bool
+	perm    fs.FileMode
+	size    int64
+	extents []extent
+	modTime time.Time
+}
+
+// Open reads the volume descriptors of the image r.
+func Open(r io.ReaderAt) (*Image, error) {
+	img := &Image{r: r}
+	var pvd, svd []byte
+	var catalog int64 = -1
+	for sector := int64(16); ; sector++ {
+		b := make([]byte, sectorSize)
+		if _, err := r.ReadAt(b, sector*sectorSize); err != nil {
+			return nil, errFormat
+		}
+		if string(b[1:6]) != "CD001" {
+			return nil, errFormat
+		}
+		switch b[0] {
+		case 0:
+			if strings.TrimRight(string(b[7:39]), "\x00") == "EL TORITO SPECIFICATION" {
+				catalog = int64(binary.LittleEndian.Uint32(b[71:75]))
+			}
+		case 1:
+			if pvd == nil {
+				pvd = b
+			}
+		case 2:
+			// Joliet is a supplementary volume with a UCS-2 escape sequence.
+			switch string(b[88:91]) {
+			case "%/@", "%/C", "%/E":
+				svd = b
+			}
+		}
+		if b[0] == 255 {
+			break
+		}
+	}
+	if pvd == nil {
+		return nil, errFormat
+	}
+	img.blockSize = int64(binary.LittleEndian.Uint16(pvd[128:130]))
+	if img.blockSize == 0 || sectorSize%img.blockSize != 0 {
+		return nil, errCorrupt
+	}
+
+	root, err := img.record(pvd[156:190])
+	if err != nil {
+		return nil, err
+	}
+	img.root = root
+	if err := img.detectRockRidge(); err != nil {
+		return nil, err
+	}
+	if !img.rockRidge && svd != nil {
+		root, err := img.record(svd[156:190])
+		if err != nil {
+			return nil, err
+		}
+		img.root, img.joliet = root, true
+	}
+	img.root.name = "."
+
+	if catalog >= 0 {
+		b := make([]byte, sectorSize)
+		if _, err := r.ReadAt(b, catalog*img.blockSize); err != nil {
+			return nil, err
+		}
+		img.boot, err = parseCatalog(b, img.blockSize)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return img, nil
+}
+
+// Boot returns the El Torito boot entries, none when the image is not
+// bootable from optical media.
+func (img *Image) Boot() []BootEntry {
+	return slices.Clone(img.boot)
+}
+
+// BootImage returns the data e loads.
+func (img *Image) BootImage(e BootEntry) *io.SectionReader {
+	return io.NewSectionReader(img.r, e.Offset, e.Size)
+}
+
+// detectRockRidge looks for the SP entry at the start of the system use area
+// of the "." record of the root directory.
+func (img *Image) detectRockRidge() error {
+	b := make([]byte, sectorSize)
+	if _, err := img.r.ReadAt(b, img.root.extents[0].offset); err != nil {
+		return err
+	}
+	n := int(b[0])
+	if n < 34 || n > len(b) {
+		return errCorrupt
+	}
+	su := systemUse(b[:n])
+	if len(su) >= 7 && string(su[:2]) == "SP" && su[4] == 0xBE && su[5] == 0xEF {
+		img.rockRidge, img.skip = true, int(su[6])
+	}
+	return nil
+}
+
+// record parses the directory record b without its name.
+func (img *Image) record(b []byte) (*entry, error) {
+	if len(b) < 34 {
+		return nil, errCorrupt
+	}
+	e := &entry{
+		dir:     b[25]&0x02 != 0,
+		size:    int64(binary.LittleEndian.Uint32(b[10:14])),
+		modTime: recordTime(b[18:25]),
+	}
+	e.extents = []extent{{offset: img.lba(b[2:6]) + int64(b[1])*img.blockSize, size: e.size}}
+	return e, nil
+}
+
+func (img *Image) lba(b []byte) int64 {
+	return int64(binary.LittleEndian.Uint32(b)) * img.blockSize
+}
+
+func recordTime(b []byte) time.Time {
+	if b[0] == 0 && b[1] == 0 {
+		return time.Time{}
+	}
+	zone := time.FixedZone("", int(int8(b[6]))*15*60)
+	return time.Date(1900+int(b[0]), time.Month(b[1]), int(b[2]), int(b[3]), int(b[4]), int(b[5]), 0, zone)
+}
+
+func systemUse(b []byte) []byte {
+	n := 33 + int(b[32])
+	if b[32]%2 == 0 {
+		n++
+	}
+	if n > len(b) {
+		return nil
+	}
+	return b[n:]
+}
+
+// readDir returns the entries of the directory d.
+func (img *Image) readDir(d *entry) ([]*entry, error) {
+	if d.size > maxDir {
+		return nil, errCorrupt
+	}
+	b := make([]byte, d.size)
+	if _, err := io.ReadFull(d.open(img.r), b); err != nil {
+		return nil, err
+	}
+
+	var entries []*entry
+	more := false
+	for off := 0; off < len(b); {
+		n := int(b[off])
+		if n == 0 {
+			// Records do not cross sectors and the rest is zero.
+			off = (off/sectorSize + 1) * sectorSize
+			continue
+		}
+		if n < 34 || off+n > len(b) || 33+int(b[off+32]) > n {
+			return nil, errCorrupt
+		}
+		rec := b[off : off+n]
+		off += n
+		id := rec[33 : 33+int(rec[32])]
+		if len(id) == 1 && (id[0] == 0 || id[0] == 1) {
+			continue
+		}
+
+		e, err := img.record(rec)
+		if err != nil {
+			return nil, err
+		}
+		// The extents of a file over 4 GiB are consecutive records.
+		if more && len(entries) > 0 {
+			last := entries[len(entries)-1]
+			last.extents = append(last.extents, e.extents...)
+			last.size += e.size
+			more = rec[25]&0x80 != 0
+			continue
+		}
+		more = rec[25]&0x80 != 0
+
+		switch {
+		case img.joliet:
+			e.name = jolietName(id)
+		case img.rockRidge:
+			ok, err := img.rockRidgeEntry(systemUse(rec), e)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+		}
+		if e.name == "" {
+			e.name = plainName(id, e.dir)
+		}
+		if e.name == "" || e.name == "." || e.name == ".." || strings.ContainsAny(e.name, "/\x00") {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	slices.SortFunc(entries, func(a, b *entry) int { return strings.Compare(a.name, b.name) })
+	return entries, nil
+}
+
+// rockRidgeEntry sets the name, the mode and the relocation of e from the
+// system use entries in su. It returns false for a relocated directory,
+// which is read through its child link instead.
+func (img *Image) rockRidgeEntry(su []byte, e *entry) (bool, error) {
+	if img.skip > len(su) {
+		return true, nil
+	}
+	su = su[img.skip:]
+	var name []byte
+	hasName := false
+	for areas := 0; areas < 16; areas++ {
+		var ce []byte
+	entries:
+		for len(su) >= 4 {
+			n := int(su[2])
+			if n < 4 || n > len(su) {
+				break
+			}
+			data := su[4:n]
+			switch string(su[:2]) {
+			case "NM":
+				// Flags other than CONTINUE name "." or "..".
+				if len(data) >= 1 && data[0]&^1 == 0 {
+					name = append(name, data[1:]...)
+					hasName = true
+				}
+			case "PX":
+				if len(data) >= 4 {
+					mode := binary.LittleEndian.Uint32(data)
+					e.perm = fs.FileMode(mode & 0777)
+					e.symlink = mode&0170000 == 0120000
+				}
+			case "CL":
+				if len(data) >= 4 {
+					d, err := img.relocated(img.lba(data))
+					if err != nil {
+						return false, err
+					}
+					e.dir, e.size, e.extents = true, d.size, d.extents
+				}
+			case "RE":
+				return false, nil
+			case "CE":
+				if len(data) >= 24 {
+					ce = data
+				}
+			case "ST":
+				break entries
+			}
+			su = su[n:]
+		}
+		if ce == nil {
+			break
+		}
+		size := int64(binary.LittleEndian.Uint32(ce[16:20]))
+		if size > sectorSize {
+			return false, errCorrupt
+		}
+		su = make([]byte, size)
+		offset := img.lba(ce[0:4]) + int64(binary.LittleEndian.Uint32(ce[8:12]))
+		if _, err := img.r.ReadAt(su, offset); err != nil {
+			return false, err
+		}
+	}
+	if hasName {
+		e.name = string(name)
+	}
+	return true, nil
+}
+
+// relocated returns the directory moved to offset by a child link, whose
+// size is in its "." record.
+func (img *Image) relocated(offset int64) (*entry, error) {
+	b := make([]byte, sectorSize)
+	if _, err := img.r.ReadAt(b, offset); err != nil {
+		return nil, err
+	}
+	if int(b[0]) < 34 || int(b[0]) > len(b) {
+		return nil, errCorrupt
+	}
+	return img.record(b[:b[0]])
+}
+
+// plainName returns the ISO 9660 name without the version, in lower case as
+// most installers expect.
+func plainName(id []byte, dir bool) string {
+	name := string(id)
+	if !dir {
+		name, _, _ = strings.Cut(name, ";")
+		name = strings.TrimSuffix(name, ".")
+	}
+	return strings.ToLower(name)
+}
+
+func jolietName(id []byte) string {
+	u := make([]uint16, len(id)/2)
+	for i := range u {
+		u[i] = binary.BigEndian.Uint16(id[2*i:])
+	}
+	name := string(utf16.Decode(u))
+	if i := strings.LastIndex(name, ";"); i >= 0 {
+		name = name[:i]
+	}
+	return name
+}
+
+func parseCatalog(b []byte, blockSize int64) ([]BootEntry, error) {
+	if b[0] != 1 || b[30] != 0x55 || b[31] != 0xAA {
+		return nil, errors.New("invalid El Torito boot catalog")
+	}
+	var sum uint16
+	for i := 0; i < 32; i += 2 {
+		sum += binary.LittleEndian.Uint16(b[i:])
+	}
+	if sum != 0 {
+		return nil, errors.New("invalid El Torito boot catalog checksum")
+	}
+
+	entries := []BootEntry{bootEntry(b[32:64], b[1], blockSize)}
+	for off := 64; off+32 <= len(b); {
+		header := b[off : off+32]
+		if header[0] != 0x90 && header[0] != 0x91 {
+			break
+		}
+		off += 32
+		for i := 0; i < int(binary.LittleEndian.Uint16(header[2:4])) && off+32 <= len(b); i++ {
+			entries = append(entries, bootEntry(b[off:off+32], header[1], blockSize))
+			off += 32
+			// Extension entries continue the section entry.
+			for off+32 <= len(b) && b[off] == 0x44 {
+				off += 32
+			}
+		}
+		if header[0] == 0x91 {
+			break
+		}
+	}
+	return entries, nil
+}
+
+func bootEntry(b []byte, platform byte, blockSize int64) BootEntry {
+	e := BootEntry{
+		Bootable: b[0] == 0x88,
+		Offset:   int64(binary.LittleEndian.Uint32(b[8:12])) * blockSize,
+		Size:     int64(binary.LittleEndian.Uint16(b[6:8])) * 512,
+	}
+	switch platform {
+	case 0:
+		e.Platform = "bios"
+	case 1:
+		e.Platform = "powerpc"
+	case 2:
+		e.Platform = "mac"
+	case 0xEF:
+		e.Platform = "uefi"
+	default:
+		e.Platform = "0x" + strconv.FormatUint(uint64(platform), 16)
+	}
+	return e
+}
+
+func (img *Image) lookup(op string, name string) (*entry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	e := img.root
+	if name == "." {
+		return e, nil
+	}
+	// A directory met again on the path is a loop, made by a child link or
+	// a record pointing to one of its ancestors.
+	path := []int64{e.extents[0].offset}
+	for _, elem := range strings.Split(name, "/") {
+		if !e.dir {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		entries, err := img.readDir(e)
+		if err != nil {
+			return nil, &fs.PathError{Op: op, Path: name, Err: err}
+		}
+		i, ok := slices.BinarySearchFunc(entries, elem, func(e *entry, name string) int { return strings.Compare(e.name, name) })
+		if !ok {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		e = entries[i]
+		if e.dir {
+			if slices.Contains(path, e.extents[0].offset) {
+				return nil, &fs.PathError{Op: op, Path: name, Err: errCorrupt}
+			}
+			path = append(path, e.extents[0].offset)
+		}
+	}
+	return e, nil
+}
+
+func (img *Image) Open(name string) (fs.File, error) {
+	e, err := img.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if !e.dir {
+		return &file{entry: e, r: e.open(img.r)}, nil
+	}
+	entries, err := img.readDir(e)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &dir{entry: e, entries: entries}, nil
+}
+
+func (img *Image) ReadDir(name string) ([]fs.DirEntry, error) {
+	e, err := img.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !e.dir {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	entries, err := img.readDir(e)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	des := make([]fs.DirEntry, len(entries))
+	for i, e := range entries {
+		des[i] = e
+	}
+	return des, nil
+}
+
+func (img *Image) Stat(name string) (fs.FileInfo, error) {
+	e, err := img.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *entry) open(r io.ReaderAt) io.Reader {
+	readers := make([]io.Reader, len(e.extents))
+	for i, x := range e.extents {
+		readers[i] = io.NewSectionReader(r, x.offset, x.size)
+	}
+	return io.MultiReader(readers...)
+}
+
+func (e *entry) Name() string               { return e.name }
+func (e *entry) Size() int64                { return e.size }
+func (e *entry) ModTime() time.Time         { return e.modTime }
+func (e *entry) IsDir() bool                { return e.dir }
+func (e *entry) Sys() any                   { return nil }
+func (e *entry) Type() fs.FileMode          { return e.Mode().Type() }
+func (e *entry) Info() (fs.FileInfo, error) { return e, nil }
+
+func (e *entry) Mode() fs.FileMode {
+	perm := e.perm
+	switch {
+	case e.dir:
+		if perm == 0 {
+			perm = 0555
+		}
+		return fs.ModeDir | perm
+	case e.symlink:
+		return fs.ModeSymlink | 0777
+	case perm == 0:
+		return 0444
+	}
+	return perm
+}
+
+type file struct {
+	*entry
+	r io.Reader
+}
+
+func (f *file) Stat() (fs.FileInfo, error) { return f.entry, nil }
+func (f *file) Read(b []byte) (int, error) { return f.r.Read(b) }
+func (f *file) Close() error               { return nil }
+
+type dir struct {
+	*entry
+	entries []*entry
+	offset  int
+}
+
+func (d *dir) Stat() (fs.FileInfo, error) { return d.entry, nil }
+func (d *dir) Close() error               { return nil }
+
+func (d *dir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+func (d *dir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.offset:]
+	if n > 0 && len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > 0 && n < len(rest) {
+		rest = rest[:n]
+	}
+	d.offset += len(rest)
+	des := make([]fs.DirEntry, len(rest))
+	for i, e := range rest {
+		des[i] = e
+	}
+	return des, nil
+}
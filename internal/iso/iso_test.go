@@ -0,0 +1,173 @@
+package iso
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/callus-corn/tao/internal/iso/isotest"
+)
+
+var rocky = map[string]string{
+	".treeinfo": "[header]\ntype = productmd.treeinfo\n\n[release]\nname = Rocky Linux\nshort = Rocky\nversion = 9.4\n\n" +
+		"[tree]\narch = x86_64\n\n[images-x86_64]\nefiboot.img = images/efiboot.img\n" +
+		"initrd = images/pxeboot/initrd.img\nkernel = images/pxeboot/vmlinuz\n",
+	"images/pxeboot/vmlinuz":                        "kernel",
+	"images/pxeboot/initrd.img":                     "initrd",
+	"images/efiboot.img":                            strings.Repeat("e", 3000),
+	"isolinux/isolinux.bin":                         "isolinux",
+	"BaseOS/Packages/b/bash-5.1.8-9.el9.x86_64.rpm": strings.Repeat("rpm", 1000),
+	"BaseOS/repodata/repomd.xml":                    "<repomd/>",
+}
+
+func TestOpen(t *testing.T) {
+	tests := []struct {
+		name  string
+		image isotest.Image
+		files []string
+	}{
+		{"rockridge", isotest.Image{Files: rocky, RockRidge: true}, []string{".treeinfo", "BaseOS/repodata/repomd.xml"}},
+		{"joliet", isotest.Image{Files: rocky, Joliet: true}, []string{".treeinfo", "BaseOS/repodata/repomd.xml"}},
+		{"plain", isotest.Image{Files: rocky}, []string{".treeinfo", "baseos/repodata/repomd.xml"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img, err := Open(bytes.NewReader(tt.image.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := fstest.TestFS(img, tt.files...); err != nil {
+				t.Fatal(err)
+			}
+			b, err := fs.ReadFile(img, tt.files[1])
+			if err != nil || string(b) != "<repomd/>" {
+				t.Fatalf("got %q %v", b, err)
+			}
+		})
+	}
+
+	if _, err := Open(bytes.NewReader(make([]byte, 40*sectorSize))); err != errFormat {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestBoot(t *testing.T) {
+	image := isotest.Image{Files: rocky, RockRidge: true, Boot: "isolinux/isolinux.bin", EFIBoot: "images/efiboot.img"}
+	img, err := Open(bytes.NewReader(image.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	boot := img.Boot()
+	if len(boot) != 2 || boot[0].Platform != "bios" || !boot[0].Bootable || boot[1].Platform != "uefi" || boot[1].Size != 3072 {
+		t.Fatalf("got %+v", boot)
+	}
+	b, err := io.ReadAll(img.BootImage(boot[1]))
+	if err != nil || !strings.HasPrefix(string(b), rocky["images/efiboot.img"]) {
+		t.Fatalf("got %d bytes %v", len(b), err)
+	}
+
+	img, _ = Open(bytes.NewReader(isotest.Image{Files: rocky}.Bytes()))
+	if len(img.Boot()) != 0 {
+		t.Fatalf("got %+v", img.Boot())
+	}
+}
+
+func TestDetect(t *testing.T) {
+	tests := []struct {
+		fsys  fstest.MapFS
+		wants Release
+	}{
+		{
+			fsys:  mapFS(rocky),
+			wants: Release{Name: "rocky-9.4-x86_64", Family: "redhat", Kernel: "images/pxeboot/vmlinuz", Initrd: "images/pxeboot/initrd.img"},
+		},
+		{
+			fsys: mapFS(map[string]string{
+				".treeinfo":                 "[general]\nfamily = CentOS Linux\nversion = 7\narch = x86_64\n\n[images-x86_64]\nkernel = images/pxeboot/vmlinuz\ninitrd = images/pxeboot/initrd.img\n",
+				"images/pxeboot/vmlinuz":    "kernel",
+				"images/pxeboot/initrd.img": "initrd",
+			}),
+			wants: Release{Name: "centos-7-x86_64", Family: "redhat", Kernel: "images/pxeboot/vmlinuz", Initrd: "images/pxeboot/initrd.img"},
+		},
+		{
+			fsys: mapFS(map[string]string{
+				".disk/info":     `Ubuntu-Server 24.04 LTS "Noble Numbat" - Release amd64 (20240423)`,
+				"casper/vmlinuz": "kernel",
+				"casper/initrd":  "initrd",
+			}),
+			wants: Release{Name: "ubuntu-24.04-amd64", Family: "ubuntu", Kernel: "casper/vmlinuz", Initrd: "casper/initrd"},
+		},
+	}
+	for _, tt := range tests {
+		r, err := Detect(tt.fsys)
+		if err != nil || r != tt.wants {
+			t.Fatalf("got %+v %v, wants %+v", r, err, tt.wants)
+		}
+	}
+
+	for _, files := range []map[string]string{
+		{".disk/info": "Debian GNU/Linux 12.5.0 \"Bookworm\" - Official amd64 NETINST"},
+		{".treeinfo": rocky[".treeinfo"]},
+	} {
+		if r, err := Detect(mapFS(files)); err == nil {
+			t.Fatalf("got %+v", r)
+		}
+	}
+}
+
+func TestExtract(t *testing.T) {
+	img, err := Open(bytes.NewReader(isotest.Image{Files: rocky, RockRidge: true}.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(t.TempDir(), "rocky")
+	if err := Extract(img, dir); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range rocky {
+		if b, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name))); err != nil || string(b) != content {
+			t.Fatalf("%s: got %d bytes %v", name, len(b), err)
+		}
+	}
+
+	dir = t.TempDir()
+	if err := Extract(img, dir, "images/pxeboot/vmlinuz"); err != nil {
+		t.Fatal(err)
+	}
+	entries, _ := os.ReadDir(dir)
+	if b, err := os.ReadFile(filepath.Join(dir, "images", "pxeboot", "vmlinuz")); err != nil || string(b) != "kernel" || len(entries) != 1 {
+		t.Fatalf("got %q %v %v", b, err, entries)
+	}
+}
+
+func TestLoop(t *testing.T) {
+	b := isotest.Image{Files: map[string]string{"a/b/f": "f"}, RockRidge: true}.Bytes()
+	// Point the record of b to the root directory.
+	root := b[16*sectorSize+156+2 : 16*sectorSize+156+10]
+	for off := 32; off < len(b)-1; off++ {
+		if rec := b[off-32:]; rec[32] == 1 && rec[33] == 'B' && rec[25]&0x02 != 0 {
+			copy(rec[2:], root)
+		}
+	}
+	img, err := Open(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Extract(img, t.TempDir()); !errors.Is(err, errCorrupt) {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func mapFS(files map[string]string) fstest.MapFS {
+	fsys := fstest.MapFS{}
+	for name, content := range files {
+		fsys[name] = &fstest.MapFile{Data: []byte(content)}
+	}
+	return fsys
+}
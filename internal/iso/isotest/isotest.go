@@ -0,0 +1,280 @@
+// Package isotest builds small ISO 9660 images for tests.
+package isotest
+
+import (
+	"encoding/binary"
+	"path"
+	"slices"
+	"strings"
+	"unicode/utf16"
+)
+
+const sector = 2048
+
+// Image describes an image to build.
+type Image struct {
+	// Files maps the paths of the files to their contents.
+	Files     map[string]string
+	RockRidge bool
+	Joliet    bool
+	// Boot and EFIBoot are the files loaded by El Torito on BIOS and UEFI.
+	Boot    string
+	EFIBoot string
+}
+
+type node struct {
+	name     string
+	data     string
+	dir      bool
+	parent   *node
+	children []*node
+	lba      int
+	size     int
+	jlba     int
+	jsize    int
+}
+
+// Bytes returns the image.
+func (img Image) Bytes() []byte {
+	root := &node{dir: true}
+	root.parent = root
+	nodes := map[string]*node{".": root}
+	var mkdir func(name string) *node
+	mkdir = func(name string) *node {
+		if n, ok := nodes[name]; ok {
+			return n
+		}
+		parent := mkdir(path.Dir(name))
+		n := &node{name: path.Base(name), dir: true, parent: parent}
+		parent.children = append(parent.children, n)
+		nodes[name] = n
+		return n
+	}
+	names := make([]string, 0, len(img.Files))
+	for name := range img.Files {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		parent := mkdir(path.Dir(name))
+		n := &node{name: path.Base(name), data: img.Files[name], parent: parent}
+		parent.children = append(parent.children, n)
+		nodes[name] = n
+	}
+	var dirs []*node
+	var walk func(n *node)
+	walk = func(n *node) {
+		slices.SortFunc(n.children, func(a, b *node) int { return strings.Compare(a.name, b.name) })
+		dirs = append(dirs, n)
+		for _, c := range n.children {
+			if c.dir {
+				walk(c)
+			}
+		}
+	}
+	walk(root)
+
+	boot := img.Boot != "" || img.EFIBoot != ""
+	next := 17
+	bootRecord, svd := 0, 0
+	if boot {
+		bootRecord = next
+		next++
+	}
+	if img.Joliet {
+		svd = next
+		next++
+	}
+	terminator := next
+	next++
+	catalog := 0
+	if boot {
+		catalog = next
+		next++
+	}
+	for _, d := range dirs {
+		d.lba, d.size = next, len(img.dirData(d, false))
+		next += (d.size + sector - 1) / sector
+	}
+	if img.Joliet {
+		for _, d := range dirs {
+			d.jlba, d.jsize = next, len(img.dirData(d, true))
+			next += (d.jsize + sector - 1) / sector
+		}
+	}
+	for _, name := range names {
+		n := nodes[name]
+		n.lba, n.size = next, len(n.data)
+		next += (n.size + sector - 1) / sector
+	}
+
+	b := make([]byte, next*sector)
+	volume := func(lba int, typ byte) []byte {
+		v := b[lba*sector : (lba+1)*sector]
+		v[0] = typ
+		copy(v[1:], "CD001")
+		v[6] = 1
+		return v
+	}
+	pvd := volume(16, 1)
+	copy(pvd[40:72], pad("TAO", 32))
+	both32(pvd[80:], next)
+	both16(pvd[120:], 1)
+	both16(pvd[124:], 1)
+	both16(pvd[128:], sector)
+	copy(pvd[156:], record([]byte{0}, root.lba, root.size, true, nil))
+	pvd[881] = 1
+	if img.Joliet {
+		v := volume(svd, 2)
+		copy(v[88:], "%/E")
+		both32(v[80:], next)
+		both16(v[128:], sector)
+		copy(v[156:], record([]byte{0}, root.jlba, root.jsize, true, nil))
+	}
+	if boot {
+		v := volume(bootRecord, 0)
+		copy(v[7:], "EL TORITO SPECIFICATION")
+		binary.LittleEndian.PutUint32(v[71:], uint32(catalog))
+		img.catalog(b[catalog*sector:], nodes)
+	}
+	volume(terminator, 255)
+
+	for _, d := range dirs {
+		copy(b[d.lba*sector:], img.dirData(d, false))
+		if img.Joliet {
+			copy(b[d.jlba*sector:], img.dirData(d, true))
+		}
+	}
+	for _, name := range names {
+		n := nodes[name]
+		copy(b[n.lba*sector:], n.data)
+	}
+	return b
+}
+
+func (img Image) catalog(b []byte, nodes map[string]*node) {
+	b[0] = 1
+	b[30], b[31] = 0x55, 0xAA
+	var sum uint16
+	for i := 0; i < 32; i += 2 {
+		sum += binary.LittleEndian.Uint16(b[i:])
+	}
+	binary.LittleEndian.PutUint16(b[28:], -sum)
+	entry := func(e []byte, name string) {
+		n := nodes[name]
+		e[0] = 0x88
+		binary.LittleEndian.PutUint16(e[6:], uint16((n.size+511)/512))
+		binary.LittleEndian.PutUint32(e[8:], uint32(n.lba))
+	}
+	if img.Boot != "" {
+		entry(b[32:64], img.Boot)
+	}
+	if img.EFIBoot != "" {
+		b[64], b[65] = 0x91, 0xEF
+		binary.LittleEndian.PutUint16(b[66:], 1)
+		entry(b[96:128], img.EFIBoot)
+	}
+}
+
+// dirData returns the records of the directory d, which do not cross
+// sectors.
+func (img Image) dirData(d *node, joliet bool) []byte {
+	lba := func(n *node) (int, int) {
+		if joliet {
+			return n.jlba, n.jsize
+		}
+		return n.lba, n.size
+	}
+	var self []byte
+	if img.RockRidge && !joliet && d.parent == d {
+		self = []byte{'S', 'P', 7, 1, 0xBE, 0xEF, 0}
+	}
+	l, s := lba(d)
+	recs := [][]byte{record([]byte{0}, l, s, true, self)}
+	l, s = lba(d.parent)
+	recs = append(recs, record([]byte{1}, l, s, true, nil))
+	for _, c := range d.children {
+		var id, su []byte
+		switch {
+		case joliet:
+			name := c.name
+			if !c.dir {
+				name += ";1"
+			}
+			for _, u := range utf16.Encode([]rune(name)) {
+				id = binary.BigEndian.AppendUint16(id, u)
+			}
+		default:
+			name := strings.ToUpper(c.name)
+			if !c.dir {
+				if !strings.Contains(name, ".") {
+					name += "."
+				}
+				name += ";1"
+			}
+			id = []byte(name)
+			if img.RockRidge {
+				su = append([]byte{'N', 'M', byte(5 + len(c.name)), 1, 0}, c.name...)
+				mode := 0100444
+				if c.dir {
+					mode = 040555
+				}
+				px := make([]byte, 36)
+				copy(px, "PX")
+				px[2], px[3] = 36, 1
+				both32(px[4:], mode)
+				both32(px[12:], 1)
+				su = append(su, px...)
+			}
+		}
+		if c.dir {
+			l, s = lba(c)
+		} else {
+			l, s = c.lba, c.size
+		}
+		recs = append(recs, record(id, l, s, c.dir, su))
+	}
+
+	var b []byte
+	for _, r := range recs {
+		if len(b)%sector+len(r) > sector {
+			b = append(b, make([]byte, sector-len(b)%sector)...)
+		}
+		b = append(b, r...)
+	}
+	return append(b, make([]byte, (sector-len(b)%sector)%sector)...)
+}
+
+func record(id []byte, lba int, size int, dir bool, su []byte) []byte {
+	n := 33 + len(id)
+	if len(id)%2 == 0 {
+		n++
+	}
+	r := make([]byte, n, n+len(su))
+	r = append(r, su...)
+	r[0] = byte(len(r))
+	both32(r[2:], lba)
+	both32(r[10:], size)
+	copy(r[18:], []byte{124, 1, 2, 3, 4, 5, 0})
+	if dir {
+		r[25] = 0x02
+	}
+	both16(r[28:], 1)
+	r[32] = byte(len(id))
+	copy(r[33:], id)
+	return r
+}
+
+func both16(b []byte, v int) {
+	binary.LittleEndian.PutUint16(b, uint16(v))
+	binary.BigEndian.PutUint16(b[2:], uint16(v))
+}
+
+func both32(b []byte, v int) {
+	binary.LittleEndian.PutUint32(b, uint32(v))
+	binary.BigEndian.PutUint32(b[4:], uint32(v))
+}
+
+func pad(s string, n int) string {
+	return s + strings.Repeat(" ", n-len(s))
+}
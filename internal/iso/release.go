@@ -0,0 +1,176 @@
+package iso
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Release is the OS of an installer image.
+type Release struct {
+	// Name is such as "rocky-9.4-x86_64" or "ubuntu-24.04-amd64".
+	Name string
+	// Family is "redhat" for the images with a .treeinfo, or "ubuntu".
+	Family string
+	// Kernel and Initrd are the paths of the netboot kernel and initrd.
+	Kernel string
+	Initrd string
+}
+
+// Detect finds the OS of the installer tree fsys.
+func Detect(fsys fs.FS) (Release, error) {
+	if b, err := fs.ReadFile(fsys, ".treeinfo"); err == nil {
+		return redhat(fsys, b)
+	}
+	if b, err := fs.ReadFile(fsys, ".disk/info"); err == nil && strings.HasPrefix(string(b), "Ubuntu") {
+		return ubuntu(fsys, b)
+	}
+	return Release{}, errors.New("unknown OS: no .treeinfo nor Ubuntu .disk/info")
+}
+
+// redhat reads the .treeinfo of Fedora, RHEL and their rebuilds, in the
+// productmd format or the older one with a [general] section.
+func redhat(fsys fs.FS, b []byte) (Release, error) {
+	ini := parseINI(b)
+	short := ini["release"]["short"]
+	version := ini["release"]["version"]
+	arch := ini["tree"]["arch"]
+	if short == "" {
+		short, _, _ = strings.Cut(ini["general"]["family"], " ")
+		version = ini["general"]["version"]
+		arch = ini["general"]["arch"]
+	}
+	images := ini["images-"+arch]
+	r := Release{
+		Name:   name(short, version, arch),
+		Family: "redhat",
+		Kernel: images["kernel"],
+		Initrd: images["initrd"],
+	}
+	if short == "" || version == "" || arch == "" {
+		return r, errors.New(".treeinfo has no release or arch")
+	}
+	return r, check(fsys, r)
+}
+
+// ubuntu reads .disk/info such as
+// `Ubuntu-Server 24.04 LTS "Noble Numbat" - Release amd64 (20240423)`.
+func ubuntu(fsys fs.FS, b []byte) (Release, error) {
+	fields := strings.Fields(string(b))
+	if len(fields) < 3 {
+		return Release{}, errors.New(".disk/info has no release")
+	}
+	arch := fields[len(fields)-1]
+	if strings.HasPrefix(arch, "(") {
+		arch = fields[len(fields)-2]
+	}
+	r := Release{
+		Name:   name("ubuntu", fields[1], arch),
+		Family: "ubuntu",
+		Kernel: "casper/vmlinuz",
+	}
+	for _, initrd := range []string{"casper/initrd", "casper/initrd.gz", "casper/initrd.lz"} {
+		if _, err := fs.Stat(fsys, initrd); err == nil {
+			r.Initrd = initrd
+			break
+		}
+	}
+	return r, check(fsys, r)
+}
+
+func name(parts ...string) string {
+	name := strings.ToLower(strings.Join(parts, "-"))
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '/' {
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+func check(fsys fs.FS, r Release) error {
+	for _, name := range []string{r.Kernel, r.Initrd} {
+		if name == "" {
+			return errors.New("kernel or initrd of " + r.Name + " is not found")
+		}
+		if _, err := fs.Stat(fsys, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseINI(b []byte) map[string]map[string]string {
+	ini := map[string]map[string]string{}
+	section := ""
+	scanner := bufio.NewScanner(strings.NewReader(string(b)))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || line[0] == '#' || line[0] == ';':
+		case line[0] == '[' && line[len(line)-1] == ']':
+			section = line[1 : len(line)-1]
+		default:
+			k, v, ok := strings.Cut(line, "=")
+			if !ok {
+				continue
+			}
+			if ini[section] == nil {
+				ini[section] = map[string]string{}
+			}
+			ini[section][strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+	return ini
+}
+
+// Extract copies the files of fsys into the directory dir, or only the files
+// names when they are given. Symbolic links are skipped.
+func Extract(fsys fs.FS, dir string, names ...string) error {
+	for _, name := range names {
+		dst := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+		if err := copyFile(fsys, name, dst); err != nil {
+			return err
+		}
+	}
+	if len(names) > 0 {
+		return nil
+	}
+	return fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(dir, filepath.FromSlash(name))
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(dst, 0755)
+		case !d.Type().IsRegular():
+			return nil
+		}
+		return copyFile(fsys, name, dst)
+	})
+}
+
+func copyFile(fsys fs.FS, name string, dst string) error {
+	src, err := fsys.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, src)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
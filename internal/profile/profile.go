@@ -0,0 +1,241 @@
+// Package profile generates the boot configs of the hosts from named boot
+// profiles, so that iPXE, GRUB and pxelinux menus need not be written by
+// hand. A Registry is shared by the servers like the host registry.
+package profile
+
+import (
+	"bytes"
+	"errors"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/callus-corn/tao/internal/config"
+	"github.com/callus-corn/tao/internal/host"
+)
+
+// BootConfig declares the boot profiles and which hosts boot them.
+type BootConfig struct {
+	// URL is the base URL of the HTTP server used in the generated configs.
+	// The address a request arrives at is used when it is empty.
+	URL      string             `json:"URL"`
+	Profiles map[string]Profile `json:"Profiles"`
+	// Classes assign a profile to the hosts without one. The first class
+	// whose labels the host has is used.
+	Classes []Class `json:"Classes"`
+}
+
+// Profile is an OS image to boot. Paths are relative to SrvDir.
+type Profile struct {
+	Kernel string `json:"Kernel"`
+	Initrd string `json:"Initrd"`
+	// Cmdline is a template of the kernel command line, which sees the
+	// fields of Data.
+	Cmdline string `json:"Cmdline"`
+	// AnswerFile is a template of the kickstart, preseed or autoinstall
+	// file served over HTTP at /profile/answer.
+	AnswerFile string `json:"AnswerFile"`
+}
+
+// Class assigns Profile to the hosts having all of Labels.
+type Class struct {
+	Labels  map[string]string `json:"Labels"`
+	Profile string            `json:"Profile"`
+}
+
+// Data is what the command line template sees.
+type Data struct {
+	host.Host
+	Profile string
+	URL     string
+}
+
+// Formats are the boot configs which can be generated.
+var Formats = []string{"ipxe", "grub", "pxelinux"}
+
+type profile struct {
+	Profile
+	name    string
+	cmdline *template.Template
+}
+
+// Registry is the set of boot profiles in use by the servers sharing it.
+type Registry struct {
+	mu       sync.RWMutex
+	boot     BootConfig
+	profiles map[string]*profile
+}
+
+// NewRegistry returns a registry without any profile.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Validate checks c without changing the profiles in use. Errors name the
+// field.
+func (c BootConfig) Validate() error {
+	_, err := parse(c)
+	return err
+}
+
+// Set replaces the profiles in use with the ones of c.
+func (r *Registry) Set(c BootConfig) error {
+	next, err := parse(c)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.boot = c
+	r.profiles = next
+	return nil
+}
+
+func parse(c BootConfig) (map[string]*profile, error) {
+	var errs []error
+	if c.URL != "" && !strings.HasPrefix(c.URL, "http://") && !strings.HasPrefix(c.URL, "https://") {
+		errs = append(errs, config.Errorf("URL", "must start with http:// or https://"))
+	}
+	next := make(map[string]*profile, len(c.Profiles))
+	names := make([]string, 0, len(c.Profiles))
+	for name := range c.Profiles {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		p := c.Profiles[name]
+		field := "Profiles[" + strconv.Quote(name) + "]"
+		if name == "" || strings.ContainsAny(name, " /") {
+			errs = append(errs, config.Errorf(field, "invalid profile name"))
+			continue
+		}
+		if p.Kernel == "" {
+			errs = append(errs, config.Errorf(field+".Kernel", "kernel is required"))
+			continue
+		}
+		t, err := template.New(name).Parse(p.Cmdline)
+		if err != nil {
+			errs = append(errs, config.Errorf(field+".Cmdline", "%w", err))
+			continue
+		}
+		next[name] = &profile{Profile: p, name: name, cmdline: t}
+	}
+	for i, class := range c.Classes {
+		if _, ok := c.Profiles[class.Profile]; !ok {
+			errs = append(errs, config.Errorf("Classes["+strconv.Itoa(i)+"].Profile", "unknown profile %q", class.Profile))
+		}
+	}
+	return next, errors.Join(errs...)
+}
+
+// Exists reports whether name is a profile in use.
+func (r *Registry) Exists(name string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, ok := r.profiles[name]
+	return ok
+}
+
+// For returns the profile of h, which is h.Profile or the one of the first
+// class matching its labels.
+func (r *Registry) For(h host.Host) (string, Profile, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	p, ok := r.lookup(h)
+	if !ok {
+		return "", Profile{}, false
+	}
+	return p.name, p.Profile, true
+}
+
+// lookup returns the profile of h. The caller holds r.mu.
+func (r *Registry) lookup(h host.Host) (*profile, bool) {
+	if h.Profile != "" {
+		p, ok := r.profiles[h.Profile]
+		return p, ok
+	}
+	for _, class := range r.boot.Classes {
+		if len(class.Labels) > 0 && matches(h.Labels, class.Labels) {
+			p, ok := r.profiles[class.Profile]
+			return p, ok
+		}
+	}
+	return nil, false
+}
+
+func matches(labels map[string]string, want map[string]string) bool {
+	for k, v := range want {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Render generates the boot config of format for h. url is the base URL of
+// the HTTP server the request has arrived at, replaced by URL of the config
+// when it is set. It returns false when h has no profile.
+func (r *Registry) Render(format string, h host.Host, url string) ([]byte, bool, error) {
+	r.mu.RLock()
+	p, ok := r.lookup(h)
+	if r.boot.URL != "" {
+		url = r.boot.URL
+	}
+	r.mu.RUnlock()
+	if !ok {
+		return nil, false, nil
+	}
+
+	var cmdline bytes.Buffer
+	data := Data{Host: h, Profile: p.name, URL: strings.TrimSuffix(url, "/")}
+	if err := p.cmdline.Execute(&cmdline, data); err != nil {
+		return nil, true, err
+	}
+	args := strings.TrimSpace(cmdline.String())
+	kernel, initrd := "/"+clean(p.Kernel), ""
+	if p.Initrd != "" {
+		initrd = "/" + clean(p.Initrd)
+	}
+
+	var b bytes.Buffer
+	switch format {
+	case "ipxe":
+		b.WriteString("#!ipxe\n")
+		if initrd != "" {
+			args = strings.TrimSpace("initrd=" + path.Base(initrd) + " " + args)
+		}
+		b.WriteString(strings.TrimSpace("kernel "+data.URL+kernel+" "+args) + "\n")
+		if initrd != "" {
+			b.WriteString("initrd " + data.URL + initrd + "\n")
+		}
+		b.WriteString("boot\n")
+	case "grub":
+		b.WriteString("set default=0\nset timeout=0\n")
+		b.WriteString("menuentry " + strconv.Quote(p.name) + " {\n")
+		b.WriteString(strings.TrimRight("    linux "+kernel+" "+args, " ") + "\n")
+		if initrd != "" {
+			b.WriteString("    initrd " + initrd + "\n")
+		}
+		b.WriteString("}\n")
+	case "pxelinux":
+		b.WriteString("DEFAULT " + p.name + "\n")
+		b.WriteString("LABEL " + p.name + "\n")
+		b.WriteString("    KERNEL " + kernel + "\n")
+		if initrd != "" {
+			args = strings.TrimSpace("initrd=" + initrd + " " + args)
+		}
+		if args != "" {
+			b.WriteString("    APPEND " + args + "\n")
+		}
+	default:
+		return nil, true, errors.New("unknown boot config format " + format)
+	}
+	return b.Bytes(), true, nil
+}
+
+func clean(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
@@ -0,0 +1,108 @@
+package profile
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/callus-corn/tao/internal/host"
+)
+
+func testConfig() BootConfig {
+	return BootConfig{
+		Profiles: map[string]Profile{
+			"rocky-9": {
+				Kernel:  "rocky/vmlinuz",
+				Initrd:  "rocky/initrd.img",
+				Cmdline: "inst.ks={{.URL}}/profile/answer?mac={{.MAC}} hostname={{.Hostname}}",
+			},
+			"memtest": {Kernel: "/memtest/memtest.efi"},
+		},
+		Classes: []Class{
+			{Labels: map[string]string{"role": "test"}, Profile: "memtest"},
+			{Labels: map[string]string{"role": "db"}, Profile: "rocky-9"},
+		},
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := testConfig().Validate(); err != nil {
+		t.Fatal(err)
+	}
+	c := testConfig()
+	c.URL = "10.0.0.1"
+	c.Profiles["bad name"] = Profile{Kernel: "vmlinuz"}
+	c.Profiles["nokernel"] = Profile{}
+	c.Profiles["badcmdline"] = Profile{Kernel: "vmlinuz", Cmdline: "{{.MAC"}
+	c.Classes = append(c.Classes, Class{Profile: "missing"})
+	err := c.Validate()
+	for _, want := range []string{
+		"URL: ",
+		`Profiles["bad name"]: invalid profile name`,
+		`Profiles["nokernel"].Kernel: kernel is required`,
+		`Profiles["badcmdline"].Cmdline: `,
+		`Classes[2].Profile: unknown profile "missing"`,
+	} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q is not in %v", want, err)
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	r := NewRegistry()
+	if err := r.Set(testConfig()); err != nil {
+		t.Fatal(err)
+	}
+	db := host.Host{MAC: "aa:bb:cc:dd:ee:01", Hostname: "db1", Labels: map[string]string{"role": "db"}}
+
+	tests := []struct {
+		format string
+		h      host.Host
+		wants  string
+	}{
+		{
+			format: "ipxe",
+			h:      db,
+			wants: "#!ipxe\n" +
+				"kernel http://10.0.0.1/rocky/vmlinuz initrd=initrd.img inst.ks=http://10.0.0.1/profile/answer?mac=aa:bb:cc:dd:ee:01 hostname=db1\n" +
+				"initrd http://10.0.0.1/rocky/initrd.img\nboot\n",
+		},
+		{
+			format: "grub",
+			h:      db,
+			wants: "set default=0\nset timeout=0\nmenuentry \"rocky-9\" {\n" +
+				"    linux /rocky/vmlinuz inst.ks=http://10.0.0.1/profile/answer?mac=aa:bb:cc:dd:ee:01 hostname=db1\n" +
+				"    initrd /rocky/initrd.img\n}\n",
+		},
+		{
+			format: "pxelinux",
+			h:      host.Host{MAC: "aa:bb:cc:dd:ee:02", Profile: "memtest", Labels: map[string]string{"role": "db"}},
+			wants:  "DEFAULT memtest\nLABEL memtest\n    KERNEL /memtest/memtest.efi\n",
+		},
+	}
+	for _, tt := range tests {
+		b, ok, err := r.Render(tt.format, tt.h, "http://10.0.0.1/")
+		if err != nil || !ok || string(b) != tt.wants {
+			t.Fatalf("Fail at %s: got %v %v %q", tt.format, ok, err, b)
+		}
+	}
+
+	if _, ok, _ := r.Render("ipxe", host.Host{MAC: "aa:bb:cc:dd:ee:03"}, ""); ok {
+		t.Fatal("host without profile is rendered")
+	}
+	if _, ok, err := r.Render("menu", db, ""); !ok || err == nil {
+		t.Fatal("unknown format is rendered")
+	}
+
+	c := testConfig()
+	c.URL = "https://boot.example.com"
+	if err := r.Set(c); err != nil {
+		t.Fatal(err)
+	}
+	if b, _, _ := r.Render("ipxe", db, "http://10.0.0.1"); !strings.Contains(string(b), "kernel https://boot.example.com/rocky/vmlinuz") {
+		t.Fatalf("URL is not used: %s", b)
+	}
+	if name, _, ok := r.For(host.Host{Labels: map[string]string{"role": "test"}}); !ok || name != "memtest" {
+		t.Fatalf("got %s %v", name, ok)
+	}
+}
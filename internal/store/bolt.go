@@ -0,0 +1,91 @@
+package store
+
+import (
+	"slices"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+type boltStore struct {
+	db *bolt.DB
+}
+
+// OpenBolt opens a store in the bbolt database name, creating it if it is
+// missing. Only one process may open it at a time.
+func OpenBolt(name string) (Store, error) {
+	return openBolt(name, false)
+}
+
+func openBolt(name string, readOnly bool) (Store, error) {
+	db, err := bolt.Open(name, 0644, &bolt.Options{Timeout: time.Second, ReadOnly: readOnly})
+	if err != nil {
+		return nil, err
+	}
+	return &boltStore{db: db}, nil
+}
+
+func (s *boltStore) List(bucket string) ([]Record, error) {
+	var rs []Record
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			rs = append(rs, Record{Key: string(k), Value: slices.Clone(v)})
+			return nil
+		})
+	})
+	return rs, err
+}
+
+func (s *boltStore) Put(bucket string, key string, value []byte) error {
+	if key == "" {
+		return errInvalidKey
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), value)
+	})
+}
+
+func (s *boltStore) Delete(bucket string, key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return b.Delete([]byte(key))
+	})
+}
+
+func (s *boltStore) Replace(bucket string, records []Record) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(bucket)) != nil {
+			if err := tx.DeleteBucket([]byte(bucket)); err != nil {
+				return err
+			}
+		}
+		b, err := tx.CreateBucket([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		for _, r := range records {
+			if r.Key == "" {
+				return errInvalidKey
+			}
+			if err := b.Put([]byte(r.Key), r.Value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
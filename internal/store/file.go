@@ -0,0 +1,119 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"slices"
+	"sync"
+)
+
+type file struct {
+	name    string
+	mu      sync.RWMutex
+	buckets map[string]map[string][]byte
+}
+
+// OpenFile opens a store keeping everything in the JSON file name, which is
+// rewritten on each change. A missing file is an empty store. The file is
+// read only here, so no other process may change it while it is open.
+func OpenFile(name string) (Store, error) {
+	f := &file{name: name, buckets: make(map[string]map[string][]byte)}
+	data, err := os.ReadFile(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var buckets map[string]map[string]json.RawMessage
+	if err := json.Unmarshal(data, &buckets); err != nil {
+		return nil, errors.New(name + ": " + err.Error())
+	}
+	for name, b := range buckets {
+		f.buckets[name] = make(map[string][]byte, len(b))
+		for k, v := range b {
+			// Values are indented in the file.
+			var compact bytes.Buffer
+			if err := json.Compact(&compact, v); err != nil {
+				return nil, err
+			}
+			f.buckets[name][k] = compact.Bytes()
+		}
+	}
+	return f, nil
+}
+
+func (f *file) List(bucket string) ([]Record, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return records(f.buckets[bucket]), nil
+}
+
+func (f *file) Put(bucket string, key string, value []byte) error {
+	if key == "" {
+		return errInvalidKey
+	}
+	return f.update(func(buckets map[string]map[string][]byte) {
+		if buckets[bucket] == nil {
+			buckets[bucket] = make(map[string][]byte)
+		}
+		buckets[bucket][key] = slices.Clone(value)
+	})
+}
+
+func (f *file) Delete(bucket string, key string) error {
+	return f.update(func(buckets map[string]map[string][]byte) {
+		delete(buckets[bucket], key)
+	})
+}
+
+func (f *file) Replace(bucket string, records []Record) error {
+	b := make(map[string][]byte, len(records))
+	for _, r := range records {
+		if r.Key == "" {
+			return errInvalidKey
+		}
+		b[r.Key] = slices.Clone(r.Value)
+	}
+	return f.update(func(buckets map[string]map[string][]byte) {
+		buckets[bucket] = b
+	})
+}
+
+func (f *file) Close() error {
+	return nil
+}
+
+// update applies change to a copy of the buckets and keeps it once it is
+// written. The file is replaced at once so that a crash never leaves half
+// of it.
+func (f *file) update(change func(buckets map[string]map[string][]byte)) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	next := clone(f.buckets)
+	change(next)
+
+	out := make(map[string]map[string]json.RawMessage, len(next))
+	for name, b := range next {
+		out[name] = make(map[string]json.RawMessage, len(b))
+		for k, v := range b {
+			out[name][k] = v
+		}
+	}
+	data, err := json.MarshalIndent(out, "", "    ")
+	if err != nil {
+		return err
+	}
+	tmp := f.name + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, f.name); err != nil {
+		return err
+	}
+	f.buckets = next
+	return nil
+}
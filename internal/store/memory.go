@@ -0,0 +1,83 @@
+package store
+
+import (
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+)
+
+type memory struct {
+	mu      sync.RWMutex
+	buckets map[string]map[string][]byte
+}
+
+// NewMemory returns a store losing everything when the process exits,
+// meant for tests.
+func NewMemory() Store {
+	return &memory{buckets: make(map[string]map[string][]byte)}
+}
+
+func (m *memory) List(bucket string) ([]Record, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return records(m.buckets[bucket]), nil
+}
+
+func (m *memory) Put(bucket string, key string, value []byte) error {
+	if key == "" {
+		return errInvalidKey
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, ok := m.buckets[bucket]
+	if !ok {
+		b = make(map[string][]byte)
+		m.buckets[bucket] = b
+	}
+	b[key] = slices.Clone(value)
+	return nil
+}
+
+func (m *memory) Delete(bucket string, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.buckets[bucket], key)
+	return nil
+}
+
+func (m *memory) Replace(bucket string, records []Record) error {
+	b := make(map[string][]byte, len(records))
+	for _, r := range records {
+		if r.Key == "" {
+			return errInvalidKey
+		}
+		b[r.Key] = slices.Clone(r.Value)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.buckets[bucket] = b
+	return nil
+}
+
+func (m *memory) Close() error {
+	return nil
+}
+
+// records returns the records of b sorted by key.
+func records(b map[string][]byte) []Record {
+	rs := make([]Record, 0, len(b))
+	for k, v := range b {
+		rs = append(rs, Record{Key: k, Value: slices.Clone(v)})
+	}
+	slices.SortFunc(rs, func(a, b Record) int { return strings.Compare(a.Key, b.Key) })
+	return rs
+}
+
+func clone(buckets map[string]map[string][]byte) map[string]map[string][]byte {
+	c := make(map[string]map[string][]byte, len(buckets))
+	for name, b := range buckets {
+		c[name] = maps.Clone(b)
+	}
+	return c
+}
@@ -0,0 +1,169 @@
+package store
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/callus-corn/tao/internal/dhcp"
+	"github.com/callus-corn/tao/internal/event"
+	"github.com/callus-corn/tao/internal/host"
+	"github.com/callus-corn/tao/internal/inventory"
+)
+
+// Lease is a lease handed out by DHCP, as kept in the lease history.
+type Lease struct {
+	MAC  string    `json:"MAC"`
+	IP   string    `json:"IP"`
+	Time time.Time `json:"Time"`
+}
+
+const (
+	leaseBucket   = "leases"
+	hostBucket    = "hosts"
+	machineBucket = "machines"
+	historyBucket = "history"
+)
+
+// historyKey sorts the lease history by time.
+const historyKey = "20060102T150405.000000000Z"
+
+const defaultHistoryDays = 90
+const defaultHistoryMax = 10000
+
+type leases struct {
+	s Store
+}
+
+// Leases returns the DHCP lease store kept in s.
+func Leases(s Store) dhcp.LeaseStore {
+	return &leases{s: s}
+}
+
+func (l *leases) Load() ([]dhcp.Lease, error) {
+	return list[dhcp.Lease](l.s, leaseBucket)
+}
+
+func (l *leases) Save(leases []dhcp.Lease) error {
+	records := make([]Record, 0, len(leases))
+	for _, lease := range leases {
+		value, err := json.Marshal(lease)
+		if err != nil {
+			return err
+		}
+		records = append(records, Record{Key: lease.MAC, Value: value})
+	}
+	return l.s.Replace(leaseBucket, records)
+}
+
+// LoadHosts returns the hosts saved by SaveHosts.
+func LoadHosts(s Store) ([]host.Entry, error) {
+	return list[host.Entry](s, hostBucket)
+}
+
+// SaveHosts replaces the saved hosts with entries.
+func SaveHosts(s Store, entries []host.Entry) error {
+	records := make([]Record, 0, len(entries))
+	for _, e := range entries {
+		value, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		records = append(records, Record{Key: e.MAC, Value: value})
+	}
+	return s.Replace(hostBucket, records)
+}
+
+// LoadMachines returns the machines saved by SaveMachines.
+func LoadMachines(s Store) ([]inventory.Machine, error) {
+	return list[inventory.Machine](s, machineBucket)
+}
+
+// SaveMachines replaces the saved machines with machines.
+func SaveMachines(s Store, machines []inventory.Machine) error {
+	records := make([]Record, 0, len(machines))
+	for _, m := range machines {
+		value, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		records = append(records, Record{Key: m.MAC, Value: value})
+	}
+	return s.Replace(machineBucket, records)
+}
+
+// RecordLease adds the lease acknowledged by e to the lease history.
+func RecordLease(s Store, e event.Event) error {
+	if e.Type != event.DHCPAck {
+		return nil
+	}
+	l := Lease{MAC: e.MAC, IP: e.IP, Time: e.Time.UTC()}
+	value, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	return s.Put(historyBucket, l.Time.Format(historyKey)+"/"+l.MAC, value)
+}
+
+// PruneHistory drops from the lease history the leases older than the
+// HistoryDays of c before now, then the oldest ones over its HistoryMax.
+func PruneHistory(s Store, c StoreConfig, now time.Time) error {
+	days, max := defaultHistoryDays, defaultHistoryMax
+	if c.HistoryDays > 0 {
+		days = c.HistoryDays
+	}
+	if c.HistoryMax > 0 {
+		max = c.HistoryMax
+	}
+	records, err := s.List(historyBucket)
+	if err != nil {
+		return err
+	}
+	oldest := now.UTC().AddDate(0, 0, -days).Format(historyKey)
+	kept := records
+	for len(kept) > 0 && kept[0].Key < oldest {
+		kept = kept[1:]
+	}
+	if len(kept) > max {
+		kept = kept[len(kept)-max:]
+	}
+	if len(kept) == len(records) {
+		return nil
+	}
+	return s.Replace(historyBucket, kept)
+}
+
+// History returns the lease history of mac from the oldest, or of every
+// host if mac is empty.
+func History(s Store, mac string) ([]Lease, error) {
+	all, err := list[Lease](s, historyBucket)
+	if err != nil || mac == "" {
+		return all, err
+	}
+	mac, err = host.NormalizeMAC(mac)
+	if err != nil {
+		return nil, err
+	}
+	var leases []Lease
+	for _, l := range all {
+		if l.MAC == mac {
+			leases = append(leases, l)
+		}
+	}
+	return leases, nil
+}
+
+func list[T any](s Store, bucket string) ([]T, error) {
+	records, err := s.List(bucket)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]T, 0, len(records))
+	for _, r := range records {
+		var v T
+		if err := json.Unmarshal(r.Value, &v); err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
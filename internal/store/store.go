@@ -0,0 +1,117 @@
+// Package store keeps the leases, reservations and host inventory of tao
+// across restarts.
+package store
+
+import (
+	"errors"
+	"path/filepath"
+
+	"github.com/callus-corn/tao/internal/config"
+)
+
+// StoreConfig is the Store section of tao.conf.
+type StoreConfig struct {
+	// Backend is memory, file or bbolt. Nothing is stored when it is empty.
+	// Only one process may change a file or bbolt store at a time, but
+	// tao history reads it while tao is stopped.
+	Backend string `json:"Backend"`
+	Path    string `json:"Path"`
+
+	// HistoryDays is how many days the lease history keeps a lease, 90 if
+	// it is 0.
+	HistoryDays int `json:"HistoryDays"`
+	// HistoryMax is how many leases the lease history keeps at most, 10000
+	// if it is 0. The history is pruned once an hour.
+	HistoryMax int `json:"HistoryMax"`
+}
+
+// Store keeps records by bucket and key. Values are JSON documents.
+type Store interface {
+	// List returns the records of bucket sorted by key.
+	List(bucket string) ([]Record, error)
+	Put(bucket string, key string, value []byte) error
+	Delete(bucket string, key string) error
+	// Replace replaces the records of bucket with records at once.
+	Replace(bucket string, records []Record) error
+	Close() error
+}
+
+// Record is a value kept under a key.
+type Record struct {
+	Key   string
+	Value []byte
+}
+
+// Validate checks the config without opening the store. Errors name the
+// field.
+func (c StoreConfig) Validate() error {
+	var errs []error
+	switch c.Backend {
+	case "", "memory":
+	case "file", "bbolt":
+		if c.Path == "" {
+			errs = append(errs, config.Errorf("Path", "path is required by backend %s", c.Backend))
+		} else {
+			errs = append(errs, config.Dir("Path", filepath.Dir(c.Path)))
+		}
+	default:
+		errs = append(errs, config.Errorf("Backend", "must be memory, file or bbolt"))
+	}
+	if c.HistoryDays < 0 {
+		errs = append(errs, config.Errorf("HistoryDays", "must not be negative"))
+	}
+	if c.HistoryMax < 0 {
+		errs = append(errs, config.Errorf("HistoryMax", "must not be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+// Open opens the store of c. It returns nil when no backend is configured.
+func Open(c StoreConfig) (Store, error) {
+	if err := c.Validate(); err != nil {
+		return nil, config.Prefix("Store", err)
+	}
+	switch c.Backend {
+	case "memory":
+		return NewMemory(), nil
+	case "file":
+		return OpenFile(c.Path)
+	case "bbolt":
+		return OpenBolt(c.Path)
+	}
+	return nil, nil
+}
+
+// OpenReadOnly opens the file or bbolt store of c for reading. A bbolt
+// store cannot be opened while another process has it open.
+func OpenReadOnly(c StoreConfig) (Store, error) {
+	if err := c.Validate(); err != nil {
+		return nil, config.Prefix("Store", err)
+	}
+	var s Store
+	var err error
+	switch c.Backend {
+	case "file":
+		s, err = OpenFile(c.Path)
+	case "bbolt":
+		s, err = openBolt(c.Path, true)
+	default:
+		return nil, errors.New("Store is not kept on disk")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return readOnly{s}, nil
+}
+
+// readOnly is a Store refusing changes.
+type readOnly struct {
+	Store
+}
+
+func (readOnly) Put(string, string, []byte) error { return errReadOnly }
+func (readOnly) Delete(string, string) error      { return errReadOnly }
+func (readOnly) Replace(string, []Record) error   { return errReadOnly }
+
+var errInvalidKey = errors.New("key must not be empty")
+var errReadOnly = errors.New("store is opened read-only")
@@ -0,0 +1,202 @@
+package store
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/callus-corn/tao/internal/dhcp"
+	"github.com/callus-corn/tao/internal/event"
+	"github.com/callus-corn/tao/internal/host"
+	"github.com/callus-corn/tao/internal/inventory"
+)
+
+var backends = []struct {
+	name string
+	open func(name string) (Store, error)
+}{
+	{"memory", func(string) (Store, error) { return NewMemory(), nil }},
+	{"file", OpenFile},
+	{"bbolt", OpenBolt},
+}
+
+func TestStore(t *testing.T) {
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			s, err := b.open(filepath.Join(t.TempDir(), "tao.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			if rs, err := s.List("missing"); err != nil || len(rs) != 0 {
+				t.Fatalf("got %v %v", rs, err)
+			}
+			for _, k := range []string{"b", "c", "a"} {
+				if err := s.Put("test", k, []byte(`"`+k+`"`)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := s.Put("test", "", []byte(`""`)); err == nil {
+				t.Fatal("empty key is accepted")
+			}
+			if err := s.Delete("test", "c"); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Delete("missing", "c"); err != nil {
+				t.Fatal(err)
+			}
+			rs, err := s.List("test")
+			if err != nil || len(rs) != 2 || rs[0].Key != "a" || string(rs[1].Value) != `"b"` {
+				t.Fatalf("got %v %v", rs, err)
+			}
+
+			if err := s.Replace("test", []Record{{Key: "d", Value: []byte(`{}`)}}); err != nil {
+				t.Fatal(err)
+			}
+			if rs, err := s.List("test"); err != nil || len(rs) != 1 || rs[0].Key != "d" {
+				t.Fatalf("got %v %v", rs, err)
+			}
+		})
+	}
+}
+
+func TestReopen(t *testing.T) {
+	for _, b := range backends[1:] {
+		t.Run(b.name, func(t *testing.T) {
+			name := filepath.Join(t.TempDir(), "tao.db")
+			s, err := b.open(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			leases := []dhcp.Lease{{MAC: "aa:bb:cc:dd:ee:01", IP: "10.0.1.2"}, {MAC: "aa:bb:cc:dd:ee:02", IP: "10.0.1.3", Reserved: true}}
+			if err := Leases(s).Save(leases); err != nil {
+				t.Fatal(err)
+			}
+			entries := []host.Entry{{Host: host.Host{MAC: "aa:bb:cc:dd:ee:01", Hostname: "node1"}, Source: "api"}}
+			if err := SaveHosts(s, entries); err != nil {
+				t.Fatal(err)
+			}
+			machines := []inventory.Machine{{MAC: "aa:bb:cc:dd:ee:01", State: inventory.Installed}}
+			if err := SaveMachines(s, machines); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			s, err = b.open(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			got, err := Leases(s).Load()
+			if err != nil || len(got) != 2 || got[1] != leases[1] {
+				t.Fatalf("got %v %v", got, err)
+			}
+			hosts, err := LoadHosts(s)
+			if err != nil || len(hosts) != 1 || hosts[0].Hostname != "node1" || hosts[0].Source != "api" {
+				t.Fatalf("got %v %v", hosts, err)
+			}
+			if got, err := LoadMachines(s); err != nil || len(got) != 1 || got[0].State != inventory.Installed {
+				t.Fatalf("got %v %v", got, err)
+			}
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			s, err = OpenReadOnly(StoreConfig{Backend: b.name, Path: name})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			if got, err := Leases(s).Load(); err != nil || len(got) != 2 {
+				t.Fatalf("read-only: got %v %v", got, err)
+			}
+			if err := Leases(s).Save(nil); err == nil {
+				t.Fatal("read-only store is changed")
+			}
+		})
+	}
+}
+
+func TestHistory(t *testing.T) {
+	s := NewMemory()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, e := range []event.Event{
+		{Type: event.DHCPAck, MAC: "aa:bb:cc:dd:ee:01", IP: "10.0.1.2", Time: start.Add(time.Hour)},
+		{Type: event.DHCPDiscover, MAC: "aa:bb:cc:dd:ee:01", Time: start.Add(2 * time.Hour)},
+		{Type: event.DHCPAck, MAC: "aa:bb:cc:dd:ee:02", IP: "10.0.1.3", Time: start.Add(3 * time.Hour)},
+		{Type: event.DHCPAck, MAC: "aa:bb:cc:dd:ee:01", IP: "10.0.1.4", Time: start},
+	} {
+		if err := RecordLease(s, e); err != nil {
+			t.Fatal(i, err)
+		}
+	}
+
+	all, err := History(s, "")
+	if err != nil || len(all) != 3 {
+		t.Fatalf("got %v %v", all, err)
+	}
+	leases, err := History(s, "AA-BB-CC-DD-EE-01")
+	if err != nil || len(leases) != 2 || leases[0].IP != "10.0.1.4" || leases[1].IP != "10.0.1.2" {
+		t.Fatalf("got %v %v", leases, err)
+	}
+	if _, err := History(s, "node1"); err == nil {
+		t.Fatal("invalid MAC is accepted")
+	}
+}
+
+func TestPruneHistory(t *testing.T) {
+	s := NewMemory()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := range 10 {
+		e := event.Event{Type: event.DHCPAck, MAC: "aa:bb:cc:dd:ee:01", IP: "10.0.1.2", Time: start.AddDate(0, 0, i)}
+		if err := RecordLease(s, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := PruneHistory(s, StoreConfig{}, start.AddDate(0, 0, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if leases, _ := History(s, ""); len(leases) != 10 {
+		t.Fatalf("got %d leases", len(leases))
+	}
+	// Days 0 to 2 are older than a week.
+	if err := PruneHistory(s, StoreConfig{HistoryDays: 7}, start.AddDate(0, 0, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if leases, _ := History(s, ""); len(leases) != 7 || !leases[0].Time.Equal(start.AddDate(0, 0, 3)) {
+		t.Fatalf("got %v", leases)
+	}
+	if err := PruneHistory(s, StoreConfig{HistoryMax: 2}, start.AddDate(0, 0, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if leases, _ := History(s, ""); len(leases) != 2 || !leases[0].Time.Equal(start.AddDate(0, 0, 8)) {
+		t.Fatalf("got %v", leases)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		c     StoreConfig
+		valid bool
+	}{
+		{StoreConfig{}, true},
+		{StoreConfig{Backend: "memory"}, true},
+		{StoreConfig{Backend: "bbolt", Path: filepath.Join(dir, "tao.db")}, true},
+		{StoreConfig{Backend: "file"}, false},
+		{StoreConfig{Backend: "file", Path: filepath.Join(dir, "missing", "tao.json")}, false},
+		{StoreConfig{Backend: "sqlite", Path: filepath.Join(dir, "tao.db")}, false},
+		{StoreConfig{HistoryDays: 30, HistoryMax: 100}, true},
+		{StoreConfig{HistoryDays: -1}, false},
+		{StoreConfig{HistoryMax: -1}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.c.Validate(); (err == nil) != tt.valid {
+			t.Errorf("%+v: %v", tt.c, err)
+		}
+	}
+}
@@ -0,0 +1,699 @@
+package tao
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	cfg "github.com/callus-corn/tao/internal/config"
+	"github.com/callus-corn/tao/internal/dhcp"
+	"github.com/callus-corn/tao/internal/host"
+	"github.com/callus-corn/tao/internal/inventory"
+	"github.com/callus-corn/tao/internal/iso"
+	"github.com/callus-corn/tao/internal/profile"
+	"github.com/callus-corn/tao/internal/store"
+	"github.com/callus-corn/tao/internal/tftp"
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(c *cli, args []string) error
+}
+
+// cli holds the flags shared by the subcommands.
+type cli struct {
+	out      io.Writer
+	confFile string
+	api      string
+	token    string
+	json     bool
+	ip       string
+	hostname string
+	arch     string
+	profile  string
+	once     bool
+	name     string
+}
+
+type apiError struct {
+	Error string `json:"Error"`
+}
+
+type health struct {
+	Status     string            `json:"Status"`
+	Subsystems map[string]string `json:"Subsystems"`
+}
+
+const defaultConf = "/etc/tao/tao.conf"
+
+var commands = []command{
+	{"leases", "leases [list | delete MAC | pin MAC]", leases},
+	{"hosts", "hosts [list | add MAC [-ip IP] [-hostname NAME] [-arch ARCH] [-profile NAME] [-netboot-once] | delete MAC]", hosts},
+	{"machines", "machines [list | show MAC | reports MAC | set MAC STATE | rearm MAC | delete MAC]", machines},
+	{"history", "history [MAC]", history},
+	{"import", "import ISO [-name NAME]", importISO},
+	{"status", "status", status},
+	{"reload", "reload", reload},
+	{"check-config", "check-config", checkConfig},
+	{"config", "config", printConfig},
+}
+
+// runCommand runs the subcommand name and returns the exit status.
+func runCommand(name string, args []string, out io.Writer) int {
+	for _, cmd := range commands {
+		if cmd.name != name {
+			continue
+		}
+		c := &cli{out: out}
+		fs := flag.NewFlagSet("tao "+name, flag.ContinueOnError)
+		fs.StringVar(&c.confFile, "conf", defaultConf, "config file")
+		fs.StringVar(&c.api, "api", "", "address of the admin API (default API.Address of the config)")
+		fs.StringVar(&c.token, "token", "", "token of the admin API (default API.Token of the config)")
+		fs.BoolVar(&c.json, "json", false, "print JSON instead of a table")
+		if name == "hosts" {
+			fs.StringVar(&c.ip, "ip", "", "reserved IP address")
+			fs.StringVar(&c.hostname, "hostname", "", "hostname")
+			fs.StringVar(&c.arch, "arch", "", "client architecture")
+			fs.StringVar(&c.profile, "profile", "", "boot profile")
+			fs.BoolVar(&c.once, "netboot-once", false, "boot from local disk once installed")
+		}
+		if name == "import" {
+			fs.StringVar(&c.name, "name", "", "directory and boot profile name (default detected from the image)")
+		}
+		fs.Usage = func() {
+			fmt.Fprintln(fs.Output(), "Usage: tao "+cmd.usage)
+			fs.PrintDefaults()
+		}
+		args, err := parseArgs(fs, args)
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		if err != nil {
+			return 2
+		}
+		if err := cmd.run(c, args); err != nil {
+			fmt.Fprintln(os.Stderr, "tao "+name+": "+err.Error())
+			return 1
+		}
+		return 0
+	}
+
+	fmt.Fprintln(os.Stderr, "tao: unknown command "+name)
+	fmt.Fprintln(os.Stderr, "Usage: tao [-conf FILE]")
+	for _, cmd := range commands {
+		fmt.Fprintln(os.Stderr, "       tao "+cmd.usage)
+	}
+	return 2
+}
+
+// parseArgs parses flags placed anywhere among the arguments and returns
+// the remaining arguments.
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var rest []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return rest, nil
+		}
+		rest = append(rest, args[0])
+		args = args[1:]
+	}
+}
+
+func leases(c *cli, args []string) error {
+	action, mac, err := action(args)
+	if err != nil {
+		return err
+	}
+	switch action {
+	case "list":
+		var leases []dhcp.Lease
+		if err := c.call("GET", "/leases", nil, &leases); err != nil {
+			return err
+		}
+		return c.print(leases, []string{"MAC", "IP", "RESERVED"}, func(row func(...any)) {
+			for _, l := range leases {
+				row(l.MAC, l.IP, l.Reserved)
+			}
+		})
+	case "delete":
+		return c.call("DELETE", "/leases/"+mac, nil, nil)
+	case "pin":
+		var lease dhcp.Lease
+		if err := c.call("POST", "/leases/"+mac+"/pin", nil, &lease); err != nil {
+			return err
+		}
+		return c.print(lease, []string{"MAC", "IP", "RESERVED"}, func(row func(...any)) {
+			row(lease.MAC, lease.IP, lease.Reserved)
+		})
+	}
+	return errors.New("unknown action " + action)
+}
+
+func hosts(c *cli, args []string) error {
+	action, mac, err := action(args)
+	if err != nil {
+		return err
+	}
+	switch action {
+	case "list":
+		var hosts []host.Host
+		if err := c.call("GET", "/hosts", nil, &hosts); err != nil {
+			return err
+		}
+		return c.print(hosts, []string{"MAC", "IP", "HOSTNAME", "ARCH"}, func(row func(...any)) {
+			for _, h := range hosts {
+				row(h.MAC, h.IP, h.Hostname, h.Arch)
+			}
+		})
+	case "add":
+		h := host.Host{MAC: mac}
+		if err := c.call("GET", "/hosts/"+mac, nil, &h); err != nil && !isNotFound(err) {
+			return err
+		}
+		if c.ip != "" {
+			h.IP = c.ip
+		}
+		if c.hostname != "" {
+			h.Hostname = c.hostname
+		}
+		if c.arch != "" {
+			h.Arch = c.arch
+		}
+		if c.profile != "" {
+			h.Profile = c.profile
+		}
+		if c.once {
+			h.NetbootOnce = true
+		}
+		if err := c.call("PUT", "/hosts/"+mac, h, &h); err != nil {
+			return err
+		}
+		return c.print(h, []string{"MAC", "IP", "HOSTNAME", "ARCH"}, func(row func(...any)) {
+			row(h.MAC, h.IP, h.Hostname, h.Arch)
+		})
+	case "delete":
+		return c.call("DELETE", "/hosts/"+mac, nil, nil)
+	}
+	return errors.New("unknown action " + action)
+}
+
+func machines(c *cli, args []string) error {
+	var state string
+	if len(args) == 3 && args[0] == "set" {
+		args, state = args[:2], args[2]
+	} else if len(args) == 2 && args[0] == "set" {
+		return errors.New("set requires a state")
+	}
+	action, mac, err := action(args)
+	if err != nil {
+		return err
+	}
+	header := []string{"MAC", "STATE", "UPDATED", "LABELS"}
+	row := func(row func(...any), m inventory.Machine) {
+		labels := make([]string, 0, len(m.Labels))
+		for k, v := range m.Labels {
+			labels = append(labels, k+"="+v)
+		}
+		slices.Sort(labels)
+		row(m.MAC, m.State, m.Updated.Local().Format(time.RFC3339), strings.Join(labels, ","))
+	}
+	switch action {
+	case "list":
+		var ms []inventory.Machine
+		if err := c.call("GET", "/machines", nil, &ms); err != nil {
+			return err
+		}
+		return c.print(ms, header, func(r func(...any)) {
+			for _, m := range ms {
+				row(r, m)
+			}
+		})
+	case "show", "set", "rearm":
+		var m inventory.Machine
+		switch action {
+		case "show":
+			err = c.call("GET", "/machines/"+mac, nil, &m)
+		case "set":
+			err = c.call("PUT", "/machines/"+mac+"/state", map[string]string{"State": state}, &m)
+		case "rearm":
+			err = c.call("POST", "/machines/"+mac+"/rearm", nil, &m)
+		}
+		if err != nil {
+			return err
+		}
+		return c.print(m, []string{"TIME", "FROM", "TO", "REASON"}, func(r func(...any)) {
+			for _, t := range m.History {
+				r(t.Time.Local().Format(time.RFC3339), t.From, t.To, t.Reason)
+			}
+		})
+	case "reports":
+		var m inventory.Machine
+		if err := c.call("GET", "/machines/"+mac, nil, &m); err != nil {
+			return err
+		}
+		return c.print(m.Reports, []string{"TIME", "TYPE", "MESSAGE", "FILE"}, func(r func(...any)) {
+			for _, rep := range m.Reports {
+				r(rep.Time.Local().Format(time.RFC3339), rep.Type, rep.Message, rep.File)
+			}
+		})
+	case "delete":
+		return c.call("DELETE", "/machines/"+mac, nil, nil)
+	}
+	return errors.New("unknown action " + action)
+}
+
+// history lists the lease history which tao keeps in its store, through
+// the admin API, or from the store itself when tao does not answer.
+func history(c *cli, args []string) error {
+	if len(args) > 1 {
+		return errors.New("too many arguments")
+	}
+	var mac string
+	path := "/history"
+	if len(args) == 1 {
+		mac = args[0]
+		path += "/" + mac
+	}
+	var leases []store.Lease
+	err := c.call("GET", path, nil, &leases)
+	var status *statusError
+	if err != nil && !errors.As(err, &status) {
+		var offline error
+		leases, offline = storedHistory(c.confFile, mac)
+		if offline != nil {
+			return errors.Join(err, offline)
+		}
+	} else if err != nil {
+		return err
+	}
+	return c.print(leases, []string{"TIME", "MAC", "IP"}, func(row func(...any)) {
+		for _, l := range leases {
+			row(l.Time.Local().Format(time.RFC3339), l.MAC, l.IP)
+		}
+	})
+}
+
+// storedHistory reads the lease history of mac from the store of the
+// config file fname.
+func storedHistory(fname string, mac string) ([]store.Lease, error) {
+	conf, err := load(fname)
+	if err != nil {
+		return nil, err
+	}
+	st, err := store.OpenReadOnly(conf.Store)
+	if err != nil {
+		return nil, err
+	}
+	defer st.Close()
+	return store.History(st, mac)
+}
+
+// importISO extracts an installer image into SrvDir of HTTP, and its kernel
+// and initrd into SrvDir of TFTP when it differs, then adds a boot profile
+// for the detected OS to the config file. The profile is used after reload.
+func importISO(c *cli, args []string) error {
+	if len(args) != 1 {
+		return errors.New("import requires an ISO image")
+	}
+	conf, err := load(c.confFile)
+	if err != nil {
+		return err
+	}
+	var dirs []string
+	for _, dir := range []struct {
+		enabled bool
+		name    string
+	}{{conf.HTTP.IsEnable, conf.HTTP.SrvDir}, {conf.TFTP.IsEnable, conf.TFTP.SrvDir}} {
+		if dir.enabled && !slices.Contains(dirs, filepath.Clean(dir.name)) {
+			dirs = append(dirs, filepath.Clean(dir.name))
+		}
+	}
+	if len(dirs) == 0 {
+		return errors.New("neither HTTP nor TFTP is enabled")
+	}
+
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	img, err := iso.Open(f)
+	if err != nil {
+		return errors.New(args[0] + ": " + err.Error())
+	}
+	r, err := iso.Detect(img)
+	if err != nil {
+		return errors.New(args[0] + ": " + err.Error())
+	}
+	name := r.Name
+	if c.name != "" {
+		name = c.name
+	}
+	if name == "." || name == ".." || strings.ContainsAny(name, " /\\") {
+		return errors.New("invalid name " + name)
+	}
+	p := profile.Profile{Kernel: name + "/" + r.Kernel, Initrd: name + "/" + r.Initrd}
+	switch r.Family {
+	case "redhat":
+		p.Cmdline = "inst.repo={{.URL}}/" + name + " ip=dhcp"
+	case "ubuntu":
+		// The casper installer downloads the whole image.
+		p.Cmdline = "ip=dhcp cloud-config-url=/dev/null url={{.URL}}/" + name + "/" + name + ".iso"
+	}
+
+	for _, dir := range dirs {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			return errors.New(filepath.Join(dir, name) + " already exists")
+		}
+	}
+	done := false
+	defer func() {
+		if !done {
+			for _, dir := range dirs {
+				os.RemoveAll(filepath.Join(dir, name))
+			}
+		}
+	}()
+	if err := iso.Extract(img, filepath.Join(dirs[0], name)); err != nil {
+		return err
+	}
+	if r.Family == "ubuntu" {
+		if err := copyImage(f, filepath.Join(dirs[0], name, name+".iso")); err != nil {
+			return err
+		}
+	}
+	for _, dir := range dirs[1:] {
+		if err := iso.Extract(img, filepath.Join(dir, name), r.Kernel, r.Initrd); err != nil {
+			return err
+		}
+	}
+	if err := addProfile(c.confFile, name, p); err != nil {
+		return err
+	}
+	done = true
+
+	boot := []string{}
+	for _, e := range img.Boot() {
+		if e.Bootable && !slices.Contains(boot, e.Platform) {
+			boot = append(boot, e.Platform)
+		}
+	}
+	res := struct {
+		Name    string          `json:"Name"`
+		Profile profile.Profile `json:"Profile"`
+		Boot    []string        `json:"Boot"`
+	}{name, p, boot}
+	return c.print(res, []string{"NAME", "KERNEL", "INITRD", "BOOT"}, func(row func(...any)) {
+		row(name, p.Kernel, p.Initrd, strings.Join(boot, ","))
+	})
+}
+
+func copyImage(f *os.File, name string) error {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	dst, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, f)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// addProfile adds p to Boot.Profiles of the config file, leaving the rest
+// of the file as it is written.
+func addProfile(fname string, name string, p profile.Profile) error {
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		return err
+	}
+	data, err = cfg.Set(data, []string{"Boot", "Profiles", name}, p)
+	if err != nil {
+		return errors.New(fname + ": " + err.Error())
+	}
+	var next config
+	if err := cfg.Decode(data, &next); err != nil {
+		return err
+	}
+	if err := validate(next); err != nil {
+		return err
+	}
+
+	info, err := os.Stat(fname)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(fname), filepath.Base(fname)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), info.Mode().Perm())
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fname)
+}
+
+func status(c *cli, args []string) error {
+	if len(args) > 0 {
+		return errors.New("too many arguments")
+	}
+	var res struct {
+		Health    health          `json:"Health"`
+		Transfers []tftp.Transfer `json:"Transfers"`
+	}
+	unhealthy := c.call("GET", "/health", nil, &res.Health)
+	if unhealthy != nil && res.Health.Status == "" {
+		return unhealthy
+	}
+	if err := c.call("GET", "/transfers", nil, &res.Transfers); err != nil {
+		return err
+	}
+
+	if c.json {
+		if err := c.print(res, nil, nil); err != nil {
+			return err
+		}
+		return unhealthy
+	}
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SUBSYSTEM\tHEALTH")
+	names := make([]string, 0, len(res.Health.Subsystems))
+	for name := range res.Health.Subsystems {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "%s\t%s\n", name, res.Health.Subsystems[name])
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "CLIENT\tFILENAME\tMODE\tPROGRESS\tELAPSED")
+	for _, t := range res.Transfers {
+		progress := strconv.FormatInt(t.Sent, 10) + "/" + strconv.FormatInt(t.Size, 10)
+		if t.Size > 0 {
+			progress += fmt.Sprintf(" (%d%%)", t.Sent*100/t.Size)
+		}
+		mode := t.Mode
+		if t.Multicast {
+			mode += ",multicast"
+		}
+		elapsed := time.Since(t.Started).Truncate(time.Second)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", t.Client, t.Filename, mode, progress, elapsed)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return unhealthy
+}
+
+func reload(c *cli, args []string) error {
+	if len(args) > 0 {
+		return errors.New("too many arguments")
+	}
+	return c.call("POST", "/reload", nil, nil)
+}
+
+func checkConfig(c *cli, args []string) error {
+	if len(args) > 0 {
+		return errors.New("too many arguments")
+	}
+	if _, err := load(c.confFile); err != nil {
+		for _, line := range strings.Split(err.Error(), "\n") {
+			fmt.Fprintln(c.out, line)
+		}
+		return errors.New(c.confFile + " is invalid")
+	}
+	fmt.Fprintln(c.out, c.confFile+" is valid")
+	return nil
+}
+
+func printConfig(c *cli, args []string) error {
+	if len(args) > 0 {
+		return errors.New("too many arguments")
+	}
+	conf, err := load(c.confFile)
+	if err != nil {
+		return err
+	}
+	if conf.API.Token != "" {
+		conf.API.Token = "********"
+	}
+	return c.print(conf, nil, nil)
+}
+
+func action(args []string) (string, string, error) {
+	if len(args) == 0 {
+		return "list", "", nil
+	}
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		return args[0], "", nil
+	case args[0] != "list" && len(args) == 2:
+		mac, err := host.NormalizeMAC(args[1])
+		return args[0], mac, err
+	case args[0] != "list" && len(args) < 2:
+		return "", "", errors.New(args[0] + " requires a MAC address")
+	}
+	return "", "", errors.New("too many arguments")
+}
+
+// call sends a request to the admin API of the running daemon and decodes
+// the response into out.
+func (c *cli) call(method string, path string, in any, out any) error {
+	base, token, err := c.endpoint()
+	if err != nil {
+		return err
+	}
+
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, base+"/api/v1"+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	client := &http.Client{Timeout: 10 * time.Second}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode >= 300 {
+		var e apiError
+		json.Unmarshal(b, &e)
+		if e.Error == "" {
+			// The health check answers 503 with a report instead of an error.
+			if out != nil {
+				json.Unmarshal(b, out)
+			}
+			e.Error = res.Status
+		}
+		return &statusError{code: res.StatusCode, msg: e.Error}
+	}
+	if out == nil || len(b) == 0 {
+		return nil
+	}
+	return json.Unmarshal(b, out)
+}
+
+func (c *cli) endpoint() (string, string, error) {
+	addr, token := c.api, c.token
+	if addr == "" || token == "" {
+		conf, err := decode(c.confFile)
+		if err != nil {
+			return "", "", err
+		}
+		if addr == "" {
+			addr = conf.API.Address
+		}
+		if token == "" {
+			token = conf.API.Token
+		}
+	}
+	if addr == "" {
+		return "", "", errors.New("API address is not configured")
+	}
+	if strings.Contains(addr, "://") {
+		return strings.TrimSuffix(addr, "/"), token, nil
+	}
+	h, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", "", err
+	}
+	if h == "" {
+		h = "127.0.0.1"
+	}
+	return "http://" + net.JoinHostPort(h, port), token, nil
+}
+
+// print writes v as JSON, or as a table with header when rows is given and
+// JSON output is not requested.
+func (c *cli) print(v any, header []string, rows func(row func(...any))) error {
+	if c.json || rows == nil {
+		encoder := json.NewEncoder(c.out)
+		encoder.SetIndent("", "    ")
+		return encoder.Encode(v)
+	}
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	rows(func(cols ...any) {
+		s := make([]string, len(cols))
+		for i, col := range cols {
+			s[i] = fmt.Sprint(col)
+		}
+		fmt.Fprintln(w, strings.Join(s, "\t"))
+	})
+	return w.Flush()
+}
+
+type statusError struct {
+	code int
+	msg  string
+}
+
+func (e *statusError) Error() string {
+	return e.msg
+}
+
+func isNotFound(err error) bool {
+	var e *statusError
+	return errors.As(err, &e) && e.code == http.StatusNotFound
+}
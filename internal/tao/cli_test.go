@@ -0,0 +1,297 @@
+package tao
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/callus-corn/tao/internal/api"
+	"github.com/callus-corn/tao/internal/event"
+	"github.com/callus-corn/tao/internal/host"
+	"github.com/callus-corn/tao/internal/iso/isotest"
+	"github.com/callus-corn/tao/internal/store"
+)
+
+func newAPI(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/leases", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"MAC":"aa:bb:cc:dd:ee:01","IP":"10.0.1.2","Reserved":false}]`))
+	})
+	mux.HandleFunc("GET /api/v1/hosts/{mac}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"Error":"host is not found"}`))
+	})
+	mux.HandleFunc("PUT /api/v1/hosts/{mac}", func(w http.ResponseWriter, r *http.Request) {
+		var h host.Host
+		json.NewDecoder(r.Body).Decode(&h)
+		json.NewEncoder(w).Encode(h)
+	})
+	mux.HandleFunc("GET /api/v1/health", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{"Status":"unhealthy","Subsystems":{"DHCP":"ok","TFTP":"ok","HTTP":"address already in use"}}`))
+	})
+	mux.HandleFunc("GET /api/v1/machines", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"MAC":"aa:bb:cc:dd:ee:01","State":"installed","Labels":{"rack":"a","role":"db"}}]`))
+	})
+	mux.HandleFunc("PUT /api/v1/machines/{mac}/state", func(w http.ResponseWriter, r *http.Request) {
+		var req struct{ State string }
+		json.NewDecoder(r.Body).Decode(&req)
+		w.Write([]byte(`{"MAC":"` + r.PathValue("mac") + `","State":"` + req.State + `","History":[{"From":"installed","To":"` + req.State + `","Reason":"operator"}]}`))
+	})
+	mux.HandleFunc("GET /api/v1/machines/{mac}", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"MAC":"aa:bb:cc:dd:ee:01","State":"failed","Reports":[{"Type":"install.failed","Message":"step partition: disk not found"}]}`))
+	})
+	mux.HandleFunc("GET /api/v1/transfers", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[]`))
+	})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"Error":"invalid token"}`))
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestParseArgs(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	ip := fs.String("ip", "", "")
+	jsonOut := fs.Bool("json", false, "")
+	args, err := parseArgs(fs, []string{"add", "-json", "aa:bb:cc:dd:ee:01", "-ip", "10.0.1.10"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(args, []string{"add", "aa:bb:cc:dd:ee:01"}) || *ip != "10.0.1.10" || !*jsonOut {
+		t.Fatalf("got %v %v %v", args, *ip, *jsonOut)
+	}
+}
+
+func TestCommands(t *testing.T) {
+	srv := newAPI(t)
+	api := []string{"-api", srv.URL, "-token", "secret"}
+
+	tests := []struct {
+		name  string
+		args  []string
+		code  int
+		wants []string
+	}{
+		{
+			name:  "leases",
+			args:  []string{"leases"},
+			wants: []string{"MAC                IP        RESERVED", "aa:bb:cc:dd:ee:01  10.0.1.2  false"},
+		},
+		{
+			name:  "leases json",
+			args:  []string{"leases", "-json"},
+			wants: []string{`"IP": "10.0.1.2"`},
+		},
+		{
+			name:  "add host",
+			args:  []string{"hosts", "add", "AA-BB-CC-DD-EE-02", "-ip", "10.0.1.11", "-hostname", "node2"},
+			wants: []string{"aa:bb:cc:dd:ee:02  10.0.1.11  node2"},
+		},
+		{
+			name:  "machines",
+			args:  []string{"machines"},
+			wants: []string{"aa:bb:cc:dd:ee:01  installed", "rack=a,role=db"},
+		},
+		{
+			name:  "set state",
+			args:  []string{"machines", "set", "aa:bb:cc:dd:ee:01", "ready"},
+			wants: []string{"installed  ready  operator"},
+		},
+		{
+			name:  "reports",
+			args:  []string{"machines", "reports", "aa:bb:cc:dd:ee:01"},
+			wants: []string{"install.failed  step partition: disk not found"},
+		},
+		{
+			name: "set without state",
+			args: []string{"machines", "set", "aa:bb:cc:dd:ee:01"},
+			code: 1,
+		},
+		{
+			name: "invalid MAC",
+			args: []string{"hosts", "delete", "node2"},
+			code: 1,
+		},
+		{
+			name:  "unhealthy",
+			args:  []string{"status"},
+			code:  1,
+			wants: []string{"HTTP       address already in use", "CLIENT"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			code := runCommand(tt.args[0], append(tt.args[1:], api...), &out)
+			if code != tt.code {
+				t.Fatalf("exit status %d, output %s", code, out.String())
+			}
+			for _, want := range tt.wants {
+				if !strings.Contains(out.String(), want) {
+					t.Fatalf("%q is not in\n%s", want, out.String())
+				}
+			}
+		})
+	}
+}
+
+func TestUnauthorizedCommand(t *testing.T) {
+	srv := newAPI(t)
+	var out bytes.Buffer
+	if code := runCommand("leases", []string{"-api", srv.URL, "-token", "wrong"}, &out); code != 1 {
+		t.Fatalf("exit status %d", code)
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "valid.conf")
+	os.WriteFile(valid, []byte(`{"API":{"Token":"secret"},"Hosts":[{"MAC":"aa:bb:cc:dd:ee:01","IP":"10.0.1.10"}]}`), 0644)
+	invalid := filepath.Join(dir, "invalid.conf")
+	os.WriteFile(invalid, []byte(`{"Hosts":[{"MAC":"aa:bb:cc:dd:ee:01","IP":"10.0.1"}]}`), 0644)
+
+	var out bytes.Buffer
+	if code := runCommand("check-config", []string{"-conf", valid}, &out); code != 0 {
+		t.Fatalf("exit status %d", code)
+	}
+	if code := runCommand("check-config", []string{"-conf", invalid}, &out); code != 1 {
+		t.Fatalf("exit status %d", code)
+	}
+
+	out.Reset()
+	if code := runCommand("config", []string{"-conf", valid}, &out); code != 0 {
+		t.Fatalf("exit status %d", code)
+	}
+	if strings.Contains(out.String(), "secret") || !strings.Contains(out.String(), `"IP": "10.0.1.10"`) {
+		t.Fatalf("got %s", out.String())
+	}
+}
+
+func TestHistory(t *testing.T) {
+	// The daemon holds the bbolt database open while the command runs.
+	dir := t.TempDir()
+	db := filepath.Join(dir, "tao.db")
+	st, err := store.OpenBolt(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	for i, mac := range []string{"aa:bb:cc:dd:ee:01", "aa:bb:cc:dd:ee:02", "aa:bb:cc:dd:ee:01"} {
+		e := event.Event{Type: event.DHCPAck, MAC: mac, IP: "10.0.1." + strconv.Itoa(i+2), Time: time.Unix(int64(i), 0)}
+		if err := store.RecordLease(st, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctl := api.Control{History: func(mac string) ([]store.Lease, error) { return store.History(st, mac) }}
+	a, err := api.NewServer(api.APIConfig{Address: "127.0.0.1:0", Token: "secret"}, ctl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(a)
+	conf := filepath.Join(dir, "tao.conf")
+	os.WriteFile(conf, []byte(`{"Store":{"Backend":"bbolt","Path":"`+db+`"}}`), 0644)
+	args := []string{"-conf", conf, "-api", srv.URL, "-token", "secret", "AA-BB-CC-DD-EE-01"}
+
+	for _, running := range []bool{true, false} {
+		if !running {
+			srv.Close()
+			st.Close()
+		}
+		var out bytes.Buffer
+		if code := runCommand("history", args, &out); code != 0 {
+			t.Fatalf("running %v: exit status %d", running, code)
+		}
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		if len(lines) != 3 || !strings.Contains(lines[1], "10.0.1.2") || !strings.Contains(lines[2], "10.0.1.4") {
+			t.Fatalf("running %v: got %s", running, out.String())
+		}
+	}
+}
+
+func TestImport(t *testing.T) {
+	dir := t.TempDir()
+	httpDir := filepath.Join(dir, "http")
+	tftpDir := filepath.Join(dir, "tftp")
+	os.Mkdir(httpDir, 0755)
+	os.Mkdir(tftpDir, 0755)
+	image := isotest.Image{
+		Files: map[string]string{
+			".treeinfo":                  "[release]\nshort = Rocky\nversion = 9.4\n[tree]\narch = x86_64\n[images-x86_64]\nkernel = images/pxeboot/vmlinuz\ninitrd = images/pxeboot/initrd.img\n",
+			"images/pxeboot/vmlinuz":     "kernel",
+			"images/pxeboot/initrd.img":  "initrd",
+			"images/efiboot.img":         "efiboot",
+			"BaseOS/repodata/repomd.xml": "<repomd/>",
+		},
+		RockRidge: true,
+		EFIBoot:   "images/efiboot.img",
+	}
+	isoFile := filepath.Join(dir, "rocky.iso")
+	os.WriteFile(isoFile, image.Bytes(), 0644)
+	conf := filepath.Join(dir, "tao.conf")
+	data := "{\n    \"TFTP\" : {\n        \"IsEnable\" : true,\n        \"Address\" : \":69\",\n        \"SrvDir\" : \"" + tftpDir + "\"\n    },\n" +
+		"    \"HTTP\" : {\n        \"IsEnable\" : true,\n        \"Address\" : \":80\",\n        \"SrvDir\" : \"" + httpDir + "\"\n    }\n}\n"
+	os.WriteFile(conf, []byte(data), 0600)
+
+	var out bytes.Buffer
+	if code := runCommand("import", []string{"-conf", conf, isoFile}, &out); code != 0 {
+		t.Fatalf("exit status %d", code)
+	}
+	if !strings.Contains(out.String(), "rocky-9.4-x86_64  rocky-9.4-x86_64/images/pxeboot/vmlinuz") || !strings.Contains(out.String(), "uefi") {
+		t.Fatalf("got %s", out.String())
+	}
+	for _, name := range []string{
+		filepath.Join(httpDir, "rocky-9.4-x86_64", "BaseOS", "repodata", "repomd.xml"),
+		filepath.Join(httpDir, "rocky-9.4-x86_64", "images", "pxeboot", "vmlinuz"),
+		filepath.Join(tftpDir, "rocky-9.4-x86_64", "images", "pxeboot", "initrd.img"),
+	} {
+		if _, err := os.Stat(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(tftpDir, "rocky-9.4-x86_64", "BaseOS")); err == nil {
+		t.Fatal("repo is copied to TFTP")
+	}
+
+	c, err := load(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := c.Boot.Profiles["rocky-9.4-x86_64"]
+	if p.Initrd != "rocky-9.4-x86_64/images/pxeboot/initrd.img" || p.Cmdline != "inst.repo={{.URL}}/rocky-9.4-x86_64 ip=dhcp" {
+		t.Fatalf("got %+v", p)
+	}
+	b, _ := os.ReadFile(conf)
+	if !strings.HasPrefix(string(b), data[:len(data)-3]+",\n    \"Boot\" : {") {
+		t.Fatalf("config is rewritten: %s", b)
+	}
+	if info, _ := os.Stat(conf); info.Mode().Perm() != 0600 {
+		t.Fatalf("config mode is %v", info.Mode())
+	}
+
+	if code := runCommand("import", []string{"-conf", conf, isoFile}, &out); code != 1 {
+		t.Fatalf("imported twice: exit status %d", code)
+	}
+	if _, err := os.Stat(filepath.Join(httpDir, "rocky-9.4-x86_64", "BaseOS")); err != nil {
+		t.Fatal(err)
+	}
+	if code := runCommand("import", []string{"-conf", conf, "-name", "rocky-9", conf}, &out); code != 1 {
+		t.Fatalf("config is imported: exit status %d", code)
+	}
+}
@@ -0,0 +1,159 @@
+package tao
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/callus-corn/tao/internal/api"
+	cfg "github.com/callus-corn/tao/internal/config"
+	"github.com/callus-corn/tao/internal/dhcp"
+	"github.com/callus-corn/tao/internal/event"
+	"github.com/callus-corn/tao/internal/host"
+	"github.com/callus-corn/tao/internal/http"
+	"github.com/callus-corn/tao/internal/inventory"
+	"github.com/callus-corn/tao/internal/profile"
+	"github.com/callus-corn/tao/internal/store"
+	"github.com/callus-corn/tao/internal/tftp"
+)
+
+// Service is a subsystem of tao started by Main.
+type Service interface {
+	Name() string
+	// Start returns once the service is listening. The service stops
+	// accepting new work when ctx is done.
+	Start(ctx context.Context) error
+	// Stop waits for the work in progress until ctx is done.
+	Stop(ctx context.Context) error
+	Health() error
+	// Reload checks c and returns a function applying it to the running
+	// service.
+	Reload(c config) (func(), error)
+}
+
+type service struct {
+	name   string
+	start  func(ctx context.Context) error
+	stop   func(ctx context.Context) error
+	health func() error
+	reload func(c config) (func(), error)
+}
+
+// pruneInterval is how often the lease history is pruned.
+const pruneInterval = time.Hour
+
+// pruner tells when the lease history is to be pruned again.
+type pruner struct {
+	mu   sync.Mutex
+	last time.Time
+}
+
+func (p *pruner) due(now time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if now.Sub(p.last) < pruneInterval {
+		return false
+	}
+	p.last = now
+	return true
+}
+
+func (s *service) Name() string                    { return s.name }
+func (s *service) Start(ctx context.Context) error { return s.start(ctx) }
+func (s *service) Stop(ctx context.Context) error  { return s.stop(ctx) }
+func (s *service) Health() error                   { return s.health() }
+func (s *service) Reload(c config) (func(), error) { return s.reload(c) }
+
+// services returns the enabled subsystems in the order they start. The
+// servers share hosts and profiles. The leases are kept in st unless it is
+// nil, and the events of the servers drive inv.
+func services(c config, reload func() error, st store.Store, hosts *host.Registry, profiles *profile.Registry, inv *inventory.Inventory) ([]Service, error) {
+	var s []Service
+	ctl := api.Control{Health: make(map[string]func() error), Reload: reload, Hosts: hosts, Profiles: profiles, Inventory: inv}
+	if st != nil {
+		ctl.History = func(mac string) ([]store.Lease, error) { return store.History(st, mac) }
+	}
+	if c.TFTP.IsEnable {
+		srv, err := tftp.NewServer(c.TFTP, hosts, profiles)
+		if err != nil {
+			return nil, err
+		}
+		srv.OnEvent(inv.Handle)
+		srv.SetLocalBoot(inv.LocalBoot)
+		ctl.TFTP = srv
+		s = append(s, &service{
+			name:   "TFTP",
+			start:  srv.Listen,
+			stop:   srv.Shutdown,
+			health: srv.Health,
+			reload: func(c config) (func(), error) { return srv.Reload(c.TFTP) },
+		})
+	}
+	if c.DHCP.IsEnable {
+		srv, err := dhcp.NewServer(c.DHCP, hosts)
+		if err != nil {
+			return nil, err
+		}
+		if st != nil {
+			if err := srv.SetLeaseStore(store.Leases(st)); err != nil {
+				return nil, cfg.Prefix("Store", err)
+			}
+			prune := &pruner{}
+			srv.OnEvent(func(e event.Event) {
+				if e.Type != event.DHCPAck {
+					return
+				}
+				if err := store.RecordLease(st, e); err != nil {
+					logger.Error("lease history is not saved: "+err.Error(), "module", "TAO", "mac", e.MAC)
+				}
+				if !prune.due(e.Time) {
+					return
+				}
+				if err := store.PruneHistory(st, c.Store, e.Time); err != nil {
+					logger.Error("lease history is not pruned: "+err.Error(), "module", "TAO")
+				}
+			})
+		}
+		srv.OnEvent(inv.Handle)
+		srv.SetLocalBoot(inv.LocalBoot)
+		ctl.DHCP = srv
+		s = append(s, &service{
+			name:   "DHCP",
+			start:  srv.Listen,
+			stop:   srv.Shutdown,
+			health: srv.Health,
+			reload: func(c config) (func(), error) { return srv.Reload(c.DHCP) },
+		})
+	}
+	if c.HTTP.IsEnable {
+		srv, err := http.NewServer(c.HTTP, hosts, profiles)
+		if err != nil {
+			return nil, err
+		}
+		srv.OnEvent(inv.Handle)
+		s = append(s, &service{
+			name:   "HTTP",
+			start:  srv.Listen,
+			stop:   srv.Shutdown,
+			health: srv.Health,
+			reload: func(c config) (func(), error) { return srv.Reload(c.HTTP) },
+		})
+	}
+	if c.API.IsEnable {
+		for _, svc := range s {
+			ctl.Health[svc.Name()] = svc.Health
+		}
+		srv, err := api.NewServer(c.API, ctl)
+		if err != nil {
+			return nil, err
+		}
+		s = append(s, &service{
+			name:   "API",
+			start:  srv.Listen,
+			stop:   srv.Shutdown,
+			health: func() error { return nil },
+			reload: func(c config) (func(), error) { return srv.Reload(c.API) },
+		})
+	}
+	return s, nil
+}
@@ -0,0 +1,140 @@
+package tao
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/callus-corn/tao/internal/host"
+	"github.com/callus-corn/tao/internal/inventory"
+	"github.com/callus-corn/tao/internal/profile"
+)
+
+func TestServices(t *testing.T) {
+	c := validConfig(t.TempDir())
+	c.TFTP.IsEnable = false
+	c.DHCP.IsEnable = false
+	c.HTTP.Address = "127.0.0.1:0"
+	c.API.Address = "127.0.0.1:0"
+
+	hosts := host.NewRegistry()
+	svcs, err := services(c, nil, nil, hosts, profile.NewRegistry(), inventory.New(hosts))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, svc := range svcs {
+		names = append(names, svc.Name())
+	}
+	if strings.Join(names, ",") != "HTTP,API" {
+		t.Fatalf("got %v", names)
+	}
+
+	for _, svc := range svcs {
+		if err := svc.Start(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if err := svc.Health(); err != nil {
+			t.Fatalf("%s: %v", svc.Name(), err)
+		}
+	}
+	if err := shutdown(svcs, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := svcs[0].Health(); err == nil {
+		t.Fatal("stopped HTTP is healthy")
+	}
+}
+
+func TestRun(t *testing.T) {
+	c := validConfig(t.TempDir())
+	c.TFTP.IsEnable = false
+	c.DHCP.IsEnable = false
+	c.API.IsEnable = false
+	c.HTTP.Address = "127.0.0.1:0"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- newDaemon("", c).run(ctx) }()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("run does not return after cancel")
+	}
+
+	// A listener failing in the background is reported by run.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	c.HTTP.Address = ln.Addr().String()
+	if err := newDaemon("", c).run(context.Background()); err == nil || !strings.HasPrefix(err.Error(), "HTTP failed to start") {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	c := validConfig(dir)
+	c.TFTP.IsEnable = false
+	c.DHCP.IsEnable = false
+	c.API.IsEnable = false
+	c.HTTP.Address = "127.0.0.1:0"
+	fname := filepath.Join(dir, "tao.conf")
+	write := func(c config) {
+		data, err := json.Marshal(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fname, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d := newDaemon(fname, c)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- d.run(ctx) }()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	c.Hosts = append(c.Hosts, host.Host{MAC: "aa:bb:cc:dd:ee:02", IP: "10.0.1.11"})
+	write(c)
+	if err := d.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := d.hosts.Get("aa:bb:cc:dd:ee:02"); !ok {
+		t.Fatal("reservation is not reloaded")
+	}
+
+	for name, change := range map[string]func(c *config){
+		"HTTP.Address":  func(c *config) { c.HTTP.Address = "127.0.0.1:1" },
+		"DHCP.IsEnable": func(c *config) { c.DHCP.IsEnable = true },
+		"HTTP.SrvDir":   func(c *config) { c.HTTP.SrvDir = filepath.Join(dir, "missing") },
+	} {
+		next := c
+		next.Hosts = nil
+		change(&next)
+		write(next)
+		if err := d.reload(); err == nil || !strings.Contains(err.Error(), name) {
+			t.Fatalf("%s: got %v", name, err)
+		}
+		if _, ok := d.hosts.Get("aa:bb:cc:dd:ee:02"); !ok {
+			t.Fatalf("%s: rejected config is applied", name)
+		}
+	}
+}
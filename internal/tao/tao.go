@@ -1,72 +1,318 @@
 package tao
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"flag"
 	"io"
 	"log/slog"
 	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/callus-corn/tao/internal/api"
+	cfg "github.com/callus-corn/tao/internal/config"
 	"github.com/callus-corn/tao/internal/dhcp"
+	"github.com/callus-corn/tao/internal/host"
 	"github.com/callus-corn/tao/internal/http"
+	"github.com/callus-corn/tao/internal/inventory"
+	"github.com/callus-corn/tao/internal/profile"
+	"github.com/callus-corn/tao/internal/store"
 	"github.com/callus-corn/tao/internal/tftp"
 )
 
 type config struct {
-	TFTP tftp.TFTPConfig `json:"TFTP"`
-	DHCP dhcp.DHCPConfig `json:"DHCP"`
-	HTTP http.HTTPConfig `json:"HTTP"`
+	TFTP  tftp.TFTPConfig `json:"TFTP"`
+	DHCP  dhcp.DHCPConfig `json:"DHCP"`
+	HTTP  http.HTTPConfig `json:"HTTP"`
+	API   api.APIConfig   `json:"API"`
+	Hosts []host.Host     `json:"Hosts"`
+	// Boot declares the boot profiles assigned to the hosts.
+	Boot profile.BootConfig `json:"Boot"`
+
+	// Store keeps the leases, the hosts and the lease history. It replaces
+	// DHCP.LeaseFile.
+	Store store.StoreConfig `json:"Store"`
+
+	// ShutdownTimeout is how many seconds work in progress may take to
+	// finish on SIGTERM or SIGINT.
+	ShutdownTimeout int `json:"ShutdownTimeout"`
 }
 
-var logger *slog.Logger
+const defaultShutdownTimeout = 30 * time.Second
+
+var logger = slog.New(slog.NewJSONHandler(os.Stdout, nil))
 var conf config
+var confFile string
+
+type daemon struct {
+	fname string
+	mu    sync.Mutex
+	conf  config
+	svcs  []Service
+	store store.Store
+
+	// hosts and profiles are shared by the services.
+	hosts    *host.Registry
+	profiles *profile.Registry
+}
+
+func newDaemon(fname string, c config) *daemon {
+	return &daemon{fname: fname, conf: c, hosts: host.NewRegistry(), profiles: profile.NewRegistry()}
+}
 
 func Main() {
-	logger = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		os.Exit(runCommand(os.Args[1], os.Args[2:], os.Stdout))
+	}
 
 	if err := setup(); err != nil {
 		logger.Error(err.Error(), "module", "TAO")
 		os.Exit(1)
 	}
 
-	if err := tftp.Listen(conf.TFTP); err != nil {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	d := newDaemon(confFile, conf)
+	if err := d.run(ctx); err != nil {
 		logger.Error(err.Error(), "module", "TAO")
 		os.Exit(1)
 	}
-	logger.Info("TFTP is listening at "+conf.TFTP.Address+conf.TFTP.SrvDir, "module", "TAO")
+	logger.Info("TAO stopped", "module", "TAO")
+}
 
-	if err := dhcp.Listen(conf.DHCP); err != nil {
-		logger.Error(err.Error(), "module", "TAO")
-		os.Exit(1)
+// run starts the enabled services, reloads the config file on SIGHUP and
+// stops the services when ctx is done.
+func (d *daemon) run(ctx context.Context) error {
+	if err := d.hosts.Set(d.conf.Hosts); err != nil {
+		return err
 	}
-	logger.Info("DHCP is listening at "+conf.DHCP.Address, "module", "TAO")
-
-	if err := http.Listen(conf.HTTP); err != nil {
-		logger.Error(err.Error(), "module", "TAO")
-		os.Exit(1)
+	if err := d.profiles.Set(d.conf.Boot); err != nil {
+		return err
+	}
+	st, err := store.Open(d.conf.Store)
+	if err != nil {
+		return err
+	}
+	inv := inventory.New(d.hosts)
+	if st != nil {
+		defer st.Close()
+		if err := keepHosts(st, d.hosts); err != nil {
+			return err
+		}
+		if err := keepMachines(st, inv); err != nil {
+			return err
+		}
 	}
-	logger.Info("HTTP is listening at "+conf.HTTP.Address+conf.HTTP.SrvDir, "module", "TAO")
 
+	svcs, err := services(d.conf, d.reload, st, d.hosts, d.profiles, inv)
+	if err != nil {
+		return err
+	}
+	d.svcs = svcs
+	if len(d.svcs) == 0 {
+		return errors.New("no service is enabled")
+	}
+	for i, svc := range d.svcs {
+		if err := svc.Start(ctx); err != nil {
+			shutdown(d.svcs[:i], d.conf.ShutdownTimeout)
+			return errors.New(svc.Name() + " failed to start: " + err.Error())
+		}
+		logger.Info(svc.Name()+" is started", "module", "TAO")
+	}
 	logger.Info("TAO start successfully", "module", "TAO")
 
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
 	for {
-		time.Sleep(24 * time.Hour)
+		select {
+		case <-hup:
+			d.reload()
+		case <-ctx.Done():
+			logger.Info("TAO is shutting down", "module", "TAO")
+			d.mu.Lock()
+			timeout := d.conf.ShutdownTimeout
+			d.mu.Unlock()
+			return shutdown(d.svcs, timeout)
+		}
+	}
+}
+
+// reload applies the config file to the running services. Nothing is
+// applied unless every service accepts the new config.
+func (d *daemon) reload() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	err := d.apply()
+	if err != nil {
+		logger.Error("TAO config is not reloaded: "+err.Error(), "module", "TAO", "file", d.fname)
+		return err
 	}
+	logger.Info("TAO config is reloaded", "module", "TAO", "file", d.fname)
+	return nil
+}
+
+func (d *daemon) apply() error {
+	next, err := load(d.fname)
+	if err != nil {
+		return err
+	}
+	if err := enabled(d.conf, next); err != nil {
+		return err
+	}
+
+	if d.conf.Store != next.Store {
+		return cfg.Errorf("Store", "cannot be changed without a restart")
+	}
+
+	// The hosts and profiles are both checked before either is replaced.
+	errs := []error{cfg.Prefix("Hosts", host.Validate(next.Hosts)), cfg.Prefix("Boot", next.Boot.Validate())}
+	var applies []func()
+	for _, svc := range d.svcs {
+		apply, err := svc.Reload(next)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		applies = append(applies, apply)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	if err := d.hosts.Set(next.Hosts); err != nil {
+		return err
+	}
+	if err := d.profiles.Set(next.Boot); err != nil {
+		return err
+	}
+	for _, apply := range applies {
+		apply()
+	}
+	d.conf = next
+	return nil
+}
+
+// enabled rejects enabling or disabling a service, which needs a restart.
+func enabled(cur config, next config) error {
+	var errs []error
+	for _, s := range []struct {
+		name string
+		cur  bool
+		next bool
+	}{
+		{"TFTP", cur.TFTP.IsEnable, next.TFTP.IsEnable},
+		{"DHCP", cur.DHCP.IsEnable, next.DHCP.IsEnable},
+		{"HTTP", cur.HTTP.IsEnable, next.HTTP.IsEnable},
+		{"API", cur.API.IsEnable, next.API.IsEnable},
+	} {
+		if s.cur != s.next {
+			errs = append(errs, cfg.Errorf(s.name+".IsEnable", "cannot be changed without a restart"))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// keepHosts restores the hosts saved in st into hosts and saves them on
+// each change.
+func keepHosts(st store.Store, hosts *host.Registry) error {
+	entries, err := store.LoadHosts(st)
+	if err != nil {
+		return cfg.Prefix("Store", err)
+	}
+	hosts.Restore(entries)
+
+	var mu sync.Mutex
+	hosts.OnChange(func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if err := store.SaveHosts(st, hosts.Entries()); err != nil {
+			logger.Error("hosts are not saved: "+err.Error(), "module", "TAO")
+		}
+	})
+	return nil
+}
+
+// keepMachines restores the machines saved in st and saves them on each
+// change.
+func keepMachines(st store.Store, inv *inventory.Inventory) error {
+	machines, err := store.LoadMachines(st)
+	if err != nil {
+		return cfg.Prefix("Store", err)
+	}
+	inv.Restore(machines)
+
+	var mu sync.Mutex
+	inv.OnChange(func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if err := store.SaveMachines(st, inv.Machines()); err != nil {
+			logger.Error("machines are not saved: "+err.Error(), "module", "TAO")
+		}
+	})
+	return nil
+}
+
+// shutdown stops svcs in the reverse order they started.
+func shutdown(svcs []Service, timeout int) error {
+	d := defaultShutdownTimeout
+	if timeout > 0 {
+		d = time.Duration(timeout) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+
+	var errs []error
+	for i := len(svcs) - 1; i >= 0; i-- {
+		if err := svcs[i].Stop(ctx); err != nil {
+			errs = append(errs, errors.New(svcs[i].Name()+" failed to stop: "+err.Error()))
+			continue
+		}
+		logger.Info(svcs[i].Name()+" is stopped", "module", "TAO")
+	}
+	return errors.Join(errs...)
 }
 
 func setup() error {
-	fname := flag.String("conf", "/etc/tao/tao.conf", "config file")
+	fname := flag.String("conf", defaultConf, "config file")
 	flag.Parse()
 
-	jsonFile, err := os.Open(*fname)
+	var err error
+	confFile = *fname
+	conf, err = load(confFile)
+	return err
+}
+
+// load reads and validates the config file.
+func load(fname string) (config, error) {
+	c, err := decode(fname)
 	if err != nil {
-		return err
+		return c, err
+	}
+	if err := validate(c); err != nil {
+		return c, err
+	}
+	return c, nil
+}
+
+func decode(fname string) (config, error) {
+	var c config
+	jsonFile, err := os.Open(fname)
+	if err != nil {
+		return c, err
 	}
 	defer jsonFile.Close()
 	jsonData, err := io.ReadAll(jsonFile)
 	if err != nil {
-		return err
+		return c, err
+	}
+	if err := cfg.Decode(jsonData, &c); err != nil {
+		return c, errors.New(fname + ": " + err.Error())
 	}
-	return json.Unmarshal(jsonData, &conf)
+	return c, nil
 }
@@ -0,0 +1,118 @@
+package tao
+
+import (
+	"errors"
+	"net"
+	"strconv"
+
+	cfg "github.com/callus-corn/tao/internal/config"
+	"github.com/callus-corn/tao/internal/host"
+)
+
+type listener struct {
+	path    string
+	network string
+	address string
+}
+
+// validate checks the enabled services and the settings between them.
+func validate(c config) error {
+	var errs []error
+	if c.TFTP.IsEnable {
+		errs = append(errs, cfg.Prefix("TFTP", c.TFTP.Validate()))
+	}
+	if c.DHCP.IsEnable {
+		errs = append(errs, cfg.Prefix("DHCP", c.DHCP.Validate()))
+	}
+	if c.HTTP.IsEnable {
+		errs = append(errs, cfg.Prefix("HTTP", c.HTTP.Validate()))
+	}
+	if c.API.IsEnable {
+		errs = append(errs, cfg.Prefix("API", c.API.Validate()))
+	}
+	errs = append(errs, cfg.Prefix("Hosts", host.Validate(c.Hosts)))
+	errs = append(errs, cfg.Prefix("Boot", c.Boot.Validate()))
+	for i, h := range c.Hosts {
+		if _, ok := c.Boot.Profiles[h.Profile]; h.Profile != "" && !ok {
+			errs = append(errs, cfg.Errorf("Hosts["+strconv.Itoa(i)+"].Profile", "unknown profile %q", h.Profile))
+		}
+	}
+	errs = append(errs, cfg.Prefix("Store", c.Store.Validate()))
+	if c.Store.Backend != "" && c.DHCP.IsEnable && c.DHCP.LeaseFile != "" {
+		errs = append(errs, cfg.Errorf("DHCP.LeaseFile", "must be empty when Store is configured"))
+	}
+	if c.ShutdownTimeout < 0 {
+		errs = append(errs, cfg.Errorf("ShutdownTimeout", "must not be negative"))
+	}
+	errs = append(errs, subnet(c)...)
+	errs = append(errs, conflicts(listeners(c))...)
+	return errors.Join(errs...)
+}
+
+// subnet checks that reservations are inside the subnet served by DHCP.
+func subnet(c config) []error {
+	if !c.DHCP.IsEnable {
+		return nil
+	}
+	_, ipnet, err := net.ParseCIDR(c.DHCP.RangeStart)
+	if err != nil {
+		return nil
+	}
+	var errs []error
+	for i, h := range c.Hosts {
+		ip := net.ParseIP(h.IP)
+		if ip != nil && !ipnet.Contains(ip) {
+			errs = append(errs, cfg.Errorf("Hosts["+strconv.Itoa(i)+"].IP", "%s is not inside subnet %s of DHCP.RangeStart", h.IP, ipnet))
+		}
+	}
+	return errs
+}
+
+func listeners(c config) []listener {
+	var ls []listener
+	if c.TFTP.IsEnable {
+		ls = append(ls, listener{"TFTP.Address", "udp", c.TFTP.Address})
+	}
+	if c.DHCP.IsEnable {
+		ls = append(ls, listener{"DHCP.Address", "udp", c.DHCP.Address})
+	}
+	if c.HTTP.IsEnable && c.HTTP.Address != "" {
+		ls = append(ls, listener{"HTTP.Address", "tcp", c.HTTP.Address})
+	}
+	if c.HTTP.IsEnable && c.HTTP.TLSAddress != "" {
+		ls = append(ls, listener{"HTTP.TLSAddress", "tcp", c.HTTP.TLSAddress})
+	}
+	if c.API.IsEnable {
+		ls = append(ls, listener{"API.Address", "tcp", c.API.Address})
+	}
+	return ls
+}
+
+// conflicts reports listeners bound to the same port of the same address.
+func conflicts(ls []listener) []error {
+	var errs []error
+	for i, a := range ls {
+		for _, b := range ls[:i] {
+			if a.network != b.network {
+				continue
+			}
+			ahost, aport, err := net.SplitHostPort(a.address)
+			if err != nil || aport == "0" {
+				continue
+			}
+			bhost, bport, err := net.SplitHostPort(b.address)
+			if err != nil || aport != bport {
+				continue
+			}
+			if ahost == bhost || wildcard(ahost) || wildcard(bhost) {
+				errs = append(errs, cfg.Errorf(a.path, "%s port %s is also used by %s", a.network, aport, b.path))
+			}
+		}
+	}
+	return errs
+}
+
+func wildcard(h string) bool {
+	ip := net.ParseIP(h)
+	return h == "" || (ip != nil && ip.IsUnspecified())
+}
@@ -0,0 +1,123 @@
+package tao
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/callus-corn/tao/internal/api"
+	"github.com/callus-corn/tao/internal/dhcp"
+	"github.com/callus-corn/tao/internal/host"
+	"github.com/callus-corn/tao/internal/http"
+	"github.com/callus-corn/tao/internal/tftp"
+)
+
+func validConfig(dir string) config {
+	return config{
+		TFTP: tftp.TFTPConfig{IsEnable: true, Address: ":69", SrvDir: dir},
+		DHCP: dhcp.DHCPConfig{IsEnable: true, Address: ":67", FileName: "boot.efi", RangeStart: "10.0.1.2/16", DefaultRouter: "10.0.0.1", DNS: "8.8.8.8"},
+		HTTP: http.HTTPConfig{IsEnable: true, Address: ":80", SrvDir: dir},
+		API:  api.APIConfig{IsEnable: true, Address: "127.0.0.1:8080", Token: "secret"},
+		Hosts: []host.Host{
+			{MAC: "aa:bb:cc:dd:ee:01", IP: "10.0.1.10"},
+		},
+	}
+}
+
+func TestValidate(t *testing.T) {
+	dir := t.TempDir()
+	if err := validate(validConfig(dir)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		change func(c *config)
+		wants  string
+	}{
+		{
+			name:   "invalid CIDR",
+			change: func(c *config) { c.DHCP.RangeStart = "10.0.1.2" },
+			wants:  "DHCP.RangeStart: ",
+		},
+		{
+			name:   "range outside subnet",
+			change: func(c *config) { c.DHCP.RangeStart = "10.0.1.130/25" },
+			wants:  "DHCP.RangeStart: range 10.0.1.0/24 is not inside subnet 10.0.1.128/25",
+		},
+		{
+			name:   "range end before start",
+			change: func(c *config) { c.DHCP.RangeEnd = "10.0.1.1" },
+			wants:  "DHCP.RangeEnd: 10.0.1.1 is not between 10.0.1.2 and the end of its /24",
+		},
+		{
+			name:   "router outside subnet",
+			change: func(c *config) { c.DHCP.DefaultRouter = "192.168.0.1" },
+			wants:  "DHCP.DefaultRouter: 192.168.0.1 is not inside subnet 10.0.0.0/16",
+		},
+		{
+			name:   "invalid router",
+			change: func(c *config) { c.DHCP.DefaultRouter = "10.0.0" },
+			wants:  "DHCP.DefaultRouter: invalid IPv4 address",
+		},
+		{
+			name:   "unknown store",
+			change: func(c *config) { c.Store.Backend = "sqlite" },
+			wants:  "Store.Backend: must be memory, file or bbolt",
+		},
+		{
+			name: "lease file with store",
+			change: func(c *config) {
+				c.Store.Backend = "memory"
+				c.DHCP.LeaseFile = dir + "/leases.json"
+			},
+			wants: "DHCP.LeaseFile: must be empty when Store is configured",
+		},
+		{
+			name:   "missing SrvDir",
+			change: func(c *config) { c.TFTP.SrvDir = dir + "/missing" },
+			wants:  "TFTP.SrvDir: ",
+		},
+		{
+			name:   "port conflict",
+			change: func(c *config) { c.API.Address = "127.0.0.1:80" },
+			wants:  "API.Address: tcp port 80 is also used by HTTP.Address",
+		},
+		{
+			name:   "reservation outside subnet",
+			change: func(c *config) { c.Hosts[0].IP = "10.1.0.10" },
+			wants:  "Hosts[0].IP: 10.1.0.10 is not inside subnet",
+		},
+		{
+			name:   "duplicate reservation",
+			change: func(c *config) { c.Hosts = append(c.Hosts, host.Host{MAC: "aa:bb:cc:dd:ee:02", IP: "10.0.1.10"}) },
+			wants:  "Hosts[1].IP: IP address 10.0.1.10 is reserved by aa:bb:cc:dd:ee:01",
+		},
+		{
+			name:   "unknown host profile",
+			change: func(c *config) { c.Hosts[0].Profile = "rocky-9" },
+			wants:  `Hosts[0].Profile: unknown profile "rocky-9"`,
+		},
+		{
+			name:   "missing token",
+			change: func(c *config) { c.API.Token = "" },
+			wants:  "API.Token: ",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := validConfig(dir)
+			tt.change(&c)
+			err := validate(c)
+			if err == nil || !strings.Contains(err.Error(), tt.wants) {
+				t.Fatalf("got %v, wants %q", err, tt.wants)
+			}
+		})
+	}
+
+	c := validConfig(dir)
+	c.TFTP = tftp.TFTPConfig{SrvDir: dir + "/missing"}
+	if err := validate(c); err != nil {
+		t.Fatalf("disabled TFTP is validated: %v", err)
+	}
+}
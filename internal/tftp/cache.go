@@ -0,0 +1,103 @@
+package tftp
+
+import (
+	"container/list"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+type cache struct {
+	mu      sync.Mutex
+	budget  int64
+	used    int64
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type cacheKey struct {
+	path    string
+	modTime time.Time
+	size    int64
+}
+
+type cacheEntry struct {
+	key   cacheKey
+	data  []byte
+	err   error
+	ready chan struct{}
+}
+
+func newCache(budget int64) *cache {
+	if budget <= 0 {
+		return nil
+	}
+	return &cache{
+		budget:  budget,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// get returns the content of path as described by info. Concurrent callers
+// asking for the same version of a file share one load and one copy.
+func (c *cache) get(path string, info os.FileInfo) ([]byte, bool) {
+	if c == nil || info.Size() > c.budget {
+		return nil, false
+	}
+	key := cacheKey{path, info.ModTime(), info.Size()}
+
+	c.mu.Lock()
+	if elem, ok := c.entries[path]; ok {
+		entry := elem.Value.(*cacheEntry)
+		if entry.key == key {
+			c.lru.MoveToFront(elem)
+			c.mu.Unlock()
+			<-entry.ready
+			return entry.data, entry.err == nil
+		}
+		c.remove(elem)
+	}
+	entry := &cacheEntry{key: key, ready: make(chan struct{})}
+	c.entries[path] = c.lru.PushFront(entry)
+	c.used += key.size
+	for c.used > c.budget {
+		c.remove(c.lru.Back())
+	}
+	c.mu.Unlock()
+
+	entry.data, entry.err = load(key)
+	close(entry.ready)
+	if entry.err != nil {
+		logger.Error(entry.err.Error(), "module", "TFTP")
+		c.mu.Lock()
+		if elem, ok := c.entries[path]; ok && elem.Value == entry {
+			c.remove(elem)
+		}
+		c.mu.Unlock()
+		return nil, false
+	}
+	return entry.data, true
+}
+
+func (c *cache) remove(elem *list.Element) {
+	entry := elem.Value.(*cacheEntry)
+	c.lru.Remove(elem)
+	delete(c.entries, entry.key.path)
+	c.used -= entry.key.size
+}
+
+func load(key cacheKey) ([]byte, error) {
+	file, err := os.Open(key.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	data := make([]byte, key.size)
+	if _, err := io.ReadFull(file, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
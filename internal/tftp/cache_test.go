@@ -0,0 +1,153 @@
+package tftp
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCacheShare(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, fname)
+	wants := bytes.Repeat([]byte("bootx64"), 1000)
+	if err := os.WriteFile(path, wants, 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := newCache(1 << 20)
+	got := make([][]byte, 16)
+	var wg sync.WaitGroup
+	for i := range got {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data, ok := c.get(path, info)
+			if !ok {
+				t.Error("cache miss")
+			}
+			got[i] = data
+		}()
+	}
+	wg.Wait()
+
+	for _, data := range got {
+		if !bytes.Equal(data, wants) {
+			t.Fatal("cached data is broken")
+		}
+		if &data[0] != &got[0][0] {
+			t.Fatal("cached data is not shared")
+		}
+	}
+	if c.lru.Len() != 1 || c.used != int64(len(wants)) {
+		t.Fatalf("cache has %d entries and %d bytes", c.lru.Len(), c.used)
+	}
+}
+
+func TestCacheInvalidate(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, fname)
+	if err := os.WriteFile(path, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := newCache(1 << 20)
+	if data, _ := c.get(path, info); string(data) != "old" {
+		t.Fatalf("got %q", data)
+	}
+
+	if err := os.WriteFile(path, []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mtime := info.ModTime().Add(time.Second)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	info, err = os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := c.get(path, info); string(data) != "new" {
+		t.Fatalf("got %q", data)
+	}
+	if c.lru.Len() != 1 {
+		t.Fatalf("cache has %d entries", c.lru.Len())
+	}
+}
+
+func TestCacheBudget(t *testing.T) {
+	dir := t.TempDir()
+	c := newCache(250)
+
+	stat := func(name string, size int) os.FileInfo {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info
+	}
+	a := stat("a", 100)
+	b := stat("b", 100)
+	d := stat("d", 100)
+	large := stat("large", 251)
+
+	c.get(filepath.Join(dir, "a"), a)
+	c.get(filepath.Join(dir, "b"), b)
+	c.get(filepath.Join(dir, "a"), a)
+	c.get(filepath.Join(dir, "d"), d)
+	if _, ok := c.entries[filepath.Join(dir, "b")]; ok {
+		t.Fatal("least recently used entry is not evicted")
+	}
+	if _, ok := c.entries[filepath.Join(dir, "a")]; !ok {
+		t.Fatal("recently used entry is evicted")
+	}
+	if c.used > c.budget {
+		t.Fatalf("cache uses %d bytes over budget %d", c.used, c.budget)
+	}
+	if _, ok := c.get(filepath.Join(dir, "large"), large); ok {
+		t.Fatal("file over budget is cached")
+	}
+
+	disabled := newCache(0)
+	if _, ok := disabled.get(filepath.Join(dir, "a"), a); ok {
+		t.Fatal("disabled cache hits")
+	}
+}
+
+func TestTFTPCached(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	s := newServer(NewDirProvider(dir, 1<<20))
+	wants := bytes.Repeat([]byte("vmlinuz\n"), 10000)
+	if err := os.WriteFile(filepath.Join(dir, fname), wants, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	addr := listen(t, s)
+	for range 2 {
+		got, err := getFile(addr, testCase{name: "cached", bytes: len(wants)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, wants) {
+			t.Fatal("Fail at cached transfer")
+		}
+	}
+	if files := s.provider.(*dirProvider).files; files.lru.Len() != 1 {
+		t.Fatalf("cache has %d entries", files.lru.Len())
+	}
+}
@@ -0,0 +1,364 @@
+package tftp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client gets files from and puts files to the TFTP server at Addr. Blksize
+// and Windowsize are requested as options when they are set.
+type Client struct {
+	Addr       string
+	Mode       string
+	Blksize    int
+	Windowsize int
+	Timeout    time.Duration
+	Retries    int
+}
+
+// Error is an ERROR packet sent by the server.
+type Error struct {
+	Code    byte
+	Message string
+}
+
+type transfer struct {
+	client *Client
+	conn   net.PacketConn
+	peer   net.Addr
+	tid    bool
+	// last holds the packets sent again on a timeout.
+	last    [][]byte
+	rx      []byte
+	blksize int
+	window  int
+	tsize   int64
+}
+
+const opcWRQ = 2
+const unknownTransferID = 5
+const optWindowsize = "windowsize"
+
+// NewClient returns a client of the server at addr, such as "10.0.0.1:69",
+// transferring in octet mode.
+func NewClient(addr string) *Client {
+	return &Client{
+		Addr:    addr,
+		Mode:    modeOctet,
+		Timeout: 5 * time.Second,
+		Retries: 5,
+	}
+}
+
+// Error returns the code and the message of the packet.
+func (e *Error) Error() string {
+	return "TFTP error code " + strconv.Itoa(int(e.Code)) + ": " + e.Message
+}
+
+// Get reads filename from the server into w and returns the number of
+// bytes written. In netascii mode, CR LF and CR NUL received are written as
+// LF and CR.
+func (c *Client) Get(filename string, w io.Writer) (int64, error) {
+	t, err := c.dial()
+	if err != nil {
+		return 0, err
+	}
+	defer t.conn.Close()
+
+	var nw *netasciiWriter
+	if strings.ToLower(c.Mode) == modeNetascii {
+		nw = &netasciiWriter{w: w}
+		w = nw
+	}
+
+	p, err := t.exchange(c.request(opcRRQ, filename, true))
+	if err != nil {
+		return 0, err
+	}
+	if p[1] == opcOACK {
+		if err := t.negotiate(p); err != nil {
+			return 0, err
+		}
+		if p, err = t.exchange(newACK(0)); err != nil {
+			return 0, err
+		}
+	}
+
+	total := int64(0)
+	expected := 1
+	count := 0
+	for {
+		if len(p) < 4 || p[1] != opcDATA {
+			return total, t.abort(illegalTFTPOperation, "unexpected packet")
+		}
+		block := blockNumber(p)
+		if block == expected || (expected == 0 && block == 1) {
+			data := p[4:]
+			if _, err := w.Write(data); err != nil {
+				return total, t.abort(notDefined, err.Error())
+			}
+			total += int64(len(data))
+			count++
+			expected = (block + 1) % blockMax
+			if len(data) < t.blksize {
+				t.send(newACK(block))
+				if nw != nil {
+					err := nw.flush()
+					return nw.written, err
+				}
+				return total, nil
+			}
+			if count >= t.window {
+				t.send(newACK(block))
+				count = 0
+			}
+		} else {
+			t.send(newACK((expected + blockMax - 1) % blockMax))
+			count = 0
+		}
+		if p, err = t.receive(); err != nil {
+			return total, err
+		}
+	}
+}
+
+// Put writes the content of r to filename on the server and returns the
+// number of bytes read from r.
+func (c *Client) Put(filename string, r io.Reader) (int64, error) {
+	t, err := c.dial()
+	if err != nil {
+		return 0, err
+	}
+	defer t.conn.Close()
+
+	if strings.ToLower(c.Mode) == modeNetascii {
+		r = newNetascii(r)
+	}
+
+	p, err := t.exchange(c.request(opcWRQ, filename, false))
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case p[1] == opcOACK:
+		if err := t.negotiate(p); err != nil {
+			return 0, err
+		}
+	case len(p) < 4 || p[1] != opcACK || blockNumber(p) != 0:
+		return 0, t.abort(illegalTFTPOperation, "unexpected packet")
+	}
+
+	total := int64(0)
+	next := 1
+	// pending holds the blocks not acknowledged yet, of which the first sent
+	// have been sent once. A timeout sends them all again, while ACKs of
+	// other blocks are ignored not to send blocks twice.
+	var pending [][]byte
+	sent := 0
+	done := false
+	for {
+		for !done && len(pending) < t.window {
+			data := make([]byte, 4+t.blksize)
+			n, err := io.ReadFull(r, data[4:])
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return total, t.abort(notDefined, err.Error())
+			}
+			data[0], data[1], data[2], data[3] = 0, opcDATA, byte(next>>8), byte(next)
+			pending = append(pending, data[:4+n])
+			total += int64(n)
+			next = (next + 1) % blockMax
+			done = n < t.blksize
+		}
+		if len(pending) == 0 {
+			return total, nil
+		}
+
+		for _, data := range pending[sent:] {
+			t.conn.WriteTo(data, t.peer)
+		}
+		sent = len(pending)
+		t.last = pending
+		p, err := t.receive()
+		if err != nil {
+			return total, err
+		}
+		if len(p) < 4 || p[1] != opcACK {
+			return total, t.abort(illegalTFTPOperation, "unexpected packet")
+		}
+		for i, data := range pending {
+			if blockNumber(data) == blockNumber(p) {
+				pending = pending[i+1:]
+				sent -= i + 1
+				break
+			}
+		}
+	}
+}
+
+// Size asks the server for the size of filename with the tsize option
+// without transferring it.
+func (c *Client) Size(filename string) (int64, error) {
+	t, err := c.dial()
+	if err != nil {
+		return 0, err
+	}
+	defer t.conn.Close()
+
+	p, err := t.exchange(c.request(opcRRQ, filename, true))
+	if err != nil {
+		return 0, err
+	}
+	if p[1] != opcOACK {
+		t.abort(requestHasBeenDeniend, "tsize is not acknowledged")
+		return 0, errors.New("server does not support tsize")
+	}
+	if err := t.negotiate(p); err != nil {
+		return 0, err
+	}
+	t.abort(notDefined, "transfer size is received")
+	if t.tsize < 0 {
+		return 0, errors.New("server does not support tsize")
+	}
+	return t.tsize, nil
+}
+
+func (c *Client) dial() (*transfer, error) {
+	peer, err := net.ResolveUDPAddr("udp", c.Addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		return nil, err
+	}
+	return &transfer{
+		client:  c,
+		conn:    conn,
+		peer:    peer,
+		rx:      make([]byte, udpMax),
+		blksize: 512,
+		window:  1,
+		tsize:   -1,
+	}, nil
+}
+
+func (c *Client) request(opc byte, filename string, read bool) []byte {
+	mode := c.Mode
+	if mode == "" {
+		mode = modeOctet
+	}
+	p := []byte{0, opc}
+	p = append(p, filename...)
+	p = append(p, 0)
+	p = append(p, mode...)
+	p = append(p, 0)
+	if c.Blksize > 0 {
+		p = appendOption(p, optBlocksize, strconv.Itoa(c.Blksize))
+	}
+	if c.Windowsize > 1 {
+		p = appendOption(p, optWindowsize, strconv.Itoa(c.Windowsize))
+	}
+	if read {
+		p = appendOption(p, optTransfersize, "0")
+	}
+	return p
+}
+
+func (t *transfer) negotiate(p []byte) error {
+	fields := bytes.Split(p[2:], []byte{0})
+	for i := 0; i+1 < len(fields); i += 2 {
+		k := strings.ToLower(string(fields[i]))
+		v, err := strconv.Atoi(string(fields[i+1]))
+		if err != nil {
+			return t.abort(requestHasBeenDeniend, "invalid option "+k)
+		}
+		switch k {
+		case optBlocksize:
+			if v < blksizeMin || v > blksizeMax || (t.client.Blksize > 0 && v > t.client.Blksize) {
+				return t.abort(requestHasBeenDeniend, "invalid blksize")
+			}
+			t.blksize = v
+		case optWindowsize:
+			if v < 1 || v > t.client.Windowsize {
+				return t.abort(requestHasBeenDeniend, "invalid windowsize")
+			}
+			t.window = v
+		case optTransfersize:
+			t.tsize = int64(v)
+		}
+	}
+	return nil
+}
+
+func (t *transfer) exchange(p []byte) ([]byte, error) {
+	t.send(p)
+	return t.receive()
+}
+
+func (t *transfer) send(p []byte) {
+	t.last = [][]byte{p}
+	t.conn.WriteTo(p, t.peer)
+}
+
+// receive waits for the next packet from the peer, sending the last packets
+// again on each timeout.
+func (t *transfer) receive() ([]byte, error) {
+	for retries := 0; ; {
+		t.conn.SetReadDeadline(time.Now().Add(t.client.Timeout))
+		n, from, err := t.conn.ReadFrom(t.rx)
+		if err != nil {
+			if !isTimeout(err) || retries >= t.client.Retries {
+				return nil, err
+			}
+			retries++
+			for _, p := range t.last {
+				t.conn.WriteTo(p, t.peer)
+			}
+			continue
+		}
+		if t.tid && isClient(from, t.peer) != nil {
+			t.conn.WriteTo(newError(unknownTransferID, "unknown transfer ID"), from)
+			continue
+		}
+		if n < 2 {
+			continue
+		}
+		if !t.tid {
+			t.peer = from
+			t.tid = true
+		}
+		p := t.rx[:n]
+		if p[1] == opcERROR {
+			e := &Error{}
+			if n >= 4 {
+				e.Code = p[3]
+				e.Message = string(bytes.Split(p[4:], []byte{0})[0])
+			}
+			return nil, e
+		}
+		return p, nil
+	}
+}
+
+func (t *transfer) abort(code byte, msg string) error {
+	t.conn.WriteTo(newError(code, msg), t.peer)
+	return errors.New(msg)
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+func newACK(block int) []byte {
+	return []byte{0, opcACK, byte(block >> 8), byte(block)}
+}
+
+func blockNumber(p []byte) int {
+	return int(p[2])<<8 + int(p[3])
+}
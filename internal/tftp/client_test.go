@@ -0,0 +1,255 @@
+package tftp
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestClientGet(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name       string
+		bytes      int
+		blksize    int
+		windowsize int
+	}{
+		{name: "0 byte file", bytes: 0},
+		{name: "512 byte file", bytes: 512},
+		{name: "100k byte file", bytes: 100 * 1000},
+		{name: "100k byte file, blksize 1468", bytes: 100 * 1000, blksize: 1468},
+		{name: "100k byte file, blksize 8", bytes: 100 * 1000, blksize: 8},
+		{name: "100k byte file, windowsize 8", bytes: 100 * 1000, windowsize: 8},
+	}
+
+	dir := t.TempDir()
+	addr := startServer(t, dir)
+	for _, tt := range tests {
+		wants := make([]byte, tt.bytes)
+		for i := range wants {
+			wants[i] = byte(rand.Int())
+		}
+		if err := os.WriteFile(filepath.Join(dir, fname), wants, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		c := NewClient(addr)
+		c.Blksize = tt.blksize
+		c.Windowsize = tt.windowsize
+		var got bytes.Buffer
+		n, err := c.Get(fname, &got)
+		if err != nil {
+			t.Fatalf("Fail at %s: %v", tt.name, err)
+		}
+		if n != int64(tt.bytes) || !bytes.Equal(got.Bytes(), wants) {
+			t.Fatal("Fail at " + tt.name)
+		}
+
+		size, err := c.Size(fname)
+		if err != nil {
+			t.Fatalf("Fail at %s: %v", tt.name, err)
+		}
+		if size != int64(tt.bytes) {
+			t.Fatalf("Fail at %s: got tsize %d", tt.name, size)
+		}
+	}
+}
+
+func TestClientNetascii(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	addr := startServer(t, dir)
+	wants := []byte("line\nbare\rcarriage return\r\nend\r")
+	if err := os.WriteFile(filepath.Join(dir, fname), wants, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewClient(addr)
+	c.Mode = modeNetascii
+	var got bytes.Buffer
+	n, err := c.Get(fname, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(wants)) || !bytes.Equal(got.Bytes(), wants) {
+		t.Fatalf("got %q, wants %q", got.Bytes(), wants)
+	}
+}
+
+func TestClientError(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	addr := startServer(t, dir)
+	c := NewClient(addr)
+
+	var e *Error
+	if _, err := c.Get("missing", &bytes.Buffer{}); !errors.As(err, &e) || e.Code != fileNotFound || e.Message != "File not found" {
+		t.Fatalf("got %v", err)
+	}
+	if _, err := c.Put(fname, bytes.NewReader([]byte("abc"))); !errors.As(err, &e) || e.Code != illegalTFTPOperation {
+		t.Fatalf("got %v", err)
+	}
+
+	c = NewClient("127.0.0.1:1")
+	c.Timeout = 10 * time.Millisecond
+	c.Retries = 1
+	if _, err := c.Get(fname, &bytes.Buffer{}); err == nil {
+		t.Fatal("unreachable server is not reported")
+	}
+}
+
+func TestClientShortPacket(t *testing.T) {
+	t.Parallel()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// The server answers every request with a packet cut after its opcode.
+	go func() {
+		rx := make([]byte, udpMax)
+		for {
+			n, client, err := conn.ReadFrom(rx)
+			if err != nil {
+				return
+			}
+			switch {
+			case n >= 2 && rx[1] == opcRRQ:
+				conn.WriteTo([]byte{0, opcDATA, 0}, client)
+			case n >= 2 && rx[1] == opcWRQ:
+				conn.WriteTo([]byte{0, opcACK}, client)
+			}
+		}
+	}()
+	c := NewClient(conn.LocalAddr().String())
+	c.Timeout = 100 * time.Millisecond
+	var e *Error
+	if _, err := c.Get(fname, &bytes.Buffer{}); errors.As(err, &e) || err == nil {
+		t.Fatalf("Get: got %v", err)
+	}
+	if _, err := c.Put(fname, bytes.NewReader([]byte("abc"))); errors.As(err, &e) || err == nil {
+		t.Fatalf("Put: got %v", err)
+	}
+}
+
+func TestClientPut(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name       string
+		bytes      int
+		windowsize int
+		ackEach    bool
+		lose       int
+	}{
+		{name: "0 byte file", bytes: 0},
+		{name: "512 byte file", bytes: 512},
+		{name: "10k byte file", bytes: 10 * 1000},
+		{name: "10k byte file, windowsize 4", bytes: 10 * 1000, windowsize: 4},
+		{name: "10k byte file, duplicate ACKs", bytes: 10 * 1000, ackEach: true},
+		{name: "10k byte file, windowsize 4, duplicate ACKs", bytes: 10 * 1000, windowsize: 4, ackEach: true},
+		{name: "10k byte file, lost block", bytes: 10 * 1000, lose: 3},
+		{name: "10k byte file, windowsize 4, lost block", bytes: 10 * 1000, windowsize: 4, ackEach: true, lose: 3},
+	}
+
+	for _, tt := range tests {
+		wants := make([]byte, tt.bytes)
+		for i := range wants {
+			wants[i] = byte(rand.Int())
+		}
+
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make(chan []byte, 1)
+		go receiveFile(conn, got, tt.ackEach, tt.lose)
+
+		c := NewClient(conn.LocalAddr().String())
+		c.Windowsize = tt.windowsize
+		c.Timeout = 50 * time.Millisecond
+		n, err := c.Put(fname, bytes.NewReader(wants))
+		if err != nil {
+			t.Fatalf("Fail at %s: %v", tt.name, err)
+		}
+		if n != int64(tt.bytes) || !bytes.Equal(<-got, wants) {
+			t.Fatal("Fail at " + tt.name)
+		}
+		conn.Close()
+	}
+}
+
+func startServer(t testing.TB, dir string) string {
+	return listen(t, newServer(NewDirProvider(dir, 0)))
+}
+
+// listen serves s on a loopback port and returns its address.
+func listen(t testing.TB, s *Server) string {
+	s.host = "127.0.0.1"
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.serve(conn)
+	return conn.LocalAddr().String()
+}
+
+// receiveFile is a minimal WRQ peer acknowledging every window of blocks,
+// or every block twice when ackEach is set. The first copy of the block lose
+// is dropped. It fails when a block it has received comes again.
+func receiveFile(conn net.PacketConn, got chan<- []byte, ackEach bool, lose int) {
+	rx := make([]byte, udpMax)
+	n, client, err := conn.ReadFrom(rx)
+	if err != nil || rx[1] != opcWRQ {
+		got <- nil
+		return
+	}
+	window := 1
+	fields := bytes.Split(rx[2:n], []byte{0})
+	if len(fields) >= 4 && string(fields[2]) == optWindowsize {
+		window = int(fields[3][0] - '0')
+		conn.WriteTo(appendOption([]byte{0, opcOACK}, optWindowsize, string(fields[3])), client)
+	} else {
+		conn.WriteTo(newACK(0), client)
+	}
+
+	var file []byte
+	expected := 1
+	for count := 0; ; {
+		n, _, err := conn.ReadFrom(rx)
+		if err != nil {
+			got <- nil
+			return
+		}
+		block := blockNumber(rx)
+		switch {
+		case block == lose:
+			lose = -1
+			continue
+		case block < expected:
+			got <- nil
+			return
+		case block > expected:
+			continue
+		}
+		file = append(file, rx[4:n]...)
+		expected++
+		count++
+		switch {
+		case n-4 < 512:
+			conn.WriteTo(newACK(block), client)
+			got <- file
+			return
+		case ackEach:
+			conn.WriteTo(newACK(block), client)
+			conn.WriteTo(newACK(block), client)
+		case count == window:
+			conn.WriteTo(newACK(block), client)
+			count = 0
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package tftp
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+type limiter struct {
+	mu        sync.Mutex
+	max       int
+	perClient int
+	total     int
+	clients   map[string]int
+}
+
+type pacer struct {
+	rate  int64
+	start time.Time
+	sent  int64
+}
+
+var errTooManySessions = errors.New("too many sessions")
+var errTooManyClientSessions = errors.New("too many sessions from client")
+
+func newLimiter(max int, perClient int) *limiter {
+	return &limiter{
+		max:       max,
+		perClient: perClient,
+		clients:   make(map[string]int),
+	}
+}
+
+// setLimits changes the limits without forgetting the sessions in progress.
+func (l *limiter) setLimits(max int, perClient int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.max = max
+	l.perClient = perClient
+}
+
+func (l *limiter) acquire(client string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.max > 0 && l.total >= l.max {
+		return errTooManySessions
+	}
+	if l.perClient > 0 && l.clients[client] >= l.perClient {
+		return errTooManyClientSessions
+	}
+	l.total++
+	l.clients[client]++
+	return nil
+}
+
+func (l *limiter) release(client string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.total--
+	l.clients[client]--
+	if l.clients[client] <= 0 {
+		delete(l.clients, client)
+	}
+}
+
+func newPacer(rate int64) *pacer {
+	return &pacer{rate: rate, start: time.Now()}
+}
+
+// wait blocks until sending n more bytes keeps the session at or below its
+// rate. A pacer with no rate never blocks.
+func (p *pacer) wait(n int) {
+	if p.rate <= 0 {
+		return
+	}
+	p.sent += int64(n)
+	due := time.Duration(float64(p.sent) / float64(p.rate) * float64(time.Second))
+	if d := due - time.Since(p.start); d > 0 {
+		time.Sleep(d)
+	}
+}
@@ -0,0 +1,217 @@
+package tftp
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	l := newLimiter(3, 2)
+
+	if err := l.acquire("10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.acquire("10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.acquire("10.0.0.1"); err != errTooManyClientSessions {
+		t.Fatalf("per client limit is not applied: %v", err)
+	}
+	if err := l.acquire("10.0.0.2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.acquire("10.0.0.3"); err != errTooManySessions {
+		t.Fatalf("global limit is not applied: %v", err)
+	}
+
+	l.release("10.0.0.1")
+	if err := l.acquire("10.0.0.3"); err != nil {
+		t.Fatal(err)
+	}
+	l.release("10.0.0.1")
+	l.release("10.0.0.2")
+	l.release("10.0.0.3")
+	if l.total != 0 || len(l.clients) != 0 {
+		t.Fatalf("limiter leaks sessions: %d %v", l.total, l.clients)
+	}
+
+	unlimited := newLimiter(0, 0)
+	for range 1000 {
+		if err := unlimited.acquire("10.0.0.1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPacer(t *testing.T) {
+	p := newPacer(100 * 1000)
+	start := time.Now()
+	for range 20 {
+		p.wait(1000)
+	}
+	if d := time.Since(start); d < 190*time.Millisecond {
+		t.Fatalf("20k bytes at 100k bytes/s took only %v", d)
+	}
+
+	// 19 GB at 1 GB/s are due 30ms from now.
+	p = &pacer{rate: 1000 * 1000 * 1000, start: time.Now().Add(-19*time.Second + 30*time.Millisecond)}
+	p.sent = 19 * 1000 * 1000 * 1000
+	start = time.Now()
+	p.wait(0)
+	if d := time.Since(start); d < 20*time.Millisecond {
+		t.Fatalf("19 GB at 1 GB/s did not wait: %v", d)
+	}
+
+	p = newPacer(0)
+	start = time.Now()
+	for range 1000 {
+		p.wait(1 << 20)
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Fatalf("unlimited pacer blocked for %v", d)
+	}
+}
+
+func TestSessionRejected(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	s := newServer(NewDirProvider(dir, 0))
+	s.host = "127.0.0.1"
+	if err := os.WriteFile(filepath.Join(dir, fname), []byte("abc"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s.sessions = newLimiter(1, 0)
+	s.sessions.acquire("192.0.2.1")
+
+	srv, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.serve(srv)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.WriteTo(newRRQ(fname, modeOctet, nil), srv.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	rx := make([]byte, udpMax)
+	n, _, err := conn.ReadFrom(rx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rx[1] != opcERROR || rx[3] != notDefined || string(rx[4:n-1]) != errorMessages[notDefined] {
+		t.Fatalf("got %q", rx[:n])
+	}
+}
+
+func TestSessionTimeout(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	s := newServer(NewDirProvider(dir, 0))
+	s.host = "127.0.0.1"
+	s.timeout = 20 * time.Millisecond
+	s.retries = 2
+	s.sessions = newLimiter(0, 1)
+	if err := os.WriteFile(filepath.Join(dir, fname), make([]byte, 10*512), 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	go s.serve(srv)
+
+	// The client receives the first block and disappears.
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.WriteTo(newRRQ(fname, modeOctet, nil), srv.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	rx := make([]byte, udpMax)
+	n, _, err := conn.ReadFrom(rx)
+	if err != nil || rx[1] != opcDATA {
+		t.Fatalf("got %q %v", rx[:n], err)
+	}
+	conn.Close()
+
+	c := NewClient(srv.LocalAddr().String())
+	var e *Error
+	if _, err := c.Get(fname, &bytes.Buffer{}); !errors.As(err, &e) {
+		t.Fatalf("the session is not held: %v", err)
+	}
+	// The session gives up after its retries and releases the slot.
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		var got bytes.Buffer
+		_, err := c.Get(fname, &got)
+		if err == nil && got.Len() == 10*512 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d bytes %v", got.Len(), err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// slowProvider blocks opening "slow" until release is closed.
+type slowProvider struct {
+	Provider
+	release chan struct{}
+}
+
+func (p slowProvider) Open(req Request) (*File, error) {
+	if req.Filename == "slow" {
+		<-p.release
+	}
+	return p.Provider.Open(req)
+}
+
+func TestSlowOpen(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, fname), []byte("abc"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan struct{})
+	defer close(release)
+	s := newServer(slowProvider{NewDirProvider(dir, 0), release})
+	s.host = "127.0.0.1"
+	srv, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	go s.serve(srv)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.WriteTo(newRRQ("slow", modeOctet, nil), srv.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Other requests are served while "slow" is being opened.
+	c := NewClient(srv.LocalAddr().String())
+	c.Timeout = 100 * time.Millisecond
+	c.Retries = 1
+	var got bytes.Buffer
+	if _, err := c.Get(fname, &got); err != nil || got.String() != "abc" {
+		t.Fatalf("got %q %v", got.String(), err)
+	}
+}
@@ -0,0 +1,251 @@
+package tftp
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type multicast struct {
+	server   *Server
+	mu       sync.Mutex
+	conn     net.PacketConn
+	group    *net.UDPAddr
+	file     *File
+	filename string
+	blksize  int
+	blocks   int
+	clients  []net.Addr
+	last     []byte
+	lastTo   net.Addr
+	pacer    *pacer
+	sent     int64
+	started  time.Time
+}
+
+const multicastTimeout = time.Second
+const multicastRetries = 5
+
+// joinMulticast adds client to the RFC 2090 session serving the same file,
+// starting one if there is none. The first client of a session is its
+// master client.
+func (s *Server) joinMulticast(client net.Addr, t *tftp) error {
+	s.mu.RLock()
+	group, rateLimit := s.multicastGroup, s.rateLimit
+	s.mu.RUnlock()
+	if group == nil {
+		return errors.New("multicast is disabled")
+	}
+	if t.mode != modeOctet {
+		return errors.New("multicast supports only octet mode")
+	}
+	blksize, err := t.blockSize()
+	if err != nil {
+		return err
+	}
+	blocks := int(t.file.Size/int64(blksize)) + 1
+	if blocks >= blockMax {
+		return errors.New("file is too large for multicast")
+	}
+
+	s.multicastMu.Lock()
+	defer s.multicastMu.Unlock()
+
+	m, ok := s.multicasts[t.file.Name]
+	if ok && m.blksize != blksize {
+		return errors.New("multicast session uses blksize " + strconv.Itoa(m.blksize))
+	}
+	if ok {
+		t.close()
+	} else {
+		conn, err := net.ListenPacket("udp", s.host+":0")
+		if err != nil {
+			return err
+		}
+		m = &multicast{
+			server:   s,
+			conn:     conn,
+			group:    s.nextGroup(group),
+			file:     t.file,
+			filename: t.filename,
+			blksize:  blksize,
+			blocks:   blocks,
+			pacer:    newPacer(rateLimit),
+			started:  time.Now(),
+		}
+		s.multicasts[t.file.Name] = m
+		logger.Info("TFTP multicast session start", "module", "TFTP", "filename", t.file.Name, "group", m.group.String())
+		s.running.Add(1)
+		go m.run()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	master := len(m.clients) == 0
+	m.clients = append(m.clients, client)
+
+	tx := make([]byte, udpMax)
+	n, err := t.oack(tx)
+	if err != nil {
+		return err
+	}
+	oack := appendOption(tx[:n], optMulticast, m.option(master))
+	m.conn.WriteTo(oack, client)
+	if master {
+		m.last = oack
+		m.lastTo = client
+	}
+	logger.Info("TFTP multicast client join", "module", "TFTP", "address", client.String(), "master", master)
+	return nil
+}
+
+// nextGroup returns the first address from base not used by a session.
+func (s *Server) nextGroup(base *net.UDPAddr) *net.UDPAddr {
+	for port := base.Port; ; port++ {
+		used := false
+		for _, m := range s.multicasts {
+			used = used || m.group.Port == port
+		}
+		if !used {
+			return &net.UDPAddr{IP: base.IP, Port: port}
+		}
+	}
+}
+
+func (m *multicast) option(master bool) string {
+	mc := "0"
+	if master {
+		mc = "1"
+	}
+	return m.group.IP.String() + "," + strconv.Itoa(m.group.Port) + "," + mc
+}
+
+func (m *multicast) run() {
+	defer m.server.running.Done()
+	defer m.close()
+
+	rx := make([]byte, udpMax)
+	retries := 0
+	for {
+		m.conn.SetReadDeadline(time.Now().Add(multicastTimeout))
+		n, from, err := m.conn.ReadFrom(rx)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			m.mu.Lock()
+			if retries < multicastRetries {
+				retries++
+				m.conn.WriteTo(m.last, m.lastTo)
+			} else if len(m.clients) > 0 {
+				logger.Error("TFTP multicast master client timeout", "module", "TFTP", "address", m.clients[0].String())
+				retries = 0
+				m.remove(0)
+			}
+			m.mu.Unlock()
+			if m.finished() {
+				return
+			}
+			continue
+		}
+
+		m.mu.Lock()
+		i := m.index(from)
+		switch {
+		case i < 0 || n < 4:
+		case rx[1] == opcERROR:
+			logger.Error(isERROR(rx[:n]).Error(), "module", "TFTP", "address", from.String())
+			m.remove(i)
+		case i > 0 || rx[1] != opcACK:
+		default:
+			retries = 0
+			block := int(rx[2])<<8 + int(rx[3])
+			if block >= m.blocks {
+				logger.Info("TFTP multicast client done", "module", "TFTP", "address", from.String())
+				m.server.emit(from, m.filename)
+				m.remove(0)
+				break
+			}
+			if err := m.send(block + 1); err != nil {
+				logger.Error(err.Error(), "module", "TFTP")
+				m.conn.WriteTo(errorPacket(accessviolation), from)
+				m.remove(0)
+			}
+		}
+		m.mu.Unlock()
+		if m.finished() {
+			return
+		}
+	}
+}
+
+func (m *multicast) send(block int) error {
+	offset := int64(block-1) * int64(m.blksize)
+	size := min(int64(m.blksize), m.file.Size-offset)
+	p := make([]byte, 4+size)
+	p[0], p[1], p[2], p[3] = 0, opcDATA, byte(block>>8), byte(block)
+	if _, err := m.file.Content.ReadAt(p[4:], offset); err != nil && size > 0 {
+		return err
+	}
+	m.pacer.wait(len(p))
+	m.sent = offset + size
+	m.last = p
+	m.lastTo = m.group
+	_, err := m.conn.WriteTo(p, m.group)
+	return err
+}
+
+// remove drops the i-th client. When the master client leaves, the next
+// client is told by an OACK that it is the master now.
+func (m *multicast) remove(i int) {
+	m.server.sessions.release(clientIP(m.clients[i]))
+	m.clients = append(m.clients[:i], m.clients[i+1:]...)
+	if i != 0 || len(m.clients) == 0 {
+		return
+	}
+	oack := appendOption([]byte{0, opcOACK}, optMulticast, m.option(true))
+	m.conn.WriteTo(oack, m.clients[0])
+	m.last = oack
+	m.lastTo = m.clients[0]
+	logger.Info("TFTP multicast master client change", "module", "TFTP", "address", m.clients[0].String())
+}
+
+func (m *multicast) index(client net.Addr) int {
+	for i, c := range m.clients {
+		if isClient(c, client) == nil {
+			return i
+		}
+	}
+	return -1
+}
+
+func (m *multicast) finished() bool {
+	m.server.multicastMu.Lock()
+	defer m.server.multicastMu.Unlock()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.clients) > 0 {
+		return false
+	}
+	if m.server.multicasts[m.file.Name] == m {
+		delete(m.server.multicasts, m.file.Name)
+	}
+	return true
+}
+
+func (m *multicast) close() {
+	m.conn.Close()
+	m.file.Close()
+	logger.Info("TFTP multicast session end", "module", "TFTP", "filename", m.file.Name, "group", m.group.String())
+}
+
+func appendOption(p []byte, k string, v string) []byte {
+	p = append(p, k...)
+	p = append(p, 0)
+	p = append(p, v...)
+	return append(p, 0)
+}
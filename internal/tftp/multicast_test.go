@@ -0,0 +1,196 @@
+package tftp
+
+import (
+	"bytes"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type multicastClient struct {
+	t       *testing.T
+	conn    net.PacketConn
+	group   *net.UDPConn
+	session net.Addr
+	blocks  map[int][]byte
+	last    int
+}
+
+func TestMulticast(t *testing.T) {
+	t.Parallel()
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skip(err)
+	}
+
+	dir := t.TempDir()
+	s := newServer(NewDirProvider(dir, 0))
+	wants := make([]byte, 100*512+77)
+	for i := range wants {
+		wants[i] = byte(rand.Int())
+	}
+	if err := os.WriteFile(filepath.Join(dir, fname), wants, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s.host = "127.0.0.1"
+	s.multicastGroup = &net.UDPAddr{IP: net.IPv4(239, 255, 69, 1), Port: 17690}
+	srv, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.serve(srv)
+
+	a := newMulticastClient(t, srv.LocalAddr(), lo, true)
+	defer a.close()
+	a.ack(0)
+	var b *multicastClient
+	for a.missing() > 0 {
+		n := a.receive()
+		if n == 10 && b == nil {
+			b = newMulticastClient(t, srv.LocalAddr(), lo, false)
+			defer b.close()
+		}
+		a.ack(n)
+	}
+	if got := a.file(); !bytes.Equal(got, wants) {
+		t.Fatal("master client got broken file")
+	}
+
+	b.waitMaster()
+	for {
+		b.drain()
+		missing := b.missing()
+		if missing < 0 {
+			break
+		}
+		b.ack(missing - 1)
+		for b.receive() != missing {
+		}
+	}
+	b.ack(b.last)
+	if got := b.file(); !bytes.Equal(got, wants) {
+		t.Fatal("late client got broken file")
+	}
+}
+
+func newMulticastClient(t *testing.T, srv net.Addr, ifi *net.Interface, master bool) *multicastClient {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &multicastClient{t: t, conn: conn, blocks: make(map[int][]byte)}
+
+	option := map[string]string{optMulticast: "", optBlocksize: "512", optTransfersize: "0"}
+	if _, err := conn.WriteTo(newRRQ(fname, modeOctet, option), srv); err != nil {
+		t.Fatal(err)
+	}
+	mc := c.oack()
+	if mc[2] != map[bool]string{true: "1", false: "0"}[master] {
+		t.Fatalf("got master client value %s", mc[2])
+	}
+	group, err := net.ResolveUDPAddr("udp4", mc[0]+":"+mc[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.group, err = net.ListenMulticastUDP("udp4", ifi, group)
+	if err != nil {
+		t.Skip(err)
+	}
+	return c
+}
+
+func (c *multicastClient) oack() []string {
+	rx := make([]byte, udpMax)
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, from, err := c.conn.ReadFrom(rx)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if rx[1] != opcOACK {
+		c.t.Fatalf("got %q", rx[:n])
+	}
+	c.session = from
+	fields := bytes.Split(rx[2:n], []byte{0})
+	for i := 0; i+1 < len(fields); i += 2 {
+		if string(fields[i]) == optMulticast {
+			return strings.Split(string(fields[i+1]), ",")
+		}
+	}
+	c.t.Fatalf("OACK has no multicast option: %q", rx[:n])
+	return nil
+}
+
+func (c *multicastClient) waitMaster() {
+	if mc := c.oack(); mc[2] != "1" {
+		c.t.Fatalf("got master client value %s", mc[2])
+	}
+}
+
+func (c *multicastClient) ack(n int) {
+	if _, err := c.conn.WriteTo([]byte{0, opcACK, byte(n >> 8), byte(n)}, c.session); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *multicastClient) receive() int {
+	rx := make([]byte, udpMax)
+	c.group.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := c.group.ReadFrom(rx)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return c.store(rx[:n])
+}
+
+func (c *multicastClient) drain() {
+	rx := make([]byte, udpMax)
+	for {
+		c.group.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, _, err := c.group.ReadFrom(rx)
+		if err != nil {
+			return
+		}
+		c.store(rx[:n])
+	}
+}
+
+func (c *multicastClient) store(p []byte) int {
+	if p[1] != opcDATA {
+		c.t.Fatalf("got %q", p)
+	}
+	n := int(p[2])<<8 + int(p[3])
+	c.blocks[n] = bytes.Clone(p[4:])
+	if len(p)-4 < 512 {
+		c.last = n
+	}
+	return n
+}
+
+func (c *multicastClient) missing() int {
+	for i := 1; c.last == 0 || i <= c.last; i++ {
+		if _, ok := c.blocks[i]; !ok {
+			return i
+		}
+	}
+	return -1
+}
+
+func (c *multicastClient) file() []byte {
+	var p []byte
+	for i := 1; i <= c.last; i++ {
+		p = append(p, c.blocks[i]...)
+	}
+	return p
+}
+
+func (c *multicastClient) close() {
+	c.conn.Close()
+	if c.group != nil {
+		c.group.Close()
+	}
+}
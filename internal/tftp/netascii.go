@@ -0,0 +1,119 @@
+package tftp
+
+import (
+	"bufio"
+	"io"
+)
+
+type netasciiWriter struct {
+	w  io.Writer
+	cr bool
+	// written counts the bytes written to w after the translation.
+	written int64
+}
+
+type netascii struct {
+	r       *bufio.Reader
+	pending byte
+	held    bool
+}
+
+func newNetascii(r io.Reader) *netascii {
+	return &netascii{r: bufio.NewReader(r)}
+}
+
+// Read translates the local newline convention to netascii: LF becomes
+// CR LF and a bare CR becomes CR NUL (RFC 764).
+func (n *netascii) Read(p []byte) (int, error) {
+	i := 0
+	for i < len(p) {
+		if n.held {
+			p[i] = n.pending
+			n.held = false
+			i++
+			continue
+		}
+		c, err := n.r.ReadByte()
+		if err != nil {
+			return i, err
+		}
+		switch c {
+		case '\n':
+			p[i] = '\r'
+			n.pending = '\n'
+			n.held = true
+		case '\r':
+			p[i] = '\r'
+			n.pending = 0
+			n.held = true
+		default:
+			p[i] = c
+		}
+		i++
+	}
+	return i, nil
+}
+
+// netasciiSize returns the number of octets r occupies on the wire once it
+// is translated to netascii.
+func netasciiSize(r io.Reader) (int64, error) {
+	size := int64(0)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		for _, c := range buf[:n] {
+			size++
+			if c == '\n' || c == '\r' {
+				size++
+			}
+		}
+		if err == io.EOF {
+			return size, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write translates netascii back to the local newline convention: CR LF
+// becomes LF and CR NUL becomes CR.
+func (n *netasciiWriter) Write(p []byte) (int, error) {
+	out := make([]byte, 0, len(p))
+	for _, c := range p {
+		if n.cr {
+			n.cr = false
+			switch c {
+			case '\n':
+				out = append(out, '\n')
+				continue
+			case 0:
+				out = append(out, '\r')
+				continue
+			default:
+				out = append(out, '\r')
+			}
+		}
+		if c == '\r' {
+			n.cr = true
+			continue
+		}
+		out = append(out, c)
+	}
+	written, err := n.w.Write(out)
+	n.written += int64(written)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (n *netasciiWriter) flush() error {
+	if !n.cr {
+		return nil
+	}
+	n.cr = false
+	written, err := n.w.Write([]byte{'\r'})
+	n.written += int64(written)
+	return err
+}
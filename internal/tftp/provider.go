@@ -0,0 +1,344 @@
+package tftp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"text/template"
+
+	"github.com/callus-corn/tao/internal/host"
+	"github.com/callus-corn/tao/internal/profile"
+)
+
+// Request is a file requested by Client.
+type Request struct {
+	Filename string
+	Client   net.Addr
+}
+
+// File is the content of a requested file. Closer, if any, is closed once
+// the file has been sent.
+type File struct {
+	Name    string
+	Content io.ReaderAt
+	Size    int64
+	Closer  io.Closer
+}
+
+// Provider opens the files requested from a server. Open returns an error
+// matching fs.ErrNotExist when it does not have the file.
+type Provider interface {
+	Open(req Request) (*File, error)
+}
+
+// TemplateData is what templates know of the host requesting a file. Its
+// Profile is the boot profile of the host, decided by the classes if the
+// host has none.
+type TemplateData struct {
+	host.Host
+	Filename string
+	ClientIP string
+}
+
+type dirProvider struct {
+	dir   string
+	files *cache
+}
+
+type templateProvider struct {
+	dir       string
+	templates map[string]string
+	hosts     *host.Registry
+	profiles  *profile.Registry
+}
+
+type fallbackProvider struct {
+	next      Provider
+	fallbacks map[string]string
+}
+
+type chainProvider []Provider
+
+type profileProvider struct {
+	hosts    *host.Registry
+	profiles *profile.Registry
+}
+
+type localBootProvider struct {
+	next  Provider
+	files map[string]string
+	hosts *host.Registry
+	local func(mac string) bool
+}
+
+var macPattern = regexp.MustCompile(`(?:\b01-)?((?:[0-9a-fA-F]{2}[-:]){5}[0-9a-fA-F]{2})\b`)
+var ipPattern = regexp.MustCompile(`(\d{1,3}\.){3}\d{1,3}|\b[0-9A-F]{8}\b`)
+
+// NewDirProvider serves the files under dir. Up to cacheSize bytes of the
+// files served recently are kept in memory, none when it is 0.
+func NewDirProvider(dir string, cacheSize int64) Provider {
+	return &dirProvider{dir, newCache(cacheSize)}
+}
+
+// NewTemplateProvider renders the template mapped to the first pattern, in
+// lexical order, that matches the requested filename. The template sees the
+// host looked up in hosts and its profile in profiles.
+func NewTemplateProvider(dir string, templates map[string]string, hosts *host.Registry, profiles *profile.Registry) Provider {
+	return &templateProvider{dir, templates, hosts, profiles}
+}
+
+// NewFallbackProvider serves the default file mapped to a matching pattern
+// when next does not have the requested file.
+func NewFallbackProvider(next Provider, fallbacks map[string]string) Provider {
+	return &fallbackProvider{next, fallbacks}
+}
+
+// NewChainProvider serves the file of the first of providers which has it.
+func NewChainProvider(providers ...Provider) Provider {
+	return chainProvider(providers)
+}
+
+// NewProfileProvider generates the boot configs of the hosts with a boot
+// profile. The pxelinux.cfg/01-<mac> and grub.cfg-01-<mac> files of a host
+// are generated, as well as profile/ipxe, profile/grub and
+// profile/pxelinux for the client. The hosts are looked up in hosts.
+func NewProfileProvider(hosts *host.Registry, profiles *profile.Registry) Provider {
+	return profileProvider{hosts, profiles}
+}
+
+// NewLocalBootProvider serves the file mapped to a matching pattern instead
+// of the requested one when local reports that the client, looked up by its
+// address in hosts, boots from its local disk.
+func NewLocalBootProvider(next Provider, files map[string]string, hosts *host.Registry, local func(mac string) bool) Provider {
+	return &localBootProvider{next, files, hosts, local}
+}
+
+// NewFile returns a File of data, named name in the logs.
+func NewFile(name string, data []byte) *File {
+	return &File{Name: name, Content: bytes.NewReader(data), Size: int64(len(data))}
+}
+
+// Close closes Closer if it is set.
+func (f *File) Close() error {
+	if f.Closer == nil {
+		return nil
+	}
+	return f.Closer.Close()
+}
+
+func (p *dirProvider) Open(req Request) (*File, error) {
+	path := filepath.Join(p.dir, cleanName(req.Filename))
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, errors.New(req.Filename + " is a directory")
+	}
+
+	if data, ok := p.files.get(path, info); ok {
+		return &File{Name: path, Content: bytes.NewReader(data), Size: info.Size()}, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &File{Name: path, Content: file, Size: info.Size(), Closer: file}, nil
+}
+
+func (p *templateProvider) Open(req Request) (*File, error) {
+	name := cleanName(req.Filename)
+	tmpl, ok := match(p.templates, name)
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+
+	path := filepath.Join(p.dir, cleanName(tmpl))
+	t, err := template.ParseFiles(path)
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	if err := t.Execute(&out, p.newTemplateData(name, req.Client)); err != nil {
+		return nil, err
+	}
+	return NewFile(path, out.Bytes()), nil
+}
+
+func (p *fallbackProvider) Open(req Request) (*File, error) {
+	f, err := p.next.Open(req)
+	if !errors.Is(err, fs.ErrNotExist) {
+		return f, err
+	}
+	fallback, ok := match(p.fallbacks, cleanName(req.Filename))
+	if !ok {
+		return nil, err
+	}
+	return p.next.Open(Request{Filename: fallback, Client: req.Client})
+}
+
+func (c chainProvider) Open(req Request) (*File, error) {
+	err := fs.ErrNotExist
+	for _, p := range c {
+		f, e := p.Open(req)
+		if !errors.Is(e, fs.ErrNotExist) {
+			return f, e
+		}
+		err = e
+	}
+	return nil, err
+}
+
+func (p profileProvider) Open(req Request) (*File, error) {
+	name := cleanName(req.Filename)
+	mac, _ := addresses(name)
+	dir, base := path.Split(name)
+	var format string
+	switch {
+	case strings.HasPrefix(name, "profile/"):
+		format = strings.TrimPrefix(name, "profile/")
+		mac = ""
+	case mac != "" && path.Base(dir) == "pxelinux.cfg":
+		format = "pxelinux"
+	case mac != "" && strings.HasPrefix(base, "grub.cfg-"):
+		format = "grub"
+	default:
+		return nil, fs.ErrNotExist
+	}
+	if !slices.Contains(profile.Formats, format) {
+		return nil, fs.ErrNotExist
+	}
+
+	var h host.Host
+	var ok bool
+	if mac != "" {
+		h, ok = p.hosts.Get(mac)
+	} else if req.Client != nil {
+		h, ok = p.hosts.ByIP(clientIP(req.Client))
+	}
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	b, ok, err := p.profiles.Render(format, h, "http://"+localIP(req.Client))
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	// Multicast sessions are keyed by the name, which differs by host.
+	return NewFile("profile/"+format+"/"+h.MAC, b), nil
+}
+
+// localIP returns the address of the server the client reaches.
+func localIP(client net.Addr) string {
+	if client == nil {
+		return ""
+	}
+	conn, err := net.Dial("udp", client.String())
+	if err != nil {
+		return ""
+	}
+	defer conn.Close()
+	return clientIP(conn.LocalAddr())
+}
+
+func (p *localBootProvider) Open(req Request) (*File, error) {
+	if req.Client == nil {
+		return p.next.Open(req)
+	}
+	h, ok := p.hosts.ByIP(clientIP(req.Client))
+	if !ok || !p.local(h.MAC) {
+		return p.next.Open(req)
+	}
+	name, ok := match(p.files, cleanName(req.Filename))
+	if !ok {
+		return p.next.Open(req)
+	}
+	return p.next.Open(Request{Filename: name, Client: req.Client})
+}
+
+// newTemplateData describes the host requesting filename from client. The
+// host is looked up by the MAC or IP address in filename, or else by the
+// address of client.
+func (p *templateProvider) newTemplateData(filename string, client net.Addr) TemplateData {
+	data := TemplateData{Filename: filename}
+	if client != nil {
+		data.ClientIP = clientIP(client)
+	}
+	mac, ip := addresses(filename)
+	var h host.Host
+	var ok bool
+	switch {
+	case mac != "":
+		h, ok = p.hosts.Get(mac)
+	case ip != "":
+		h, ok = p.hosts.ByIP(ip)
+	case data.ClientIP != "":
+		h, ok = p.hosts.ByIP(data.ClientIP)
+	}
+	if ok {
+		data.Host = h
+		if name, _, ok := p.profiles.For(h); ok {
+			data.Profile = name
+		}
+	}
+	if mac != "" {
+		data.MAC = mac
+	}
+	if ip != "" {
+		data.IP = ip
+	}
+	return data
+}
+
+// addresses returns the MAC or IP address in filename, such as
+// pxelinux.cfg/01-aa-bb-cc-dd-ee-ff or pxelinux.cfg/0A000105.
+func addresses(filename string) (mac string, ip string) {
+	if m := macPattern.FindStringSubmatch(filename); m != nil {
+		mac = strings.ToLower(strings.ReplaceAll(m[1], "-", ":"))
+	}
+	if ip = ipPattern.FindString(path.Base(filename)); ip != "" {
+		if len(ip) == 8 && !strings.Contains(ip, ".") {
+			b := make([]byte, 4)
+			for i := range b {
+				b[i] = fromHex(ip[2*i])<<4 | fromHex(ip[2*i+1])
+			}
+			ip = net.IP(b).String()
+		}
+	}
+	return mac, ip
+}
+
+func fromHex(c byte) byte {
+	if c >= 'A' {
+		return c - 'A' + 10
+	}
+	return c - '0'
+}
+
+func match(patterns map[string]string, name string) (string, bool) {
+	keys := make([]string, 0, len(patterns))
+	for k := range patterns {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		if ok, _ := path.Match(k, name); ok {
+			return patterns[k], true
+		}
+	}
+	return "", false
+}
+
+func cleanName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(name)), "/")
+}
@@ -0,0 +1,286 @@
+package tftp
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/callus-corn/tao/internal/host"
+	"github.com/callus-corn/tao/internal/profile"
+)
+
+func TestTemplateData(t *testing.T) {
+	tests := []struct {
+		filename string
+		mac      string
+		ip       string
+	}{
+		{filename: "pxelinux.cfg/01-aa-bb-cc-dd-ee-ff", mac: "aa:bb:cc:dd:ee:ff"},
+		{filename: "pxelinux.cfg/01-AA-BB-CC-DD-EE-FF", mac: "aa:bb:cc:dd:ee:ff"},
+		{filename: "pxelinux.cfg/0A000105", ip: "10.0.1.5"},
+		{filename: "grub/grub.cfg-01-aa-bb-cc-dd-ee-ff", mac: "aa:bb:cc:dd:ee:ff"},
+		{filename: "grub/grub.cfg-10.0.1.5", ip: "10.0.1.5"},
+		{filename: "grub/grub.cfg-aa:bb:cc:dd:ee:ff", mac: "aa:bb:cc:dd:ee:ff"},
+		{filename: "pxelinux.cfg/default"},
+	}
+
+	p := &templateProvider{hosts: host.NewRegistry(), profiles: profile.NewRegistry()}
+	for _, tt := range tests {
+		data := p.newTemplateData(tt.filename, &net.UDPAddr{IP: net.IPv4(10, 0, 1, 2), Port: 2000})
+		if data.MAC != tt.mac || data.IP != tt.ip || data.ClientIP != "10.0.1.2" {
+			t.Fatalf("Fail at %s: %+v", tt.filename, data)
+		}
+	}
+}
+
+func TestTemplateHost(t *testing.T) {
+	hosts, profiles := host.NewRegistry(), profile.NewRegistry()
+	err := profiles.Set(profile.BootConfig{
+		Profiles: map[string]profile.Profile{"rocky": {Kernel: "vmlinuz"}},
+		Classes:  []profile.Class{{Labels: map[string]string{"role": "web"}, Profile: "rocky"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	web := host.Host{MAC: "aa:bb:cc:dd:ee:03", IP: "10.0.1.12", Hostname: "web1", Arch: "x64-uefi", Labels: map[string]string{"role": "web"}}
+	if err := hosts.Set([]host.Host{web}); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	tmpl := `{{.Hostname}} {{.MAC}} {{.IP}} {{.Arch}} {{index .Labels "role"}} {{.Profile}}`
+	if err := os.WriteFile(filepath.Join(dir, "host.tmpl"), []byte(tmpl), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p := NewTemplateProvider(dir, map[string]string{"*": "host.tmpl", "*/*": "host.tmpl"}, hosts, profiles)
+
+	tests := []struct {
+		filename string
+		client   net.Addr
+		wants    string
+	}{
+		{"pxelinux.cfg/01-aa-bb-cc-dd-ee-03", nil, "web1 aa:bb:cc:dd:ee:03 10.0.1.12 x64-uefi web rocky"},
+		{"grub.cfg-10.0.1.12", nil, "web1 aa:bb:cc:dd:ee:03 10.0.1.12 x64-uefi web rocky"},
+		{"boot.ipxe", &net.UDPAddr{IP: net.IPv4(10, 0, 1, 12), Port: 2000}, "web1 aa:bb:cc:dd:ee:03 10.0.1.12 x64-uefi web rocky"},
+		{"pxelinux.cfg/01-aa-bb-cc-dd-ee-04", nil, " aa:bb:cc:dd:ee:04    "},
+	}
+	for _, tt := range tests {
+		f, err := p.Open(Request{Filename: tt.filename, Client: tt.client})
+		if err != nil {
+			t.Fatalf("Fail at %s: %v", tt.filename, err)
+		}
+		got, _ := io.ReadAll(io.NewSectionReader(f.Content, 0, f.Size))
+		if string(got) != tt.wants {
+			t.Fatalf("Fail at %s: got %q, wants %q", tt.filename, got, tt.wants)
+		}
+	}
+}
+
+func TestTemplateProvider(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "pxelinux.tmpl"), []byte("DEFAULT {{.MAC}} {{.ClientIP}}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := newServer(NewTemplateProvider(dir, map[string]string{"pxelinux.cfg/01-*": "pxelinux.tmpl"}, host.NewRegistry(), profile.NewRegistry()))
+	client := &net.UDPAddr{IP: net.IPv4(10, 0, 1, 2), Port: 2000}
+
+	tftp, err := s.rrq(newRRQ("/pxelinux.cfg/01-aa-bb-cc-dd-ee-ff", modeNetascii, map[string]string{optTransfersize: "0"}), client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tftp.close()
+
+	wants := "DEFAULT aa:bb:cc:dd:ee:ff 10.0.1.2\r\n"
+	tx := make([]byte, udpMax)
+	n, err := tftp.oack(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(tx[2:n]); got != optTransfersize+"\x00"+strconv.Itoa(len(wants))+"\x00" {
+		t.Fatalf("got tsize %q", got)
+	}
+	tftp.ack([]byte{0, opcACK, 0, 0})
+	n, err = tftp.data(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(tx[4:n]); got != wants {
+		t.Fatalf("got %q, wants %q", got, wants)
+	}
+
+	if _, err := s.rrq(newRRQ("pxelinux.cfg/default", modeOctet, nil), client); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("unmatched file is served: %v", err)
+	}
+}
+
+func TestFallbackProvider(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "pxelinux.cfg"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{
+		"pxelinux.cfg/default":              "default",
+		"pxelinux.cfg/01-aa-bb-cc-dd-ee-ff": "host",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p := NewFallbackProvider(NewDirProvider(dir, 0), map[string]string{"pxelinux.cfg/*": "pxelinux.cfg/default"})
+
+	tests := map[string]string{
+		"pxelinux.cfg/01-aa-bb-cc-dd-ee-ff": "host",
+		"pxelinux.cfg/01-11-22-33-44-55-66": "default",
+		"pxelinux.cfg/0A000105":             "default",
+	}
+	for name, wants := range tests {
+		f, err := p.Open(Request{Filename: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(io.NewSectionReader(f.Content, 0, f.Size))
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != wants {
+			t.Fatalf("Fail at %s: got %q, wants %q", name, got, wants)
+		}
+	}
+
+	if _, err := p.Open(Request{Filename: "bootx64.efi"}); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("unmatched file is served: %v", err)
+	}
+}
+
+func TestLocalBootProvider(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"bootx64.efi": "installer",
+		"local.ipxe":  "#!ipxe\nexit\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hosts := host.NewRegistry()
+	if err := hosts.Set([]host.Host{{MAC: "aa:bb:cc:dd:ee:01", IP: "10.0.1.10"}, {MAC: "aa:bb:cc:dd:ee:02", IP: "10.0.1.11"}}); err != nil {
+		t.Fatal(err)
+	}
+	local := func(mac string) bool { return mac == "aa:bb:cc:dd:ee:01" }
+	p := NewLocalBootProvider(NewDirProvider(dir, 0), map[string]string{"*.efi": "local.ipxe"}, hosts, local)
+
+	tests := []struct {
+		client net.Addr
+		wants  string
+	}{
+		{&net.UDPAddr{IP: net.IPv4(10, 0, 1, 10), Port: 2000}, "#!ipxe\nexit\n"},
+		{&net.UDPAddr{IP: net.IPv4(10, 0, 1, 11), Port: 2000}, "installer"},
+		{&net.UDPAddr{IP: net.IPv4(10, 0, 1, 12), Port: 2000}, "installer"},
+		{nil, "installer"},
+	}
+	for _, tt := range tests {
+		f, err := p.Open(Request{Filename: "bootx64.efi", Client: tt.client})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(io.NewSectionReader(f.Content, 0, f.Size))
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tt.wants {
+			t.Fatalf("Fail at %v: got %q, wants %q", tt.client, got, tt.wants)
+		}
+	}
+}
+
+func TestSetProvider(t *testing.T) {
+	dir, custom := t.TempDir(), t.TempDir()
+	os.WriteFile(filepath.Join(dir, fname), []byte("config"), 0644)
+	os.WriteFile(filepath.Join(custom, fname), []byte("custom"), 0644)
+	conf := TFTPConfig{Address: "127.0.0.1:0", SrvDir: dir}
+	s, err := NewServer(conf, host.NewRegistry(), profile.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetProvider(NewDirProvider(custom, 0))
+	apply, err := s.Reload(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	apply()
+	got, err := getFile(listen(t, s), testCase{})
+	if err != nil || string(got) != "custom" {
+		t.Fatalf("got %q %v", got, err)
+	}
+}
+
+func TestProfileProvider(t *testing.T) {
+	hosts, profiles := host.NewRegistry(), profile.NewRegistry()
+	err := profiles.Set(profile.BootConfig{
+		URL:      "http://10.0.0.1",
+		Profiles: map[string]profile.Profile{"memtest": {Kernel: "memtest.efi", Cmdline: "console={{.Hostname}}"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := hosts.Set([]host.Host{{MAC: "aa:bb:cc:dd:ee:01", IP: "10.0.1.10", Hostname: "node1", Profile: "memtest"}, {MAC: "aa:bb:cc:dd:ee:02", IP: "10.0.1.11"}}); err != nil {
+		t.Fatal(err)
+	}
+	p := NewProfileProvider(hosts, profiles)
+	client := &net.UDPAddr{IP: net.IPv4(10, 0, 1, 10), Port: 2000}
+
+	tests := []struct {
+		filename string
+		client   net.Addr
+		wants    string
+	}{
+		{"pxelinux.cfg/01-aa-bb-cc-dd-ee-01", nil, "DEFAULT memtest\nLABEL memtest\n    KERNEL /memtest.efi\n    APPEND console=node1\n"},
+		{"grub/grub.cfg-01-aa-bb-cc-dd-ee-01", nil, "set default=0\nset timeout=0\nmenuentry \"memtest\" {\n    linux /memtest.efi console=node1\n}\n"},
+		{"profile/ipxe", client, "#!ipxe\nkernel http://10.0.0.1/memtest.efi console=node1\nboot\n"},
+	}
+	for _, tt := range tests {
+		f, err := p.Open(Request{Filename: tt.filename, Client: tt.client})
+		if err != nil {
+			t.Fatalf("Fail at %s: %v", tt.filename, err)
+		}
+		got, err := io.ReadAll(io.NewSectionReader(f.Content, 0, f.Size))
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tt.wants {
+			t.Fatalf("Fail at %s: got %q, wants %q", tt.filename, got, tt.wants)
+		}
+	}
+
+	for _, name := range []string{"pxelinux.cfg/01-aa-bb-cc-dd-ee-02", "pxelinux.cfg/default", "profile/menu", "bootx64.efi"} {
+		if _, err := p.Open(Request{Filename: name, Client: client}); !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("%s is served: %v", name, err)
+		}
+	}
+}
+
+func TestDirProviderTraversal(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "srv")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "secret"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewDirProvider(dir, 0)
+	for _, name := range []string{"../secret", "/../secret", "a/../../secret"} {
+		if _, err := p.Open(Request{Filename: name}); !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("Fail at %s: file outside of directory is served: %v", name, err)
+		}
+	}
+}
@@ -2,25 +2,58 @@ package tftp
 
 import (
 	"bytes"
+	"context"
 	"errors"
+	"fmt"
+	"io"
 	"log/slog"
 	"net"
 	"os"
+	"path"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/callus-corn/tao/internal/config"
+	"github.com/callus-corn/tao/internal/event"
+	"github.com/callus-corn/tao/internal/host"
+	"github.com/callus-corn/tao/internal/profile"
 )
 
+// TFTPConfig is the TFTP section of tao.conf.
 type TFTPConfig struct {
-	IsEnable bool   `json:"IsEnable"`
-	Address  string `json:"Address"`
-	SrvDir   string `json:"SrvDir"`
+	IsEnable  bool   `json:"IsEnable"`
+	Address   string `json:"Address"`
+	SrvDir    string `json:"SrvDir"`
+	Rollover  int    `json:"Rollover"`
+	CacheSize int64  `json:"CacheSize"`
+
+	MaxSessions          int   `json:"MaxSessions"`
+	MaxSessionsPerClient int   `json:"MaxSessionsPerClient"`
+	RateLimit            int64 `json:"RateLimit"`
+
+	MulticastAddress string `json:"MulticastAddress"`
+
+	Templates map[string]string `json:"Templates"`
+	Fallbacks map[string]string `json:"Fallbacks"`
+	// LocalBoot maps patterns to the files served instead to hosts which
+	// boot from their local disk, such as an iPXE script running exit.
+	LocalBoot map[string]string `json:"LocalBoot"`
 }
 
 type tftp struct {
-	blocks  [][]byte
-	blockNo int
-	file    *os.File
-	option  map[string]string
+	filename string
+	blocks   [][]byte
+	blockNo  int
+	lastACK  int
+	rollover int
+	file     *File
+	reader   io.Reader
+	mode     string
+	option   map[string]string
 }
 
 const udpMax = 65536
@@ -30,182 +63,497 @@ const opcDATA = 3
 const opcACK = 4
 const opcERROR = 5
 const opcOACK = 6
+const notDefined = 0
 const fileNotFound = 1
 const accessviolation = 2
 const illegalTFTPOperation = 4
 const requestHasBeenDeniend = 8
 const optBlocksize = "blksize"
 const optTransfersize = "tsize"
+const optRollover = "rollover"
+const optMulticast = "multicast"
+const blksizeMin = 8
+const blksizeMax = 65464
+const modeNetascii = "netascii"
+const modeOctet = "octet"
+
+const sessionTimeout = time.Second
+const sessionRetries = 5
+
+var errInvalidPacket = errors.New("invalid packet")
+var errUnsupportedMode = errors.New("unsupported transfer mode")
+var errInvalidOption = errors.New("invalid option")
+var errDuplicateACK = errors.New("duplicate ACK")
 
 var logger = slog.New(slog.NewJSONHandler(os.Stdout, nil))
-var host string
-var srvDir = "./"
 
-func Listen(conf TFTPConfig) error {
-	address := conf.Address
-	srvDir = conf.SrvDir
+// Server serves files over TFTP. Its settings can be changed by Reload
+// while it is serving.
+type Server struct {
+	// mu guards the settings Reload changes while a request is accepted.
+	mu       sync.RWMutex
+	rollover int
+	provider Provider
+	// custom is the Provider set by SetProvider, served instead of the
+	// files of the config.
+	custom         Provider
+	rateLimit      int64
+	multicastGroup *net.UDPAddr
+
+	// localBoot reports whether a host boots from its local disk.
+	localBoot atomic.Pointer[func(mac string) bool]
+
+	address  string
+	host     string
+	listener net.PacketConn
+	sessions *limiter
+
+	// hosts and profiles describe the clients to the providers.
+	hosts    *host.Registry
+	profiles *profile.Registry
+
+	// running counts the transfers being served, multicast sessions included.
+	running  sync.WaitGroup
+	activeMu sync.Mutex
+	actives  map[*active]struct{}
+
+	// timeout is how long a session waits for an ACK before sending its
+	// last packet again, at most retries times.
+	timeout time.Duration
+	retries int
+
+	multicastMu sync.Mutex
+	multicasts  map[string]*multicast
+
+	events event.Hooks
+
+	healthMu sync.Mutex
+	health   error
+}
 
-	var err error = nil
-	host, _, err = net.SplitHostPort(address)
+// Validate checks the config without listening. Errors name the field.
+func (c TFTPConfig) Validate() error {
+	errs := []error{
+		config.Address("Address", c.Address),
+		config.Dir("SrvDir", c.SrvDir),
+	}
+	if c.Rollover != 0 && c.Rollover != 1 {
+		errs = append(errs, config.Errorf("Rollover", "must be 0 or 1"))
+	}
+	if c.CacheSize < 0 {
+		errs = append(errs, config.Errorf("CacheSize", "must not be negative"))
+	}
+	if c.MaxSessions < 0 {
+		errs = append(errs, config.Errorf("MaxSessions", "must not be negative"))
+	}
+	if c.MaxSessionsPerClient < 0 {
+		errs = append(errs, config.Errorf("MaxSessionsPerClient", "must not be negative"))
+	}
+	if c.RateLimit < 0 {
+		errs = append(errs, config.Errorf("RateLimit", "must not be negative"))
+	}
+	if c.MulticastAddress != "" {
+		group, err := net.ResolveUDPAddr("udp4", c.MulticastAddress)
+		if err != nil {
+			errs = append(errs, config.Errorf("MulticastAddress", "%w", err))
+		} else if !group.IP.IsMulticast() {
+			errs = append(errs, config.Errorf("MulticastAddress", "%s is not a multicast address", c.MulticastAddress))
+		}
+	}
+	errs = append(errs, patterns("Templates", c.Templates), patterns("Fallbacks", c.Fallbacks), patterns("LocalBoot", c.LocalBoot))
+	return errors.Join(errs...)
+}
+
+func patterns(name string, m map[string]string) error {
+	keys := make([]string, 0, len(m))
+	for pattern := range m {
+		keys = append(keys, pattern)
+	}
+	slices.Sort(keys)
+
+	var errs []error
+	for _, pattern := range keys {
+		if _, err := path.Match(pattern, ""); err != nil {
+			errs = append(errs, config.Errorf(name+"["+strconv.Quote(pattern)+"]", "%w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// NewServer returns a server for conf. The clients are looked up in hosts,
+// and their boot configs generated from profiles. It does not listen until
+// Listen is called.
+func NewServer(conf TFTPConfig, hosts *host.Registry, profiles *profile.Registry) (*Server, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, config.Prefix("TFTP", err)
+	}
+	addr, _, err := net.SplitHostPort(conf.Address)
 	if err != nil {
-		return err
+		return nil, config.Errorf("TFTP.Address", "%w", err)
 	}
+	s := newServer(nil)
+	s.hosts, s.profiles = hosts, profiles
+	apply, err := s.prepare(conf)
+	if err != nil {
+		return nil, config.Prefix("TFTP", err)
+	}
+	apply()
+	s.address = conf.Address
+	s.host = addr
+	return s, nil
+}
+
+func newServer(p Provider) *Server {
+	return &Server{
+		provider:   p,
+		sessions:   newLimiter(0, 0),
+		hosts:      host.NewRegistry(),
+		profiles:   profile.NewRegistry(),
+		timeout:    sessionTimeout,
+		retries:    sessionRetries,
+		actives:    make(map[*active]struct{}),
+		multicasts: make(map[string]*multicast),
+		health:     errors.New("TFTP is not started"),
+	}
+}
 
-	conn, err := net.ListenPacket("udp", address)
+// Listen starts serving in the background. The listener is closed when ctx
+// is done.
+func (s *Server) Listen(ctx context.Context) error {
+	conn, err := net.ListenPacket("udp", s.address)
 	if err != nil {
 		return err
 	}
-	go listen(conn)
+	s.mu.Lock()
+	s.listener = conn
+	s.mu.Unlock()
+	context.AfterFunc(ctx, func() { conn.Close() })
+	go s.serve(conn)
+	s.setHealth(nil)
 
 	return nil
 }
 
-func listen(conn net.PacketConn) {
-	defer conn.Close()
+// Reload checks conf against the running server and returns a function
+// applying it. Transfers in progress keep the file they have opened.
+func (s *Server) Reload(conf TFTPConfig) (func(), error) {
+	if err := conf.Validate(); err != nil {
+		return nil, config.Prefix("TFTP", err)
+	}
+	if conf.Address != s.address {
+		return nil, config.Errorf("TFTP.Address", "cannot be changed without a restart")
+	}
+	apply, err := s.prepare(conf)
+	if err != nil {
+		return nil, config.Prefix("TFTP", err)
+	}
+	return apply, nil
+}
 
-	rx := make([]byte, udpMax)
-	for {
-		_, client, err := conn.ReadFrom(rx)
+// OnEvent adds fn to the functions called for each file sent to the end.
+func (s *Server) OnEvent(fn func(event.Event)) {
+	s.events.Add(fn)
+}
+
+// emit reports the transfer of filename to client. The host is looked up by
+// its address.
+func (s *Server) emit(client net.Addr, filename string) {
+	ip := clientIP(client)
+	h, _ := s.hosts.ByIP(ip)
+	s.events.Emit(event.Event{Type: event.TFTPTransfer, MAC: h.MAC, IP: ip, File: filename})
+}
+
+// SetLocalBoot sets the function deciding which hosts are served the files
+// of LocalBoot.
+func (s *Server) SetLocalBoot(fn func(mac string) bool) {
+	s.localBoot.Store(&fn)
+}
+
+// SetProvider makes the server serve the files of p instead of SrvDir,
+// Templates, Fallbacks, LocalBoot and the boot profiles, also after Reload.
+func (s *Server) SetProvider(p Provider) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.custom = p
+	s.provider = p
+}
+
+func (s *Server) bootsLocally(mac string) bool {
+	fn := s.localBoot.Load()
+	return fn != nil && (*fn)(mac)
+}
+
+func (s *Server) prepare(conf TFTPConfig) (func(), error) {
+	p := NewFallbackProvider(NewChainProvider(
+		NewProfileProvider(s.hosts, s.profiles),
+		NewTemplateProvider(conf.SrvDir, conf.Templates, s.hosts, s.profiles),
+		NewDirProvider(conf.SrvDir, conf.CacheSize),
+	), conf.Fallbacks)
+	if len(conf.LocalBoot) > 0 {
+		p = NewLocalBootProvider(p, conf.LocalBoot, s.hosts, s.bootsLocally)
+	}
+	var group *net.UDPAddr
+	if conf.MulticastAddress != "" {
+		var err error
+		group, err = net.ResolveUDPAddr("udp4", conf.MulticastAddress)
 		if err != nil {
-			logger.Error(err.Error(), "module", "TFTP")
-			continue
+			return nil, config.Errorf("MulticastAddress", "%w", err)
 		}
-		logger.Info("TFTP connection start", "module", "TFTP", "address", client.String())
+	}
 
-		if err := isERROR(rx); err != nil {
-			logger.Error(err.Error(), "module", "TFTP")
-			continue
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.rollover = conf.Rollover
+		s.provider = p
+		if s.custom != nil {
+			s.provider = s.custom
 		}
+		s.rateLimit = conf.RateLimit
+		s.multicastGroup = group
+		s.sessions.setLimits(conf.MaxSessions, conf.MaxSessionsPerClient)
+	}, nil
+}
 
-		if err := isRRQ(rx); err != nil {
-			logger.Error("Illegal TFTP operation form "+client.String(), "module", "TFTP")
-			response := newError(illegalTFTPOperation)
-			conn.WriteTo(response, client)
-			continue
-		}
+func (s *Server) serve(conn net.PacketConn) {
+	defer conn.Close()
 
-		tftp, err := rrq(rx)
+	rx := make([]byte, udpMax)
+	for {
+		n, client, err := conn.ReadFrom(rx)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
 			logger.Error(err.Error(), "module", "TFTP")
-			response := newError(fileNotFound)
-			conn.WriteTo(response, client)
 			continue
 		}
-		logger.Info("TFTP RRQ option", "module", "TFTP", "address", client.String(), "option", tftp.option)
 
-		conn, err := net.ListenPacket("udp", host+":0")
-		if err != nil {
-			logger.Error(err.Error(), "module", "TFTP")
-			continue
+		// Opening the file may take long, as when it is loaded into the
+		// cache, so the request is served out of this loop.
+		s.running.Add(1)
+		go s.accept(conn, bytes.Clone(rx[:n]), client)
+	}
+}
+
+// accept serves the request p from client.
+func (s *Server) accept(conn net.PacketConn, p []byte, client net.Addr) {
+	defer s.running.Done()
+	logger.Info("TFTP connection start", "module", "TFTP", "address", client.String())
+
+	if err := isERROR(p); err != nil {
+		logger.Error(err.Error(), "module", "TFTP")
+		return
+	}
+
+	if err := isRRQ(p); err != nil {
+		logger.Error("Illegal TFTP operation form "+client.String(), "module", "TFTP")
+		response := errorPacket(illegalTFTPOperation)
+		conn.WriteTo(response, client)
+		return
+	}
+
+	clientIP := clientIP(client)
+	if err := s.sessions.acquire(clientIP); err != nil {
+		logger.Error(err.Error(), "module", "TFTP", "address", client.String())
+		response := errorPacket(notDefined)
+		conn.WriteTo(response, client)
+		return
+	}
+
+	tftp, err := s.rrq(p, client)
+	if err != nil {
+		s.sessions.release(clientIP)
+		logger.Error(err.Error(), "module", "TFTP")
+		response := errorPacket(errorCode(err))
+		conn.WriteTo(response, client)
+		return
+	}
+	logger.Info("TFTP RRQ option", "module", "TFTP", "address", client.String(), "mode", tftp.mode, "option", tftp.option)
+
+	if _, ok := tftp.option[optMulticast]; ok {
+		err := s.joinMulticast(client, tftp)
+		if err == nil {
+			return
 		}
-		logger.Info("TFTP send file", "module", "TFTP", "address", client.String(), "filename", tftp.file.Name())
+		logger.Info("TFTP multicast is declined: "+err.Error(), "module", "TFTP", "address", client.String())
+		tftp.decline(optMulticast)
+	}
 
-		go handleTFTP(conn, client, tftp)
+	session, err := net.ListenPacket("udp", s.host+":0")
+	if err != nil {
+		s.sessions.release(clientIP)
+		tftp.close()
+		logger.Error(err.Error(), "module", "TFTP")
+		return
 	}
+	logger.Info("TFTP send file", "module", "TFTP", "address", client.String(), "filename", tftp.file.Name)
+
+	s.mu.RLock()
+	rateLimit := s.rateLimit
+	s.mu.RUnlock()
+	s.handleTFTP(session, client, tftp, newPacer(rateLimit))
 }
 
-func handleTFTP(conn net.PacketConn, client net.Addr, tftp *tftp) {
+func (s *Server) handleTFTP(conn net.PacketConn, client net.Addr, tftp *tftp, pacer *pacer) {
+	defer s.sessions.release(clientIP(client))
 	defer conn.Close()
 	defer tftp.close()
 
+	active := s.track(conn, client, tftp)
+	defer s.untrack(active)
+
 	rx := make([]byte, udpMax)
 	tx := make([]byte, udpMax)
 	if len(tftp.option) > 0 {
-		//if false {
 		n, err := tftp.oack(tx)
 		if err != nil {
 			logger.Error(err.Error(), "module", "TFTP")
-			response := newError(requestHasBeenDeniend)
+			response := errorPacket(requestHasBeenDeniend)
 			conn.WriteTo(response, client)
 			return
 		}
 		oack := tx[:n]
 		conn.WriteTo(oack, client)
-
-		for {
-			_, ackClient, err := conn.ReadFrom(rx)
-			if err != nil {
-				logger.Error(err.Error(), "module", "TFTP")
-				continue
-			}
-			if err = isClient(ackClient, client); err != nil {
-				continue
-			}
-			if err := isERROR(rx); err != nil {
-				logger.Error(err.Error(), "module", "TFTP")
-				return
-			}
-			if err = tftp.ack(rx); err != nil {
-				logger.Error(err.Error(), "module", "TFTP")
-				continue
-			}
-			break
+		if err := s.waitACK(conn, client, tftp, oack, rx); err != nil {
+			return
 		}
 	}
 
-	n, err := tftp.data(tx)
-	if err != nil {
-		logger.Error(err.Error(), "module", "TFTP")
-		response := newError(accessviolation)
-		conn.WriteTo(response, client)
-		return
+	blockSize, _ := tftp.blockSize()
+	for {
+		n, err := tftp.data(tx)
+		if err != nil {
+			logger.Error(err.Error(), "module", "TFTP")
+			response := errorPacket(accessviolation)
+			conn.WriteTo(response, client)
+			return
+		}
+		data := tx[:n]
+		pacer.wait(n)
+		conn.WriteTo(data, client)
+		active.sent.Add(int64(n - 4))
+
+		if err := s.waitACK(conn, client, tftp, data, rx); err != nil {
+			return
+		}
+		// The ACK of a block shorter than blksize ends the transfer.
+		if n-4 < blockSize {
+			logger.Info("TFTP transfer complete", "module", "TFTP", "address", client.String(), "filename", tftp.file.Name)
+			s.emit(client, tftp.filename)
+			return
+		}
 	}
-	data := tx[:n]
-	conn.WriteTo(data, client)
+}
 
+// waitACK waits for the ACK of last, the packet sent to client, and sends it
+// again each time none comes within s.timeout. It gives up after s.retries
+// resends, or when the client sends an ERROR.
+func (s *Server) waitACK(conn net.PacketConn, client net.Addr, tftp *tftp, last []byte, rx []byte) error {
+	retries := 0
 	for {
-		_, ackClient, err := conn.ReadFrom(rx)
+		conn.SetReadDeadline(time.Now().Add(s.timeout))
+		n, from, err := conn.ReadFrom(rx)
+		if errors.Is(err, net.ErrClosed) {
+			return err
+		}
+		if isTimeout(err) {
+			if retries >= s.retries {
+				logger.Error("TFTP client timeout", "module", "TFTP", "address", client.String())
+				return err
+			}
+			retries++
+			conn.WriteTo(last, client)
+			continue
+		}
 		if err != nil {
 			logger.Error(err.Error(), "module", "TFTP")
 			continue
 		}
-		if err = isClient(ackClient, client); err != nil {
+		if err = isClient(from, client); err != nil {
 			continue
 		}
-		if err := isERROR(rx); err != nil {
+		if err := isERROR(rx[:n]); err != nil {
 			logger.Error(err.Error(), "module", "TFTP")
-			return
+			return err
 		}
-		if err = tftp.ack(rx); err != nil {
-			logger.Error(err.Error(), "module", "TFTP")
+		if err = tftp.ack(rx[:n]); err != nil {
+			if !errors.Is(err, errDuplicateACK) {
+				logger.Error(err.Error(), "module", "TFTP")
+			}
 			continue
 		}
+		return nil
+	}
+}
 
-		n, err := tftp.data(tx)
-		if err != nil {
-			logger.Error(err.Error(), "module", "TFTP")
-			response := newError(accessviolation)
-			conn.WriteTo(response, client)
-			return
+// rrq opens the file requested by p.
+func (s *Server) rrq(p []byte, client net.Addr) (*tftp, error) {
+	fields := bytes.Split(p[2:], []byte{0})
+	if len(fields) < 2 {
+		return nil, errInvalidPacket
+	}
+	filename := string(fields[0])
+	mode := strings.ToLower(string(fields[1]))
+	if mode != modeOctet && mode != modeNetascii {
+		return nil, fmt.Errorf("%w: %s", errUnsupportedMode, mode)
+	}
+
+	option := make(map[string]string)
+	options := fields[2:]
+	for i := 0; i+1 < len(options); i += 2 {
+		k := strings.ToLower(string(options[i]))
+		switch k {
+		case optBlocksize, optTransfersize, optRollover, optMulticast:
+			option[k] = string(options[i+1])
 		}
-		data := tx[:n]
-		conn.WriteTo(data, client)
 	}
-}
 
-func rrq(p []byte) (*tftp, error) {
-	filename := string(bytes.Split(p[2:], []byte{0})[0])
-	path := srvDir + "/" + filename
-	file, err := os.Open(path)
+	if v, ok := option[optBlocksize]; ok {
+		blockSize, err := strconv.Atoi(v)
+		if err != nil || blockSize < blksizeMin || blockSize > blksizeMax {
+			return nil, fmt.Errorf("%w: %s %s", errInvalidOption, optBlocksize, v)
+		}
+	}
+	s.mu.RLock()
+	r, provider := s.rollover, s.provider
+	s.mu.RUnlock()
+	if v, ok := option[optRollover]; ok {
+		switch v {
+		case "0":
+			r = 0
+		case "1":
+			r = 1
+		default:
+			return nil, fmt.Errorf("%w: %s %s", errInvalidOption, optRollover, v)
+		}
+	}
+
+	file, err := provider.Open(Request{filename, client})
 	if err != nil {
 		return nil, err
 	}
 
-	option := make(map[string]string)
-	options := bytes.Split(p[2:], []byte{0})[2:]
-	for i := 0; i < len(options); i += 2 {
-		if len(options[i]) == 0 {
-			continue
-		}
-		option[strings.ToLower(string(options[i]))] = string(options[i+1])
+	var reader io.Reader = io.NewSectionReader(file.Content, 0, file.Size)
+	if mode == modeNetascii {
+		reader = newNetascii(reader)
 	}
 
-	blocks := make([][]byte, 1)
 	blockNo := 1
 	if len(option) > 0 {
 		blockNo = 0
 	}
-	tftp := &tftp{blocks, blockNo, file, option}
+	tftp := &tftp{
+		filename: filename,
+		blocks:   make([][]byte, 1),
+		blockNo:  blockNo,
+		lastACK:  -1,
+		rollover: r,
+		file:     file,
+		reader:   reader,
+		mode:     mode,
+		option:   option,
+	}
 	return tftp, nil
 }
 
@@ -217,13 +565,17 @@ func (t *tftp) ack(p []byte) error {
 		return errors.New("opc is not ACK")
 	}
 	ack := (int(p[2]) << 8) + int(p[3])
+	if ack == t.lastACK {
+		return errDuplicateACK
+	}
 	if ack != t.blockNo {
 		return errors.New("invalid ACK number")
 	}
 
+	t.lastACK = ack
 	t.blockNo = ack + 1
 	if t.blockNo >= blockMax {
-		t.blockNo = 0
+		t.blockNo = t.rollover
 	}
 
 	return nil
@@ -241,8 +593,37 @@ func (t *tftp) data(p []byte) (int, error) {
 	return len(head) + len(t.blocks[0]), nil
 }
 
-func newError(code byte) []byte {
-	return []byte{0, opcERROR, 0, code, 0}
+// errorMessages are the messages of RFC 1350 sent to clients. The errors
+// themselves may hold paths of the server and are only logged.
+var errorMessages = map[byte]string{
+	notDefined:            "Not defined",
+	fileNotFound:          "File not found",
+	accessviolation:       "Access violation",
+	illegalTFTPOperation:  "Illegal TFTP operation",
+	requestHasBeenDeniend: "Request has been denied",
+}
+
+// errorPacket returns the ERROR packet of code with its generic message.
+func errorPacket(code byte) []byte {
+	return newError(code, errorMessages[code])
+}
+
+func newError(code byte, msg string) []byte {
+	p := []byte{0, opcERROR, 0, code}
+	p = append(p, msg...)
+	return append(p, 0)
+}
+
+func errorCode(err error) byte {
+	switch {
+	case errors.Is(err, errUnsupportedMode), errors.Is(err, errInvalidPacket):
+		return illegalTFTPOperation
+	case errors.Is(err, errInvalidOption):
+		return requestHasBeenDeniend
+	case errors.Is(err, os.ErrPermission):
+		return accessviolation
+	}
+	return fileNotFound
 }
 
 func (t *tftp) oack(p []byte) (int, error) {
@@ -250,17 +631,17 @@ func (t *tftp) oack(p []byte) (int, error) {
 	options := []byte{}
 	for k, v := range t.option {
 		switch k {
-		case optBlocksize:
+		case optBlocksize, optRollover:
 			options = append(options, []byte(k)...)
 			options = append(options, 0)
 			options = append(options, []byte(v)...)
 			options = append(options, 0)
 		case optTransfersize:
-			info, err := t.file.Stat()
+			size, err := t.size()
 			if err != nil {
 				return 0, err
 			}
-			tsize := strconv.Itoa(int(info.Size()))
+			tsize := strconv.FormatInt(size, 10)
 			options = append(options, []byte(k)...)
 			options = append(options, 0)
 			options = append(options, tsize...)
@@ -276,6 +657,14 @@ func (t *tftp) oack(p []byte) (int, error) {
 	return len(head) + len(options), nil
 }
 
+func clientIP(a net.Addr) string {
+	ip, _, err := net.SplitHostPort(a.String())
+	if err != nil {
+		return a.String()
+	}
+	return ip
+}
+
 func isClient(a net.Addr, b net.Addr) error {
 	if a.String() != b.String() {
 		return errors.New("invalid client")
@@ -288,6 +677,9 @@ func isERROR(p []byte) error {
 		return errors.New("invalid packet")
 	}
 	if p[1] == opcERROR {
+		if len(p) < 4 {
+			return errInvalidPacket
+		}
 		return errors.New("error code " + string(p[3]) + " " + string(bytes.Split(p[4:], []byte{0})[0]))
 	}
 	return nil
@@ -303,6 +695,20 @@ func isRRQ(p []byte) error {
 	return nil
 }
 
+func (t *tftp) size() (int64, error) {
+	if t.mode == modeNetascii {
+		return netasciiSize(io.NewSectionReader(t.file.Content, 0, t.file.Size))
+	}
+	return t.file.Size, nil
+}
+
+func (t *tftp) decline(option string) {
+	delete(t.option, option)
+	if len(t.option) == 0 && t.blockNo == 0 {
+		t.blockNo = 1
+	}
+}
+
 func (t *tftp) close() {
 	t.file.Close()
 }
@@ -330,7 +736,7 @@ func (t *tftp) loadFile() error {
 			block := make([]byte, blockSize)
 			t.blocks[i] = block
 		}
-		n, err := t.file.Read(t.blocks[i])
+		n, err := io.ReadFull(t.reader, t.blocks[i])
 		if n < blockSize {
 			t.blocks[i] = t.blocks[i][:n]
 			break
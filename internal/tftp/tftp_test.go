@@ -1,16 +1,22 @@
 package tftp
 
 import (
+	"bytes"
+	"errors"
 	"math/rand"
+	"net"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 type testCase struct {
 	name   string
 	bytes  int
+	mode   string
 	option map[string]string
 }
 
@@ -37,7 +43,12 @@ func TestTFTP(t *testing.T) {
 		{name: "512*2+1 byte file", bytes: 512*2 + 1, option: nil},
 	}
 
+	dir := t.TempDir()
+	addr := startServer(t, dir)
 	for _, tc := range tests {
+		if testing.Short() && tc.bytes > 10*1000*1000 {
+			continue
+		}
 		var wants []byte
 		for range tc.bytes {
 			wants = append(wants, byte(rand.Int()))
@@ -45,30 +56,20 @@ func TestTFTP(t *testing.T) {
 
 		func() {
 			println(tc.name)
-			dir := t.TempDir()
 			path := filepath.Join(dir, fname)
-			srvDir = dir
-
 			err := os.WriteFile(path, wants, 0644)
 			if err != nil {
 				t.Fatal(err)
 			}
 			defer os.Remove(path)
 
-			got := make([]byte, 0, tc.bytes)
-			n, err := getFile(tc, got)
+			got, err := getFile(addr, tc)
 			if err != nil {
-				t.Fatal(err)
+				t.Fatalf("Fail at %s: %v", tc.name, err)
 			}
-			got = got[:n]
-			if len(wants) != len(got) {
+			if !bytes.Equal(got, wants) {
 				t.Fatal("Fail at " + tc.name)
 			}
-			for i, v := range wants {
-				if v != got[i] {
-					t.Fatal("Fail at " + tc.name)
-				}
-			}
 		}()
 	}
 }
@@ -111,7 +112,12 @@ func TestBlksize(t *testing.T) {
 		{name: "8192*2+1 byte file, blockSize 8192", bytes: 8192*2 + 1, option: map[string]string{"blksize": "8192"}},
 	}
 
+	dir := t.TempDir()
+	addr := startServer(t, dir)
 	for _, tc := range tests {
+		if testing.Short() && tc.bytes > 10*1000*1000 {
+			continue
+		}
 		println(tc.name)
 		var wants []byte
 		for range tc.bytes {
@@ -119,134 +125,293 @@ func TestBlksize(t *testing.T) {
 		}
 
 		func() {
-			dir := t.TempDir()
 			path := filepath.Join(dir, fname)
-			srvDir = dir
-
 			err := os.WriteFile(path, wants, 0644)
 			if err != nil {
 				t.Fatal(err)
 			}
 			defer os.Remove(path)
 
-			got := make([]byte, 0, tc.bytes)
-			n, err := getFile(tc, got)
+			got, err := getFile(addr, tc)
 			if err != nil {
-				t.Fatal(err)
+				t.Fatalf("Fail at %s: %v", tc.name, err)
 			}
-			got = got[:n]
-			if len(wants) != len(got) {
+			if !bytes.Equal(got, wants) {
 				t.Fatal("Fail at " + tc.name)
 			}
-			for i, v := range wants {
-				if v != got[i] {
-					t.Fatal("Fail at " + tc.name)
-				}
-			}
 		}()
 	}
 }
 
 func TestInvalidBlksize(t *testing.T) {
-	tests := []testCase{
-		{name: "10k byte file, blockSize ABC", bytes: 10 * 1000, option: map[string]string{"blksize": "ABC"}},
+	t.Parallel()
+	dir := t.TempDir()
+	addr := startServer(t, dir)
+	if err := os.WriteFile(filepath.Join(dir, fname), make([]byte, 10*1000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	server, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		t.Fatal(err)
 	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
 
-	for _, tc := range tests {
-		println(tc.name)
-		var wants []byte
-		for range tc.bytes {
-			wants = append(wants, byte(rand.Int()))
+	// The client does not send such a blksize, so the request is sent as is.
+	if _, err := conn.WriteTo(newRRQ(fname, modeOctet, map[string]string{optBlocksize: "ABC"}), server); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	rx := make([]byte, udpMax)
+	n, _, err := conn.ReadFrom(rx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rx[1] != opcERROR || rx[3] != requestHasBeenDeniend {
+		t.Fatalf("got %q", rx[:n])
+	}
+}
+
+func TestInvalidOption(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	s := newServer(NewDirProvider(dir, 0))
+	if err := os.WriteFile(filepath.Join(dir, fname), []byte("abc"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []map[string]string{
+		{optBlocksize: "ABC"},
+		{optBlocksize: "0"},
+		{optBlocksize: "7"},
+		{optBlocksize: "65465"},
+		{optRollover: "2"},
+	}
+	for _, option := range tests {
+		_, err := s.rrq(newRRQ(fname, modeOctet, option), nil)
+		if !errors.Is(err, errInvalidOption) || errorCode(err) != requestHasBeenDeniend {
+			t.Fatalf("Fail at option %v: %v", option, err)
+		}
+	}
+	for _, option := range []map[string]string{{optBlocksize: "8"}, {optBlocksize: "65464"}} {
+		tftp, err := s.rrq(newRRQ(fname, modeOctet, option), nil)
+		if err != nil {
+			t.Fatalf("Fail at option %v: %v", option, err)
 		}
+		tftp.close()
+	}
+}
 
+func TestRollover(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name     string
+		rollover int
+		option   map[string]string
+		wants    int
+	}{
+		{name: "rollover 0 by default", rollover: 0, option: map[string]string{optBlocksize: "8"}, wants: 0},
+		{name: "rollover 1 by config", rollover: 1, option: map[string]string{optBlocksize: "8"}, wants: 1},
+		{name: "rollover 1 by option", rollover: 0, option: map[string]string{optBlocksize: "8", optRollover: "1"}, wants: 1},
+		{name: "rollover 0 by option", rollover: 1, option: map[string]string{optBlocksize: "8", optRollover: "0"}, wants: 0},
+	}
+	for _, tt := range tests {
 		func() {
+			blocks := blockMax + 10
+			wants := make([]byte, 8*blocks)
+			for i := range wants {
+				wants[i] = byte(rand.Int())
+			}
 			dir := t.TempDir()
-			path := filepath.Join(dir, fname)
-			srvDir = dir
+			s := newServer(NewDirProvider(dir, 0))
+			s.rollover = tt.rollover
+			if err := os.WriteFile(filepath.Join(dir, fname), wants, 0644); err != nil {
+				t.Fatal(err)
+			}
 
-			err := os.WriteFile(path, wants, 0644)
+			tftp, err := s.rrq(newRRQ(fname, modeOctet, tt.option), nil)
 			if err != nil {
 				t.Fatal(err)
 			}
-			defer os.Remove(path)
+			defer tftp.close()
+			if err := tftp.ack([]byte{0, opcACK, 0, 0}); err != nil {
+				t.Fatal(err)
+			}
 
-			got := make([]byte, 0, tc.bytes)
-			if _, err = getFile(tc, got); err == nil {
-				t.Fatal("Fail at " + tc.name)
+			got := []byte{}
+			rx := make([]byte, udpMax)
+			for i := 1; ; i++ {
+				n, err := tftp.data(rx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, rx[4:n]...)
+				blockNo := int(rx[2])<<8 + int(rx[3])
+				if i == blockMax && blockNo != tt.wants {
+					t.Fatalf("Fail at %s: block %d is numbered %d", tt.name, i, blockNo)
+				}
+				if n < 4+8 {
+					break
+				}
+				if err := tftp.ack([]byte{0, opcACK, rx[2], rx[3]}); err != nil {
+					t.Fatalf("Fail at %s: block %d: %v", tt.name, i, err)
+				}
+			}
+			if !bytes.Equal(got, wants) {
+				t.Fatal("Fail at " + tt.name)
 			}
 		}()
 	}
 }
 
-func getFile(tc testCase, got []byte) (int, error) {
-	var err error
-	blockSize := 512
-
-	head := []byte{0, opcRRQ}
-	req := append(head, []byte(fname)...)
-	req = append(req, 0)
-	req = append(req, []byte("octet")...)
-	req = append(req, 0)
-	if blksize, ok := tc.option[optBlocksize]; ok {
-		option := append([]byte(optBlocksize), 0)
-		option = append(option, []byte(blksize)...)
-		option = append(option, 0)
-		req = append(req, option...)
-		blockSize, err = strconv.Atoi(blksize)
-		if err != nil {
-			return 0, err
-		}
+func TestDuplicateACK(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	s := newServer(NewDirProvider(dir, 0))
+	if err := os.WriteFile(filepath.Join(dir, fname), make([]byte, 2000), 0644); err != nil {
+		t.Fatal(err)
 	}
-	tftp, err := rrq(req)
+
+	tftp, err := s.rrq(newRRQ(fname, modeOctet, nil), nil)
 	if err != nil {
-		return 0, err
+		t.Fatal(err)
 	}
+	defer tftp.close()
 
-	if tc.option != nil {
-		tftp.ack([]byte{0, opcACK, 0, 0})
+	rx := make([]byte, udpMax)
+	if _, err := tftp.data(rx); err != nil {
+		t.Fatal(err)
 	}
+	if err := tftp.ack([]byte{0, opcACK, 0, 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tftp.data(rx); err != nil {
+		t.Fatal(err)
+	}
+	if err := tftp.ack([]byte{0, opcACK, 0, 1}); !errors.Is(err, errDuplicateACK) {
+		t.Fatalf("duplicate ACK is not suppressed: %v", err)
+	}
+	if err := tftp.ack([]byte{0, opcACK, 0, 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tftp.ack([]byte{0, opcACK, 0, 5}); err == nil || errors.Is(err, errDuplicateACK) {
+		t.Fatalf("unexpected ACK is accepted: %v", err)
+	}
+}
 
-	i := 1
-	rx := make([]byte, udpMax)
-	for {
-		n, err := tftp.data(rx)
-		if err != nil {
-			return 0, err
+func TestNetascii(t *testing.T) {
+	tests := []struct {
+		name  string
+		file  string
+		wants string
+	}{
+		{name: "empty", file: "", wants: ""},
+		{name: "no newline", file: "abc", wants: "abc"},
+		{name: "LF", file: "a\nb\n", wants: "a\r\nb\r\n"},
+		{name: "bare CR", file: "a\rb", wants: "a\r\x00b"},
+		{name: "CR LF", file: "a\r\nb", wants: "a\r\x00\r\nb"},
+		{name: "LF across block boundary", file: strings.Repeat("x", 511) + "\n" + "y", wants: strings.Repeat("x", 511) + "\r\n" + "y"},
+		{name: "many LF", file: strings.Repeat("\n", 1000), wants: strings.Repeat("\r\n", 1000)},
+	}
+
+	dir := t.TempDir()
+	addr := startServer(t, dir)
+	c := NewClient(addr)
+	c.Mode = "NetASCII"
+	for _, tt := range tests {
+		if err := os.WriteFile(filepath.Join(dir, fname), []byte(tt.file), 0644); err != nil {
+			t.Fatal(err)
 		}
-		got = append(got, rx[4:n]...)
 
-		if n < blockSize {
-			break
+		// The client translates the file back, and tsize is its size on
+		// the wire.
+		var got bytes.Buffer
+		if _, err := c.Get(fname, &got); err != nil {
+			t.Fatalf("Fail at %s: %v", tt.name, err)
+		}
+		if got.String() != tt.file {
+			t.Fatalf("Fail at %s: got %q, wants %q", tt.name, got.String(), tt.file)
+		}
+		size, err := c.Size(fname)
+		if err != nil || size != int64(len(tt.wants)) {
+			t.Fatalf("Fail at %s: got tsize %d %v, wants %d", tt.name, size, err, len(tt.wants))
 		}
-		tftp.ack([]byte{0, opcACK, byte(i >> 8), byte(i)})
-		i++
 	}
-
-	return len(got), nil
 }
 
-func Benchmark512(b *testing.B) {
-	tc := testCase{name: "bench 512", bytes: 1000 * 1000 * 1000, option: nil}
-	var data []byte
-	for range tc.bytes {
-		data = append(data, byte(rand.Int()))
+func TestUnsupportedMode(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	s := newServer(NewDirProvider(dir, 0))
+	if err := os.WriteFile(filepath.Join(dir, fname), []byte("abc"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mode := range []string{"mail", "binary", ""} {
+		_, err := s.rrq(newRRQ(fname, mode, nil), nil)
+		if !errors.Is(err, errUnsupportedMode) {
+			t.Fatalf("Fail at mode %q: %v", mode, err)
+		}
+		if errorCode(err) != illegalTFTPOperation {
+			t.Fatalf("Fail at mode %q: error code %d", mode, errorCode(err))
+		}
 	}
+}
 
-	func() {
-		dir := b.TempDir()
-		path := filepath.Join(dir, fname)
-		srvDir = dir
+func newRRQ(filename string, mode string, option map[string]string) []byte {
+	req := []byte{0, opcRRQ}
+	req = append(req, []byte(filename)...)
+	req = append(req, 0)
+	req = append(req, []byte(mode)...)
+	req = append(req, 0)
+	for k, v := range option {
+		req = append(req, []byte(k)...)
+		req = append(req, 0)
+		req = append(req, []byte(v)...)
+		req = append(req, 0)
+	}
+	return req
+}
 
-		err := os.WriteFile(path, data, 0644)
+// getFile reads fname from the server at addr with the client.
+func getFile(addr string, tc testCase) ([]byte, error) {
+	c := NewClient(addr)
+	if tc.mode != "" {
+		c.Mode = tc.mode
+	}
+	if v, ok := tc.option[optBlocksize]; ok {
+		blksize, err := strconv.Atoi(v)
 		if err != nil {
-			b.Fatal(err)
+			return nil, err
 		}
-		defer os.Remove(path)
+		c.Blksize = blksize
+	}
+	var got bytes.Buffer
+	_, err := c.Get(fname, &got)
+	return got.Bytes(), err
+}
 
-		got := make([]byte, 0, tc.bytes)
-		b.ResetTimer()
-		for range b.N {
-			getFile(tc, got)
+func Benchmark512(b *testing.B) {
+	if testing.Short() {
+		b.Skip("1 GB file")
+	}
+	data := make([]byte, 1000*1000*1000)
+	for i := range data {
+		data[i] = byte(rand.Int())
+	}
+	dir := b.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, fname), data, 0644); err != nil {
+		b.Fatal(err)
+	}
+	addr := startServer(b, dir)
+
+	b.ResetTimer()
+	for range b.N {
+		if _, err := getFile(addr, testCase{name: "bench 512"}); err != nil {
+			b.Fatal(err)
 		}
-	}()
+	}
 }
@@ -0,0 +1,137 @@
+package tftp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Transfer describes a file being sent to a client.
+type Transfer struct {
+	Client    string    `json:"Client"`
+	Filename  string    `json:"Filename"`
+	Mode      string    `json:"Mode"`
+	Sent      int64     `json:"Sent"`
+	Size      int64     `json:"Size"`
+	Started   time.Time `json:"Started"`
+	Multicast bool      `json:"Multicast"`
+}
+
+type active struct {
+	conn    net.PacketConn
+	client  net.Addr
+	tftp    *tftp
+	sent    atomic.Int64
+	started time.Time
+}
+
+// Transfers returns the files being sent.
+func (s *Server) Transfers() []Transfer {
+	var transfers []Transfer
+
+	s.activeMu.Lock()
+	for a := range s.actives {
+		transfers = append(transfers, Transfer{
+			Client:   a.client.String(),
+			Filename: a.tftp.file.Name,
+			Mode:     a.tftp.mode,
+			Sent:     a.sent.Load(),
+			Size:     a.tftp.file.Size,
+			Started:  a.started,
+		})
+	}
+	s.activeMu.Unlock()
+
+	s.multicastMu.Lock()
+	for _, m := range s.multicasts {
+		m.mu.Lock()
+		for _, c := range m.clients {
+			transfers = append(transfers, Transfer{
+				Client:    c.String(),
+				Filename:  m.file.Name,
+				Mode:      modeOctet,
+				Sent:      m.sent,
+				Size:      m.file.Size,
+				Started:   m.started,
+				Multicast: true,
+			})
+		}
+		m.mu.Unlock()
+	}
+	s.multicastMu.Unlock()
+
+	slices.SortFunc(transfers, func(a, b Transfer) int {
+		if c := a.Started.Compare(b.Started); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Client, b.Client)
+	})
+	return transfers
+}
+
+// Health returns nil while the server is listening.
+func (s *Server) Health() error {
+	s.healthMu.Lock()
+	defer s.healthMu.Unlock()
+	return s.health
+}
+
+// Shutdown closes the listener and waits for the transfers in progress.
+// They are aborted when ctx is done first.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	if s.listener != nil {
+		s.listener.Close()
+		s.listener = nil
+	}
+	s.mu.Unlock()
+	s.setHealth(errors.New("TFTP is stopped"))
+
+	done := make(chan struct{})
+	go func() {
+		s.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	s.activeMu.Lock()
+	for a := range s.actives {
+		a.conn.Close()
+	}
+	s.activeMu.Unlock()
+	s.multicastMu.Lock()
+	for _, m := range s.multicasts {
+		m.conn.Close()
+	}
+	s.multicastMu.Unlock()
+	<-done
+	return ctx.Err()
+}
+
+func (s *Server) setHealth(err error) {
+	s.healthMu.Lock()
+	defer s.healthMu.Unlock()
+	s.health = err
+}
+
+func (s *Server) track(conn net.PacketConn, client net.Addr, t *tftp) *active {
+	a := &active{conn: conn, client: client, tftp: t, started: time.Now()}
+	s.activeMu.Lock()
+	defer s.activeMu.Unlock()
+	s.actives[a] = struct{}{}
+	return a
+}
+
+func (s *Server) untrack(a *active) {
+	s.activeMu.Lock()
+	defer s.activeMu.Unlock()
+	delete(s.actives, a)
+}
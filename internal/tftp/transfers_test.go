@@ -0,0 +1,90 @@
+package tftp
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/callus-corn/tao/internal/event"
+)
+
+func TestShutdown(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	s := newServer(NewDirProvider(dir, 0))
+	s.host = "127.0.0.1"
+	if err := os.WriteFile(filepath.Join(dir, "big"), make([]byte, 4096), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	srv, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.listener = srv
+	go s.serve(srv)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.WriteTo(newRRQ("big", modeOctet, nil), srv.LocalAddr())
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	rx := make([]byte, udpMax)
+	if _, _, err := conn.ReadFrom(rx); err != nil {
+		t.Fatal(err)
+	}
+	transfers := s.Transfers()
+	if len(transfers) != 1 || filepath.Base(transfers[0].Filename) != "big" || transfers[0].Sent != 512 {
+		t.Fatalf("got %+v", transfers)
+	}
+
+	// The client never acknowledges, so the transfer is aborted.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("got %v", err)
+	}
+	if len(s.Transfers()) != 0 {
+		t.Fatalf("aborted transfer is listed: %+v", s.Transfers())
+	}
+	if s.Health() == nil {
+		t.Fatal("stopped TFTP is healthy")
+	}
+}
+
+func TestOnEvent(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	s := newServer(NewDirProvider(dir, 0))
+	s.host = "127.0.0.1"
+	if err := os.WriteFile(filepath.Join(dir, fname), []byte("kernel"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	events := make(chan event.Event, 1)
+	s.OnEvent(func(e event.Event) { events <- e })
+
+	srv, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	go s.serve(srv)
+
+	if _, err := NewClient(srv.LocalAddr().String()).Get(fname, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e := <-events:
+		if e.Type != event.TFTPTransfer || e.File != fname || e.IP != "127.0.0.1" {
+			t.Fatalf("got %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("transfer is not reported")
+	}
+}
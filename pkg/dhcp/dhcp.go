@@ -0,0 +1,28 @@
+// Package dhcp is the DHCP server of tao.
+package dhcp
+
+import (
+	"github.com/callus-corn/tao/internal/dhcp"
+	"github.com/callus-corn/tao/pkg/host"
+)
+
+type (
+	// Config is the DHCP section of tao.conf.
+	Config = dhcp.DHCPConfig
+	// Server hands out addresses and points PXE clients to their boot file.
+	Server = dhcp.Server
+	// Lease is an address handed out to a host.
+	Lease = dhcp.Lease
+	// LeaseStore keeps the leases across restarts.
+	LeaseStore = dhcp.LeaseStore
+)
+
+// NewServer returns a server for c handing out the reservations of hosts.
+func NewServer(c Config, hosts *host.Registry) (*Server, error) {
+	return dhcp.NewServer(c, hosts)
+}
+
+// NewFileStore returns a store keeping the leases in the JSON file name.
+func NewFileStore(name string) LeaseStore {
+	return dhcp.NewFileStore(name)
+}
@@ -0,0 +1,51 @@
+package dhcp_test
+
+import (
+	"context"
+	"log"
+
+	"github.com/callus-corn/tao/pkg/dhcp"
+	"github.com/callus-corn/tao/pkg/event"
+	"github.com/callus-corn/tao/pkg/host"
+	"github.com/callus-corn/tao/pkg/profile"
+	"github.com/callus-corn/tao/pkg/tftp"
+)
+
+func ExampleNewServer() {
+	ctx := context.Background()
+
+	hosts := host.NewRegistry()
+	if err := hosts.Set([]host.Host{{MAC: "aa:bb:cc:dd:ee:01", IP: "10.0.0.10", Hostname: "node1"}}); err != nil {
+		log.Fatal(err)
+	}
+	boot, err := tftp.NewServer(tftp.Config{Address: "10.0.0.1:69", SrvDir: "/var/lib/tao"}, hosts, profile.NewRegistry())
+	if err != nil {
+		log.Fatal(err)
+	}
+	srv, err := dhcp.NewServer(dhcp.Config{
+		Address:       "0.0.0.0:67",
+		FileName:      "ipxe.efi",
+		RangeStart:    "10.0.0.100/24",
+		DefaultRouter: "10.0.0.1",
+		DNS:           "10.0.0.1",
+	}, hosts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := srv.SetLeaseStore(dhcp.NewFileStore("/var/lib/tao/leases.json")); err != nil {
+		log.Fatal(err)
+	}
+
+	record := func(e event.Event) { log.Printf("%s %s %s %s", e.Type, e.MAC, e.IP, e.File) }
+	srv.OnEvent(record)
+	boot.OnEvent(record)
+
+	if err := boot.Listen(ctx); err != nil {
+		log.Fatal(err)
+	}
+	if err := srv.Listen(ctx); err != nil {
+		log.Fatal(err)
+	}
+	defer srv.Shutdown(ctx)
+	defer boot.Shutdown(ctx)
+}
@@ -0,0 +1,23 @@
+// Package event describes what the tao servers see of the hosts they boot.
+package event
+
+import "github.com/callus-corn/tao/internal/event"
+
+type (
+	// Type is what has happened to a host.
+	Type = event.Type
+	// Event is a message handled or a file served for a host.
+	Event = event.Event
+)
+
+// The types of events.
+const (
+	DHCPDiscover    = event.DHCPDiscover
+	DHCPAck         = event.DHCPAck
+	TFTPTransfer    = event.TFTPTransfer
+	HTTPRequest     = event.HTTPRequest
+	InstallProgress = event.InstallProgress
+	InstallLog      = event.InstallLog
+	InstallDone     = event.InstallDone
+	InstallFailed   = event.InstallFailed
+)
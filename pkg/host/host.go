@@ -0,0 +1,25 @@
+// Package host is the registry of the hosts known to tao.
+package host
+
+import "github.com/callus-corn/tao/internal/host"
+
+type (
+	// Host is a reservation, or a host seen through DHCP.
+	Host = host.Host
+	// Network is what DHCP configures the hosts with.
+	Network = host.Network
+	// Entry is a known host as kept by a store.
+	Entry = host.Entry
+	// Registry is the set of known hosts shared by the servers.
+	Registry = host.Registry
+)
+
+// NewRegistry returns a registry without any host.
+func NewRegistry() *Registry {
+	return host.NewRegistry()
+}
+
+// NormalizeMAC returns mac in the lower case form separated by colons.
+func NormalizeMAC(mac string) (string, error) {
+	return host.NormalizeMAC(mac)
+}
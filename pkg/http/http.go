@@ -0,0 +1,22 @@
+// Package http is the HTTP server of tao.
+package http
+
+import (
+	"github.com/callus-corn/tao/internal/http"
+	"github.com/callus-corn/tao/pkg/host"
+	"github.com/callus-corn/tao/pkg/profile"
+)
+
+type (
+	// Config is the HTTP section of tao.conf.
+	Config = http.HTTPConfig
+	// Server serves files, templates and instance metadata.
+	Server = http.Server
+	// TemplateData is what the .tmpl files under SrvDir see.
+	TemplateData = http.TemplateData
+)
+
+// NewServer returns a server for c looking up its clients in hosts.
+func NewServer(c Config, hosts *host.Registry, profiles *profile.Registry) (*Server, error) {
+	return http.NewServer(c, hosts, profiles)
+}
@@ -0,0 +1,39 @@
+// Package inventory follows the machines booted by tao through provisioning.
+package inventory
+
+import (
+	"github.com/callus-corn/tao/internal/inventory"
+	"github.com/callus-corn/tao/pkg/host"
+)
+
+type (
+	// Inventory keeps the state of each machine.
+	Inventory = inventory.Inventory
+	// Machine is a host followed through its provisioning.
+	Machine = inventory.Machine
+	// Transition is a change of the state of a machine.
+	Transition = inventory.Transition
+	// Report is what the installer of a machine has reported.
+	Report = inventory.Report
+	// State is where a machine is in its provisioning.
+	State = inventory.State
+)
+
+// The states of machines.
+const (
+	Discovered   = inventory.Discovered
+	Ready        = inventory.Ready
+	Provisioning = inventory.Provisioning
+	Installed    = inventory.Installed
+	Failed       = inventory.Failed
+)
+
+// New returns an empty inventory of the hosts of hosts.
+func New(hosts *host.Registry) *Inventory {
+	return inventory.New(hosts)
+}
+
+// ParseState returns the state named s.
+func ParseState(s string) (State, error) {
+	return inventory.ParseState(s)
+}
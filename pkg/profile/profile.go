@@ -0,0 +1,22 @@
+// Package profile generates iPXE, GRUB and pxelinux configs from profiles.
+package profile
+
+import "github.com/callus-corn/tao/internal/profile"
+
+type (
+	// BootConfig is the Boot section of tao.conf.
+	BootConfig = profile.BootConfig
+	// Profile is an OS image to boot.
+	Profile = profile.Profile
+	// Class assigns a profile to the hosts with its labels.
+	Class = profile.Class
+	// Data is what the command line template of a profile sees.
+	Data = profile.Data
+	// Registry is the set of profiles shared by the servers.
+	Registry = profile.Registry
+)
+
+// NewRegistry returns a registry without any profile.
+func NewRegistry() *Registry {
+	return profile.NewRegistry()
+}
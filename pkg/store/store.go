@@ -0,0 +1,81 @@
+// Package store keeps the state of tao across restarts.
+package store
+
+import (
+	"github.com/callus-corn/tao/internal/store"
+	"github.com/callus-corn/tao/pkg/dhcp"
+	"github.com/callus-corn/tao/pkg/event"
+	"github.com/callus-corn/tao/pkg/host"
+	"github.com/callus-corn/tao/pkg/inventory"
+)
+
+type (
+	// Config is the Store section of tao.conf.
+	Config = store.StoreConfig
+	// Store keeps records by bucket and key.
+	Store = store.Store
+	// Record is a value kept under a key.
+	Record = store.Record
+	// Lease is an entry of the lease history.
+	Lease = store.Lease
+)
+
+// Open opens the store of c. It returns nil when no backend is configured.
+func Open(c Config) (Store, error) {
+	return store.Open(c)
+}
+
+// NewMemory returns a store losing everything when the process exits.
+func NewMemory() Store {
+	return store.NewMemory()
+}
+
+// OpenFile opens a store keeping everything in the JSON file name.
+func OpenFile(name string) (Store, error) {
+	return store.OpenFile(name)
+}
+
+// OpenBolt opens a store in the bbolt database name.
+func OpenBolt(name string) (Store, error) {
+	return store.OpenBolt(name)
+}
+
+// OpenReadOnly opens the file or bbolt store of c for reading.
+func OpenReadOnly(c Config) (Store, error) {
+	return store.OpenReadOnly(c)
+}
+
+// Leases returns the DHCP lease store kept in s.
+func Leases(s Store) dhcp.LeaseStore {
+	return store.Leases(s)
+}
+
+// LoadHosts returns the hosts saved in s.
+func LoadHosts(s Store) ([]host.Entry, error) {
+	return store.LoadHosts(s)
+}
+
+// SaveHosts replaces the hosts saved in s with entries.
+func SaveHosts(s Store, entries []host.Entry) error {
+	return store.SaveHosts(s, entries)
+}
+
+// LoadMachines returns the machines saved in s.
+func LoadMachines(s Store) ([]inventory.Machine, error) {
+	return store.LoadMachines(s)
+}
+
+// SaveMachines replaces the machines saved in s with machines.
+func SaveMachines(s Store, machines []inventory.Machine) error {
+	return store.SaveMachines(s, machines)
+}
+
+// RecordLease adds the lease acknowledged by e to the lease history.
+func RecordLease(s Store, e event.Event) error {
+	return store.RecordLease(s, e)
+}
+
+// History returns the lease history of mac, or of every host if it is empty.
+func History(s Store, mac string) ([]Lease, error) {
+	return store.History(s, mac)
+}
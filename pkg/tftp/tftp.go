@@ -0,0 +1,76 @@
+// Package tftp is the TFTP server and client of tao.
+package tftp
+
+import (
+	"github.com/callus-corn/tao/internal/tftp"
+	"github.com/callus-corn/tao/pkg/host"
+	"github.com/callus-corn/tao/pkg/profile"
+)
+
+type (
+	// Config is the TFTP section of tao.conf.
+	Config = tftp.TFTPConfig
+	// Server serves files over TFTP, those of a Provider set by SetProvider.
+	Server = tftp.Server
+	// Transfer is a file being sent.
+	Transfer = tftp.Transfer
+
+	// Provider opens the files requested from a Server.
+	Provider = tftp.Provider
+	// Request is a file requested by a client.
+	Request = tftp.Request
+	// File is what a Provider returns for a Request.
+	File = tftp.File
+	// TemplateData is what the templates of a template provider see.
+	TemplateData = tftp.TemplateData
+
+	// Client gets files from and puts files to a TFTP server.
+	Client = tftp.Client
+	// Error is an ERROR packet sent by the server.
+	Error = tftp.Error
+)
+
+// NewServer returns a server for c looking up its clients in hosts.
+func NewServer(c Config, hosts *host.Registry, profiles *profile.Registry) (*Server, error) {
+	return tftp.NewServer(c, hosts, profiles)
+}
+
+// NewClient returns a client of the server at addr, such as "10.0.0.1:69".
+func NewClient(addr string) *Client {
+	return tftp.NewClient(addr)
+}
+
+// NewDirProvider serves the files under dir, caching up to cacheSize bytes.
+func NewDirProvider(dir string, cacheSize int64) Provider {
+	return tftp.NewDirProvider(dir, cacheSize)
+}
+
+// NewTemplateProvider renders the templates under dir mapped to patterns.
+func NewTemplateProvider(dir string, templates map[string]string, hosts *host.Registry, profiles *profile.Registry) Provider {
+	return tftp.NewTemplateProvider(dir, templates, hosts, profiles)
+}
+
+// NewFallbackProvider serves a default file when next does not have one.
+func NewFallbackProvider(next Provider, fallbacks map[string]string) Provider {
+	return tftp.NewFallbackProvider(next, fallbacks)
+}
+
+// NewChainProvider serves the file of the first of providers which has it.
+func NewChainProvider(providers ...Provider) Provider {
+	return tftp.NewChainProvider(providers...)
+}
+
+// NewProfileProvider serves the boot configs generated from profiles.
+func NewProfileProvider(hosts *host.Registry, profiles *profile.Registry) Provider {
+	return tftp.NewProfileProvider(hosts, profiles)
+}
+
+// NewLocalBootProvider serves files instead to hosts booting locally.
+func NewLocalBootProvider(next Provider, files map[string]string, hosts *host.Registry, local func(mac string) bool) Provider {
+	return tftp.NewLocalBootProvider(next, files, hosts, local)
+}
+
+// NewFile returns a File of data, named name in the logs.
+func NewFile(name string, data []byte) *File {
+	return tftp.NewFile(name, data)
+}